@@ -0,0 +1,164 @@
+// Copyright (c) 2014 Project Iris. All rights reserved.
+//
+// The current language binding is an official support library of the Iris
+// cloud messaging framework, and as such, the same licensing terms apply.
+// For details please see http://iris.karalabe.com/downloads#License
+
+// Contains the batched event publishing and processing.
+
+package iris
+
+import (
+	"encoding/binary"
+	"errors"
+	"sync/atomic"
+	"time"
+)
+
+// Callback interface for processing events from a single subscribed topic in
+// batches, amortizing the per event scheduling costs of high rate topics.
+type BatchTopicHandler interface {
+	// Callback invoked whenever a batch of events published to the topic is
+	// ready for processing: either the batch size was reached or the linger
+	// time expired since the first event was queued.
+	HandleEvents(events [][]byte)
+}
+
+// Subscribes to a topic, using handler as the callback for arriving batches of
+// events. The BatchSize and BatchLinger fields of the limits define the maximum
+// number of events delivered together and the maximum time to wait for a batch
+// to fill. Ordering keys are not supported for batch subscriptions.
+//
+// Similarly to Subscribe, the method blocks until the subscription is forwarded
+// to the relay.
+func (c *Connection) SubscribeBatch(topic string, handler BatchTopicHandler, limits *TopicLimits) (*Subscription, error) {
+	// Sanity check on the arguments
+	if len(topic) == 0 {
+		return nil, errors.New("empty topic identifier")
+	}
+	if handler == nil {
+		return nil, errors.New("nil subscription handler")
+	}
+	if limits != nil && limits.EventKey != nil {
+		return nil, errors.New("ordering key on batch subscription")
+	}
+	// Make sure the subscription limits have valid values
+	limits = finalizeTopicLimits(limits)
+
+	// Subscribe with the batch handler
+	return c.subscribe(topic, nil, handler, nil, nil, limits)
+}
+
+// Publishes a batch of events asynchronously to topic, packed into a single wire
+// message. Subscribers unpack the batch transparently, processing the events as
+// if they were published one by one. No guarantees are made that all subscribers
+// receive the message (best effort).
+//
+// Batches travel through an internal sibling of the topic, so subscribers using
+// other language bindings don't receive them.
+//
+// The method blocks until the message is forwarded to the local Iris node.
+func (c *Connection) PublishBatch(topic string, events [][]byte) error {
+	// Sanity check on the arguments
+	if len(topic) == 0 {
+		return errors.New("empty topic identifier")
+	}
+	if len(events) == 0 {
+		return errors.New("empty event batch")
+	}
+	for _, event := range events {
+		if event == nil {
+			return errors.New("nil event")
+		}
+	}
+	// Publish and return
+	batch := packEnvelope(envelopeBatch, c.stampSequence("topic:"+topic), packEventBatch(events))
+	c.Log.Debug("publishing new event batch", "topic", topic, "events", len(events), "data", logLazyBlob(batch))
+	return c.sendPublish(envelopeTopic(topic), batch)
+}
+
+// Packs a batch of events into a length prefixed container.
+func packEventBatch(events [][]byte) []byte {
+	batch := binary.AppendUvarint(nil, uint64(len(events)))
+	for _, event := range events {
+		batch = binary.AppendUvarint(batch, uint64(len(event)))
+		batch = append(batch, event...)
+	}
+	return batch
+}
+
+// Unpacks a batch container into its events.
+func unpackEventBatch(message []byte) ([][]byte, error) {
+	// Read the event count, followed by the events themselves
+	count, n := binary.Uvarint(message)
+	if n <= 0 || count > uint64(len(message)) {
+		return nil, errors.New("invalid batch header")
+	}
+	message = message[n:]
+
+	events := make([][]byte, 0, count)
+	for i := uint64(0); i < count; i++ {
+		size, n := binary.Uvarint(message)
+		if n <= 0 || uint64(len(message)-n) < size {
+			return nil, errors.New("invalid batch event header")
+		}
+		events = append(events, message[n:n+int(size)])
+		message = message[n+int(size):]
+	}
+	return events, nil
+}
+
+// Accumulates an event (already accounted in the memory usage) into the current
+// batch, flushing it if full.
+func (t *topic) batchEvent(event []byte) {
+	t.batchLock.Lock()
+	defer t.batchLock.Unlock()
+
+	t.batchBuf = append(t.batchBuf, event)
+	t.batchUsed += len(event)
+
+	switch {
+	case len(t.batchBuf) >= t.limits.BatchSize:
+		t.scheduleBatch()
+	case len(t.batchBuf) == 1:
+		// First event in the batch, start the linger timer
+		gen := t.batchGen
+		t.batchTime = time.AfterFunc(t.limits.BatchLinger, func() {
+			t.batchLock.Lock()
+			defer t.batchLock.Unlock()
+
+			if t.batchGen == gen {
+				t.scheduleBatch()
+			}
+		})
+	}
+}
+
+// Schedules the current batch for processing, if any events are pending.
+func (t *topic) flushBatch() {
+	t.batchLock.Lock()
+	defer t.batchLock.Unlock()
+
+	t.scheduleBatch()
+}
+
+// Schedules the current batch for processing. The batch lock must be held.
+func (t *topic) scheduleBatch() {
+	if len(t.batchBuf) == 0 {
+		return
+	}
+	if t.batchTime != nil {
+		t.batchTime.Stop()
+		t.batchTime = nil
+	}
+	batch, used := t.batchBuf, t.batchUsed
+	t.batchBuf, t.batchUsed = nil, 0
+	t.batchGen++ // Invalidate the linger timer if it already fired
+
+	t.eventPool.Schedule(nil, func() {
+		// Start the processing by decrementing the memory usage
+		atomic.AddInt32(&t.eventUsed, -int32(used))
+		t.logger.Debug("handling scheduled event batch", "events", len(batch))
+		t.batcher.HandleEvents(batch)
+	})
+}
@@ -7,6 +7,7 @@
 package iris
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
 	"sync"
@@ -252,6 +253,99 @@ func TestBroadcastMemoryLimit(t *testing.T) {
 	}
 }
 
+// Tests the sequence gap and duplicate tracking.
+func TestSequenceTracker(t *testing.T) {
+	tracker := newSeqTracker(time.Hour)
+
+	// Feed two senders with a few anomalies and check for duplicate reports
+	arrivals := []struct {
+		sender uint64
+		seq    uint64
+		dup    bool
+	}{
+		{1, 5, false}, {1, 6, false}, {1, 9, false}, // sender 1: 7 and 8 skipped
+		{1, 7, false}, {1, 6, true}, {1, 9, true}, // sender 1: 7 late, 6 and 9 duplicated
+		{2, 1, false}, {2, 2, false}, {2, 2, true}, // sender 2: 2 duplicated
+	}
+	for i, arrival := range arrivals {
+		if dup := tracker.track(arrival.sender, arrival.seq); dup != arrival.dup {
+			t.Errorf("arrival %d: duplicate mismatch: have %v, want %v.", i, dup, arrival.dup)
+		}
+	}
+	want := SequenceStats{Senders: 2, Lost: 1, Duplicates: 3, Reordered: 1}
+	if have := tracker.snapshot(); have != want {
+		t.Fatalf("stats mismatch: have %+v, want %+v.", have, want)
+	}
+	// Verify that idle senders are forgotten, restarting their sequences
+	tracker = newSeqTracker(10 * time.Millisecond)
+	tracker.track(1, 5)
+	tracker.track(2, 1)
+	time.Sleep(15 * time.Millisecond)
+	tracker.track(2, 2)
+
+	if have := tracker.snapshot(); have.Senders != 1 {
+		t.Fatalf("idle sender not forgotten: have %d senders, want %d.", have.Senders, 1)
+	}
+	if tracker.track(1, 5) {
+		t.Fatalf("returning sender's restarted sequence reported as duplicate.")
+	}
+}
+
+// Tests that sequenced broadcasts are unstamped and tracked transparently.
+func TestBroadcastSequencing(t *testing.T) {
+	// Test specific configurations
+	conf := struct {
+		messages int
+	}{10}
+
+	// Register a new service to the relay
+	handler := &broadcastTestHandler{
+		delivers: make(chan []byte, conf.messages),
+	}
+	serv, err := Register(config.relay, config.cluster, handler, nil)
+	if err != nil {
+		t.Fatalf("registration failed: %v.", err)
+	}
+	defer serv.Unregister()
+
+	// Send a plain broadcast resembling a stamp and verify it's left intact
+	plain := []byte("iris-seq:plain")
+	if err := handler.conn.Broadcast(config.cluster, plain); err != nil {
+		t.Fatalf("broadcast failed: %v.", err)
+	}
+	select {
+	case msg := <-handler.delivers:
+		if !bytes.Equal(msg, plain) {
+			t.Fatalf("plain broadcast mismatch: have %q, want %q.", msg, plain)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("plain broadcast not received.")
+	}
+	// Send a few sequenced broadcasts and verify the payloads
+	if err := handler.conn.EnableSequencing(); err != nil {
+		t.Fatalf("failed to enable sequencing: %v.", err)
+	}
+	for i := 0; i < conf.messages; i++ {
+		if err := handler.conn.Broadcast(config.cluster, []byte{byte(i)}); err != nil {
+			t.Fatalf("broadcast failed: %v.", err)
+		}
+	}
+	for i := 0; i < conf.messages; i++ {
+		select {
+		case msg := <-handler.delivers:
+			if len(msg) != 1 {
+				t.Fatalf("sequence stamp not stripped: %v.", msg)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("broadcast #%d not received.", i)
+		}
+	}
+	want := SequenceStats{Senders: 1}
+	if have := serv.BroadcastStats(); have != want {
+		t.Fatalf("stats mismatch: have %+v, want %+v.", have, want)
+	}
+}
+
 // Benchmarks broadcasting a single message.
 func BenchmarkBroadcastLatency(b *testing.B) {
 	// Create the service handler
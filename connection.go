@@ -22,30 +22,52 @@ import (
 // Client connection to the Iris network.
 type Connection struct {
 	// Application layer fields
-	handler ServiceHandler // Handler for connection events
+	cluster  string         // Cluster the connection is registered to (empty if client)
+	instance string         // Unique id of the service instance (empty if client)
+	handler  ServiceHandler // Handler for connection events
 
 	reqIdx  uint64                 // Index to assign the next request
 	reqReps map[uint64]chan []byte // Reply channels for active requests
 	reqErrs map[uint64]chan error  // Error channels for active requests
 	reqLock sync.RWMutex           // Mutex to protect the result channel maps
 
-	subIdx  uint64            // Index to assign the next subscription (logging purposes)
-	subLive map[string]*topic // Active subscriptions
-	subLock sync.RWMutex      // Mutex to protect the subscription map
+	subIdx  uint64                       // Index to assign the next subscription
+	subLive map[string]map[uint64]*topic // Active subscriptions, grouped by topic name
+	subPend map[string]chan struct{}     // Relay (un)subscriptions in flight, closed when done
+	subLock sync.RWMutex                 // Mutex to protect the subscription maps
 
-	tunIdx  uint64             // Index to assign the next tunnel
-	tunLive map[uint64]*Tunnel // Active tunnels
-	tunLock sync.RWMutex       // Mutex to protect the tunnel map
+	tunIdx     uint64             // Index to assign the next tunnel
+	tunLive    map[uint64]*Tunnel // Active tunnels
+	tunInbound *int32             // Number of active inbound tunnels (shared by the service's connections)
+	tunBacklog chan *Tunnel       // Inbound tunnels pending acceptance (nil if handler based)
+	tunLock    sync.RWMutex       // Mutex to protect the tunnel map
+
+	scatterIdx   uint64                        // Index to assign the next scatter request
+	scatterLive  map[uint64]chan *ScatterReply // Reply channels for active scatter requests
+	scatterSize  map[string]int                // Last seen reply counts per cluster (membership estimate)
+	scatterTopic string                        // Private topic gathering scatter replies (empty if none yet)
+	scatterLock  sync.Mutex                    // Mutex to protect the scatter state
+
+	presLive map[string]*presence // Membership views of the watched clusters
+	presLock sync.Mutex           // Mutex to protect the membership views
 
 	// Quality of service fields
 	limits *ServiceLimits // Limits on the inbound message processing
 
-	bcastIdx  uint64           // Index to assign the next inbound broadcast (logging purposes)
-	bcastPool *pool.ThreadPool // Queue and concurrency limiter for the broadcast handlers
-	bcastUsed int32            // Actual memory usage of the broadcast queue
+	bcastIdx   uint64      // Index to assign the next inbound broadcast (logging purposes)
+	bcastPool  *keyedPool  // Queue and concurrency limiter for the broadcast handlers
+	bcastUsed  *int32      // Actual memory usage of the broadcast queue
+	bcastSeqs  *seqTracker // Gap and duplicate tracker of the inbound broadcasts
+	bcastTopic string      // Internal topic carrying the enveloped broadcasts (empty if client)
 
 	reqPool *pool.ThreadPool // Queue and concurrency limiter for the request handlers
-	reqUsed int32            // Actual memory usage of the request queue
+	reqUsed *int32           // Actual memory usage of the request queue
+
+	pubPool *keyedPool // Dispatcher of the inbound events, preserving arrival order per topic
+
+	seqId   uint64            // Sender id stamped on outbound messages (if sequencing)
+	seqNext map[string]uint64 // Last sequence numbers per destination (nil if not sequencing)
+	seqLock sync.Mutex        // Mutex to protect the sequence numbers
 
 	// Network layer fields
 	sock     net.Conn          // Network connection to the iris node
@@ -53,6 +75,7 @@ type Connection struct {
 	sockLock sync.Mutex        // Mutex to atomize message sending
 
 	// Bookkeeping fields
+	drop *sync.Once      // Guard reporting a drop once (shared by the service's connections)
 	init chan struct{}   // Init channel to receive a success signal
 	quit chan chan error // Quit channel to synchronize receiver termination
 	term chan struct{}   // Channel to signal termination to blocked go-routines
@@ -68,7 +91,7 @@ func Connect(port int) (*Connection, error) {
 	logger := Log.New("client", atomic.AddUint64(&nextConnId, 1))
 	logger.Info("connecting new client", "relay_port", port)
 
-	conn, err := newConnection(port, "", nil, nil, logger)
+	conn, err := newConnection(port, "", nil, nil, nil, logger)
 	if err != nil {
 		logger.Warn("failed to connect new client", "reason", err)
 	} else {
@@ -77,8 +100,10 @@ func Connect(port int) (*Connection, error) {
 	return conn, err
 }
 
-// Connects to a local relay endpoint on port and registers as cluster.
-func newConnection(port int, cluster string, handler ServiceHandler, limits *ServiceLimits, logger log15.Logger) (*Connection, error) {
+// Connects to a local relay endpoint on port and registers as cluster. Service
+// connections sharing an owner use its handler queues and allowances instead of
+// their own, and report a drop to the handler only once.
+func newConnection(port int, cluster string, handler ServiceHandler, limits *ServiceLimits, owner *Connection, logger log15.Logger) (*Connection, error) {
 	// Connect to the iris relay node
 	addr, err := net.ResolveTCPAddr("tcp", fmt.Sprintf("localhost:%d", port))
 	if err != nil {
@@ -91,28 +116,53 @@ func newConnection(port int, cluster string, handler ServiceHandler, limits *Ser
 	// Create the relay object
 	conn := &Connection{
 		// Application layer
+		cluster: cluster,
 		handler: handler,
 
 		reqReps: make(map[uint64]chan []byte),
 		reqErrs: make(map[uint64]chan error),
-		subLive: make(map[string]*topic),
+		subLive: make(map[string]map[uint64]*topic),
+		subPend: make(map[string]chan struct{}),
 		tunLive: make(map[uint64]*Tunnel),
 
+		scatterLive: make(map[uint64]chan *ScatterReply),
+		scatterSize: make(map[string]int),
+		presLive:    make(map[string]*presence),
+
+		// Quality of service
+		bcastSeqs: newSeqTracker(defaultServiceLimits.BroadcastSenderExpiry),
+		pubPool:   newKeyedPool(publishLanes, publishKey),
+
 		// Network layer
 		sock:    sock,
 		sockBuf: bufio.NewReadWriter(bufio.NewReader(sock), bufio.NewWriter(sock)),
 
 		// Bookkeeping
+		drop: new(sync.Once),
 		quit: make(chan chan error),
 		term: make(chan struct{}),
 
 		Log: logger,
 	}
-	// Initialize service QoS fields
-	if cluster != "" {
+	// Initialize service QoS fields, sharing the owner's if any
+	switch {
+	case owner != nil:
+		conn.limits = owner.limits
+		conn.bcastSeqs = newSeqTracker(owner.limits.BroadcastSenderExpiry)
+		conn.bcastPool, conn.bcastUsed = owner.bcastPool, owner.bcastUsed
+		conn.reqPool, conn.reqUsed = owner.reqPool, owner.reqUsed
+		conn.tunBacklog, conn.tunInbound = owner.tunBacklog, owner.tunInbound
+		conn.drop = owner.drop
+
+	case cluster != "":
 		conn.limits = limits
-		conn.bcastPool = pool.NewThreadPool(limits.BroadcastThreads)
-		conn.reqPool = pool.NewThreadPool(limits.RequestThreads)
+		conn.bcastSeqs = newSeqTracker(limits.BroadcastSenderExpiry)
+		conn.bcastPool, conn.bcastUsed = newKeyedPool(limits.BroadcastThreads, limits.BroadcastKey), new(int32)
+		if limits.TunnelListen {
+			conn.tunBacklog = make(chan *Tunnel, limits.TunnelBacklog)
+		}
+		conn.reqPool, conn.reqUsed = pool.NewThreadPool(limits.RequestThreads), new(int32)
+		conn.tunInbound = new(int32)
 	}
 	// Initialize the connection and wait for a confirmation
 	if err := conn.sendInit(cluster); err != nil {
@@ -121,7 +171,15 @@ func newConnection(port int, cluster string, handler ServiceHandler, limits *Ser
 	if _, err := conn.procInit(); err != nil {
 		return nil, err
 	}
-	// Start the network receiver and return
+	// Services also receive the enveloped broadcasts of their cluster
+	if cluster != "" {
+		conn.bcastTopic = broadcastTopic(cluster)
+		if err := conn.sendSubscribe(conn.bcastTopic); err != nil {
+			return nil, err
+		}
+	}
+	// Start the event dispatcher and network receiver, then return
+	conn.pubPool.Start()
 	go conn.process()
 	return conn, nil
 }
@@ -140,6 +198,9 @@ func (c *Connection) Broadcast(cluster string, message []byte) error {
 	}
 	// Broadcast and return
 	c.Log.Debug("sending new broadcast", "cluster", cluster, "data", logLazyBlob(message))
+	if stamp := c.stampSequence("cluster:" + cluster); stamp != nil {
+		return c.sendPublish(broadcastTopic(cluster), packEnvelope(0, stamp, message))
+	}
 	return c.sendBroadcast(cluster, message)
 }
 
@@ -200,45 +261,99 @@ func (c *Connection) Request(cluster string, request []byte, timeout time.Durati
 
 // Subscribes to a topic, using handler as the callback for arriving events.
 //
+// Multiple handlers may subscribe to the same topic, each with its own limits,
+// sharing a single subscription within the relay. The same event is delivered
+// to all of them, so handlers must not modify it.
+//
 // The method blocks until the subscription is forwarded to the relay. There
 // might be a small delay between subscription completion and start of event
 // delivery. This is caused by subscription propagation through the network.
 func (c *Connection) Subscribe(topic string, handler TopicHandler, limits *TopicLimits) error {
+	_, err := c.SubscribeHandler(topic, handler, limits)
+	return err
+}
+
+// Subscribes to a topic similarly to Subscribe, but returns a handle through
+// which this particular handler can be unsubscribed, leaving any others on the
+// same topic intact.
+func (c *Connection) SubscribeHandler(topic string, handler TopicHandler, limits *TopicLimits) (*Subscription, error) {
 	// Sanity check on the arguments
 	if len(topic) == 0 {
-		return errors.New("empty topic identifier")
+		return nil, errors.New("empty topic identifier")
 	}
 	if handler == nil {
-		return errors.New("nil subscription handler")
+		return nil, errors.New("nil subscription handler")
 	}
 	// Make sure the subscription limits have valid values
 	limits = finalizeTopicLimits(limits)
 
-	// Subscribe locally
-	c.subLock.Lock()
-	if _, ok := c.subLive[topic]; ok {
-		c.subLock.Unlock()
-		return errors.New("already subscribed")
-	}
-	logger := c.Log.New("topic", atomic.AddUint64(&c.subIdx, 1))
-	logger.Info("subscribing to new topic", "name", topic,
+	// Subscribe with the callback handler
+	return c.subscribe(topic, handler, nil, nil, nil, limits)
+}
+
+// Subscribes locally to a topic delivering either to one of the handlers or a
+// channel stream, optionally filtering the events. The subscription is forwarded to the
+// relay only for the first local subscriber of the topic.
+func (c *Connection) subscribe(name string, handler TopicHandler, batcher BatchTopicHandler, stream *eventStream, filter EventFilter, limits *TopicLimits) (*Subscription, error) {
+	id := atomic.AddUint64(&c.subIdx, 1)
+	logger := c.Log.New("topic", id)
+	logger.Info("subscribing to new topic", "name", name,
 		"limits", log15.Lazy{func() string {
 			return fmt.Sprintf("%dT|%dB", limits.EventThreads, limits.EventMemory)
 		}})
 
-	c.subLive[topic] = newTopic(handler, limits, logger)
-	c.subLock.Unlock()
+	c.subLock.Lock()
+	defer c.subLock.Unlock()
+
+	// Send the subscription request if not yet subscribed through the relay
+	c.waitSubPending(name)
+	subs, ok := c.subLive[name]
+	if !ok {
+		if err := c.syncSubPending(name, c.relaySubscribe); err != nil {
+			return nil, err
+		}
+		subs = make(map[uint64]*topic)
+		c.subLive[name] = subs
+	}
+	// Subscribe locally and return the handle
+	top := newTopic(handler, batcher, stream, filter, limits, logger)
+	subs[id] = top
+
+	return &Subscription{
+		conn:  c,
+		topic: name,
+		id:    id,
+		top:   top,
+	}, nil
+}
 
-	// Send the subscription request
-	err := c.sendSubscribe(topic)
-	if err != nil {
-		c.subLock.Lock()
-		if top, ok := c.subLive[topic]; ok {
-			top.terminate()
-			delete(c.subLive, topic)
+// Waits until no relay (un)subscription is in flight for a topic. The lock
+// needs to be held, and is released while waiting.
+func (c *Connection) waitSubPending(name string) {
+	for {
+		pend, ok := c.subPend[name]
+		if !ok {
+			return
 		}
 		c.subLock.Unlock()
+		<-pend
+		c.subLock.Lock()
 	}
+}
+
+// Forwards a (un)subscription of a topic to the relay with the lock released,
+// making any concurrent subscription changes to the same topic wait for it. The
+// lock needs to be held.
+func (c *Connection) syncSubPending(name string, send func(string) error) error {
+	pend := make(chan struct{})
+	c.subPend[name] = pend
+	c.subLock.Unlock()
+
+	err := send(name)
+
+	c.subLock.Lock()
+	delete(c.subPend, name)
+	close(pend)
 	return err
 }
 
@@ -256,10 +371,14 @@ func (c *Connection) Publish(topic string, event []byte) error {
 	}
 	// Publish and return
 	c.Log.Debug("publishing new event", "topic", topic, "data", logLazyBlob(event))
+	if stamp := c.stampSequence("topic:" + topic); stamp != nil {
+		return c.sendPublish(envelopeTopic(topic), packEnvelope(0, stamp, event))
+	}
 	return c.sendPublish(topic, event)
 }
 
-// Unsubscribes from topic, receiving no more event notifications for it.
+// Unsubscribes from topic, receiving no more event notifications for it. All
+// the local handlers subscribed to the topic are removed.
 //
 // The method blocks until the unsubscription is forwarded to the local Iris node.
 func (c *Connection) Unsubscribe(topic string) error {
@@ -267,27 +386,58 @@ func (c *Connection) Unsubscribe(topic string) error {
 	if len(topic) == 0 {
 		return errors.New("empty topic identifier")
 	}
-	// Log the unsubscription request
-	c.subLock.RLock()
-	if top, ok := c.subLive[topic]; ok {
+	c.subLock.Lock()
+	c.waitSubPending(topic)
+
+	subs, ok := c.subLive[topic]
+	if !ok {
+		c.subLock.Unlock()
+		return errors.New("not subscribed")
+	}
+	for _, top := range subs {
 		top.logger.Info("unsubscribing from topic")
 	}
-	c.subLock.RUnlock()
-
 	// Unsubscribe through the relay and remove if successful
-	err := c.sendUnsubscribe(topic)
-	if err == nil {
-		c.subLock.Lock()
-		defer c.subLock.Unlock()
+	if err := c.syncSubPending(topic, c.relayUnsubscribe); err != nil {
+		c.subLock.Unlock()
+		return err
+	}
+	delete(c.subLive, topic)
+	c.subLock.Unlock()
 
-		if top, ok := c.subLive[topic]; !ok {
-			return errors.New("not subscribed")
-		} else {
-			top.terminate()
-			delete(c.subLive, topic)
+	for _, top := range subs {
+		top.terminate()
+	}
+	return nil
+}
+
+// Removes a single local subscription from a topic, unsubscribing through the
+// relay only if it was the last one.
+func (c *Connection) unsubscribe(name string, id uint64) error {
+	c.subLock.Lock()
+	c.waitSubPending(name)
+
+	top, ok := c.subLive[name][id]
+	if !ok {
+		c.subLock.Unlock()
+		return errors.New("not subscribed")
+	}
+	top.logger.Info("unsubscribing from topic")
+
+	// Unsubscribe through the relay if no other local subscriptions remain
+	if len(c.subLive[name]) == 1 {
+		if err := c.syncSubPending(name, c.relayUnsubscribe); err != nil {
+			c.subLock.Unlock()
+			return err
 		}
+		delete(c.subLive, name)
+	} else {
+		delete(c.subLive[name], id)
 	}
-	return err
+	c.subLock.Unlock()
+
+	top.terminate()
+	return nil
 }
 
 // Opens a direct tunnel to a member of a remote cluster, allowing pairwise-
@@ -299,7 +449,14 @@ func (c *Connection) Unsubscribe(topic string) error {
 // The timeout unit is in milliseconds. Anything lower will fail with an error.
 func (c *Connection) Tunnel(cluster string, timeout time.Duration) (*Tunnel, error) {
 	// Simple call indirection to move into the tunnel source file
-	return c.initTunnel(cluster, timeout)
+	return c.initTunnel(cluster, timeout, &defaultTunnelOptions)
+}
+
+// Opens a direct tunnel to a member of a remote cluster, same as Tunnel, but
+// with custom input buffering and flow control. Any unset option defaults to
+// the preset value.
+func (c *Connection) TunnelWithOptions(cluster string, timeout time.Duration, opts *TunnelOptions) (*Tunnel, error) {
+	return c.initTunnel(cluster, timeout, finalizeTunnelOptions(opts))
 }
 
 // Gracefully terminates the connection removing all subscriptions and closing
@@ -319,9 +476,11 @@ func (c *Connection) Close() error {
 
 	// Terminate all running subscription handlers
 	c.subLock.Lock()
-	for _, topic := range c.subLive {
-		topic.logger.Warn("forcefully terminating subscription")
-		topic.terminate()
+	for _, subs := range c.subLive {
+		for _, topic := range subs {
+			topic.logger.Warn("forcefully terminating subscription")
+			topic.terminate()
+		}
 	}
 	c.subLock.Unlock()
 
@@ -124,6 +124,16 @@ and an optional resource cap.
       defer service.Unregister()
     }
 
+Services interested only in a subset of the inbound events can use
+iris.ServiceFuncs instead, setting only the needed callbacks. Unset ones default
+to a safe behavior: broadcasts are ignored, requests fail with
+iris.ErrNotSupported and tunnels are closed.
+
+    handler := &iris.ServiceFuncs{
+      OnRequest: func(req []byte) ([]byte, error) { return req, nil },
+    }
+    service, err := iris.Register(55555, "echo", handler, nil)
+
 Upon successful registration, Iris invokes the handler's Init method with the
 live iris.Connection object - the service's client connection - through which
 the service itself can initiate outbound requests. Init is called only once and
@@ -210,6 +220,10 @@ fields (i.e. value of zero) will default to the preset ones.
       BroadcastMemory:  64 * 1024 * 1024,
       RequestThreads:   4 * runtime.NumCPU(),
       RequestMemory:    64 * 1024 * 1024,
+      TunnelBacklog:    128,
+      TunnelInbound:    4096,
+      TunnelBuffer:     64 * 1024 * 1024,
+      TunnelRefresh:    1024 * 1024,
     }
 
     // Default limits of the threading and memory usage of a subscription.
@@ -218,9 +232,21 @@ fields (i.e. value of zero) will default to the preset ones.
       EventMemory:  64 * 1024 * 1024,
     }
 
-There is also a sanity limit on the input buffer of a tunnel, but it is not
-exposed through the API as tunnels are meant as structural primitives, not
-sensitive to load. This may change in the future.
+Concurrently processed messages may complete out of order. Should a service or
+subscription need ordering, an ordering key extractor can be set via BroadcastKey
+and EventKey respectively: messages with the same key are processed serially in
+arrival order, whereas different keys still run in parallel.
+
+Inbound tunnels beyond TunnelInbound are rejected, the initiator's Close
+reporting the reason. Services preferring an accept loop over HandleTunnel
+callbacks can set TunnelListen and retrieve tunnels through Service.AcceptTunnel
+or the net.Listener returned by Service.Listen, with at most TunnelBacklog
+tunnels queued.
+
+Each tunnel also limits its input buffer (64MB by default), granting the consumed
+space back to the remote side in batches (1MB by default). Inbound tunnels take
+these from TunnelBuffer and TunnelRefresh, whereas outbound ones can be customized
+via Connection.TunnelWithOptions and iris.TunnelOptions.
 
 Logging
 
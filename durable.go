@@ -0,0 +1,397 @@
+// Copyright (c) 2014 Project Iris. All rights reserved.
+//
+// The current language binding is an official support library of the Iris
+// cloud messaging framework, and as such, the same licensing terms apply.
+// For details please see http://iris.karalabe.com/downloads#License
+
+// Contains the locally durable topics, supporting replay for late subscribers.
+
+package iris
+
+import (
+	"encoding/binary"
+	"errors"
+	"net/url"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Prefix of the relay topics and replay clusters backing the durable topics, to
+// avoid collision with plain ones.
+const durablePrefix = "iris-durable:"
+
+// User limits of the on-disk log of a durable topic.
+type DurableOptions struct {
+	Dir         string        // Directory to store the topic logs in
+	SegmentSize int64         // Size after which a new log segment is started
+	RetainSize  int64         // Total size of the log segments to retain
+	RetainAge   time.Duration // Age of the log segments to retain
+}
+
+// Publisher side of a durable topic. All events are stored in a bounded on-disk
+// log before being published, allowing subscribers to replay the ones they've
+// missed. Each durable topic must have a single publisher.
+type DurableTopic struct {
+	topic string      // Name of the durable topic
+	serv  *Service    // Replay service registered for the topic
+	log   *durableLog // On-disk log of the published events
+
+	quit chan struct{} // Quit channel to stop the retention enforcement
+}
+
+// Opens a durable topic for publishing, recovering any previously logged events
+// and registering a replay service for the subscribers in the Iris network.
+//
+// The log retention limits are enforced on open, whenever a new segment is
+// started and periodically, so quiet topics expire their old events too. The
+// log is not synced to disk on every publish, hence it survives the crash of the
+// process, but not that of the operating system.
+func OpenDurableTopic(port int, topic string, options *DurableOptions) (*DurableTopic, error) {
+	// Sanity check on the arguments
+	if len(topic) == 0 {
+		return nil, errors.New("empty topic identifier")
+	}
+	if options == nil || len(options.Dir) == 0 {
+		return nil, errors.New("missing log directory")
+	}
+	options = finalizeDurableOptions(options)
+
+	// Open the on-disk log and register the replay service
+	log, err := openDurableLog(filepath.Join(options.Dir, url.PathEscape(topic)), options)
+	if err != nil {
+		return nil, err
+	}
+	handler := &ServiceFuncs{
+		OnRequest: func(request []byte) ([]byte, error) {
+			from, n := binary.Uvarint(request)
+			if n <= 0 {
+				return nil, errors.New("invalid replay request")
+			}
+			records, err := log.read(from, durableReplayBatch)
+			if err != nil {
+				return nil, err
+			}
+			return packReplayBatch(records), nil
+		},
+	}
+	serv, err := Register(port, durablePrefix+topic, handler, nil)
+	if err != nil {
+		log.close()
+		return nil, err
+	}
+	serv.Log.Info("durable topic opened", "topic", topic, "next", log.next)
+
+	d := &DurableTopic{
+		topic: topic,
+		serv:  serv,
+		log:   log,
+		quit:  make(chan struct{}),
+	}
+	go d.retain()
+	return d, nil
+}
+
+// Periodically enforces the log retention limits until the topic is closed.
+func (d *DurableTopic) retain() {
+	ticker := time.NewTicker(durableRetainInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-d.quit:
+			return
+		}
+		if err := d.log.expire(); err != nil {
+			d.serv.Log.Warn("failed to enforce log retention", "topic", d.topic, "reason", err)
+		}
+	}
+}
+
+// Merges the user requested durable options with the defaults.
+func finalizeDurableOptions(user *DurableOptions) *DurableOptions {
+	options := new(DurableOptions)
+	*options = *user
+
+	if user.SegmentSize == 0 {
+		options.SegmentSize = defaultDurableOptions.SegmentSize
+	}
+	if user.RetainSize == 0 {
+		options.RetainSize = defaultDurableOptions.RetainSize
+	}
+	if user.RetainAge == 0 {
+		options.RetainAge = defaultDurableOptions.RetainAge
+	}
+	return options
+}
+
+// Stores an event in the topic's log and publishes it asynchronously to the
+// durable subscribers, returning the sequence number assigned to it.
+//
+// The method blocks until the message is forwarded to the local Iris node.
+func (d *DurableTopic) Publish(event []byte) (uint64, error) {
+	// Sanity check on the arguments
+	if event == nil {
+		return 0, errors.New("nil event")
+	}
+	// Log the event, then publish it with its sequence number
+	seq, err := d.log.append(event)
+	if err != nil {
+		return 0, err
+	}
+	d.serv.Log.Debug("publishing durable event", "topic", d.topic, "seq", seq, "data", logLazyBlob(event))
+
+	envelope := binary.AppendUvarint(nil, seq)
+	return seq, d.serv.conn.Publish(durablePrefix+d.topic, append(envelope, event...))
+}
+
+// Unregisters the replay service and closes the topic's log.
+func (d *DurableTopic) Close() error {
+	close(d.quit)
+	err := d.serv.Unregister()
+	if lerr := d.log.close(); err == nil {
+		err = lerr
+	}
+	return err
+}
+
+// Callback interface for processing events from a durable topic.
+type DurableHandler interface {
+	// Callback invoked, serially and in sequence order, for every event of the
+	// durable topic, be it live or replayed.
+	HandleDurableEvent(seq uint64, event []byte)
+}
+
+// Subscription to a durable topic, tracking the sequence of delivered events.
+type DurableSubscription struct {
+	*Subscription
+
+	conn    *Connection    // Connection for requesting replays
+	topic   string         // Name of the durable topic
+	handler DurableHandler // User handler for the events
+
+	next      uint64       // Sequence number of the next expected event (0 = any)
+	held      []*logRecord // Live events held back while a replay is running
+	heldSize  int          // Memory usage of the held back events
+	memory    int          // Memory allowance of the held back events
+	skipped   uint64       // Highest live event dropped instead of held (gap marker)
+	replaying bool         // Whether a replay is filling a gap
+	lost      uint64       // Number of events unrecoverably lost
+	lock      sync.Mutex   // Mutex to serialize event delivery
+}
+
+// Subscribes to a durable topic, using handler as the callback for the arriving
+// events. If from is non-zero, all retained events starting with sequence number
+// from are replayed before the live ones. Gaps in the live event sequence are
+// filled in by replays too; duplicates are discarded.
+//
+// Live events are processed by a single thread to preserve their order, hence
+// the EventThreads and EventKey of the limits are ignored. Live events arriving
+// during a replay are held back within the EventMemory allowance; beyond it they
+// are dropped and fetched by the replay too.
+//
+// The method blocks until the initial replay completes.
+func (c *Connection) SubscribeDurable(topic string, from uint64, handler DurableHandler, limits *TopicLimits) (*DurableSubscription, error) {
+	// Sanity check on the arguments
+	if len(topic) == 0 {
+		return nil, errors.New("empty topic identifier")
+	}
+	if handler == nil {
+		return nil, errors.New("nil subscription handler")
+	}
+	// Make sure the subscription limits have valid values, delivering in order
+	serial := *finalizeTopicLimits(limits)
+	serial.EventThreads, serial.EventKey = 1, nil
+
+	// Subscribe to the live events, holding them back until the past ones are
+	// replayed
+	sub := &DurableSubscription{
+		conn:      c,
+		topic:     topic,
+		handler:   handler,
+		next:      from,
+		memory:    serial.EventMemory,
+		replaying: from != 0,
+	}
+	live, err := c.subscribe(durablePrefix+topic, TopicHandlerFunc(sub.handleEvent), nil, nil, nil, &serial)
+	if err != nil {
+		return nil, err
+	}
+	sub.Subscription = live
+	if from != 0 {
+		sub.replay(0)
+	}
+	return sub, nil
+}
+
+// Returns the number of events that were lost unrecoverably, either because of
+// failed replays or because the publisher's log didn't retain them anymore.
+func (d *DurableSubscription) Lost() uint64 {
+	return atomic.LoadUint64(&d.lost)
+}
+
+// Unpacks a live durable event and delivers it, filling any gaps before it in
+// the background.
+func (d *DurableSubscription) handleEvent(event []byte) {
+	seq, n := binary.Uvarint(event)
+	if n <= 0 {
+		d.conn.Log.Warn("malformed durable event", "topic", d.topic)
+		return
+	}
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	switch {
+	case d.next != 0 && seq < d.next:
+		d.conn.Log.Debug("discarding duplicate durable event", "topic", d.topic, "seq", seq)
+	case d.replaying:
+		d.hold(seq, event[n:])
+	case d.next != 0 && seq > d.next:
+		d.hold(seq, event[n:])
+		d.replaying = true
+		go d.replay(seq)
+	default:
+		d.deliver(seq, event[n:])
+	}
+}
+
+// Holds back a live event until the running replay completes. If the memory
+// allowance is exhausted, the event is dropped instead, marking it for the replay
+// to fetch from the log. The delivery lock must be held.
+func (d *DurableSubscription) hold(seq uint64, event []byte) {
+	if d.heldSize+len(event) > d.memory {
+		d.conn.Log.Debug("dropping held back durable event", "topic", d.topic, "seq", seq, "limit", d.memory)
+		if seq > d.skipped {
+			d.skipped = seq
+		}
+		return
+	}
+	d.held = append(d.held, &logRecord{seq: seq, data: event})
+	d.heldSize += len(event)
+}
+
+// Replays the missing events until sequence number until is reached (or the
+// end of the log if zero), then releases the live events held back meanwhile,
+// replaying any further gaps among them and any events dropped instead of held.
+func (d *DurableSubscription) replay(until uint64) {
+	for {
+		d.fill(until)
+
+		d.lock.Lock()
+		for len(d.held) > 0 {
+			rec := d.held[0]
+			if rec.seq > d.next && rec.seq != until {
+				break // New gap, not yet attempted to replay
+			}
+			d.held, d.heldSize = d.held[1:], d.heldSize-len(rec.data)
+			if rec.seq >= d.next {
+				d.deliver(rec.seq, rec.data)
+			}
+		}
+		switch {
+		case len(d.held) > 0:
+			until = d.held[0].seq
+		case d.skipped >= d.next:
+			until = d.skipped + 1
+		default:
+			d.held, d.heldSize, d.replaying = nil, 0, false
+			d.lock.Unlock()
+			return
+		}
+		d.lock.Unlock()
+	}
+}
+
+// Requests replays from the publisher until sequence number until is reached,
+// or until the end of the log if zero. The delivery lock must not be held, as
+// the requests are made without it.
+func (d *DurableSubscription) fill(until uint64) {
+	for {
+		d.lock.Lock()
+		from := d.next
+		d.lock.Unlock()
+
+		if until != 0 && from >= until {
+			return
+		}
+		request := binary.AppendUvarint(nil, from)
+		reply, err := d.conn.Request(durablePrefix+d.topic, request, durableReplayTimeout)
+
+		var records []*logRecord
+		if err == nil {
+			records, err = unpackReplayBatch(reply)
+		}
+		if err != nil {
+			// Replay failed, skip the missing events
+			d.conn.Log.Warn("durable replay failed", "topic", d.topic, "from", from, "reason", err)
+
+			d.lock.Lock()
+			if until != 0 && d.next < until {
+				atomic.AddUint64(&d.lost, until-d.next)
+				d.next = until
+			}
+			d.lock.Unlock()
+			return
+		}
+		if len(records) == 0 {
+			return // Reached the end of the log
+		}
+		d.lock.Lock()
+		for _, rec := range records {
+			if rec.seq >= d.next {
+				d.deliver(rec.seq, rec.data)
+			}
+		}
+		d.lock.Unlock()
+	}
+}
+
+// Delivers a single event to the user handler, accounting for any unrecoverable
+// gap before it. The delivery lock must be held.
+func (d *DurableSubscription) deliver(seq uint64, event []byte) {
+	if d.next != 0 && seq > d.next {
+		d.conn.Log.Warn("durable events lost", "topic", d.topic, "from", d.next, "to", seq-1)
+		atomic.AddUint64(&d.lost, seq-d.next)
+	}
+	d.handler.HandleDurableEvent(seq, event)
+	d.next = seq + 1
+}
+
+// Packs a batch of log records into a replay reply.
+func packReplayBatch(records []*logRecord) []byte {
+	batch := binary.AppendUvarint(nil, uint64(len(records)))
+	for _, rec := range records {
+		batch = binary.AppendUvarint(batch, rec.seq)
+		batch = binary.AppendUvarint(batch, uint64(len(rec.data)))
+		batch = append(batch, rec.data...)
+	}
+	return batch
+}
+
+// Unpacks a replay reply into its log records.
+func unpackReplayBatch(batch []byte) ([]*logRecord, error) {
+	count, n := binary.Uvarint(batch)
+	if n <= 0 || count > uint64(len(batch)) {
+		return nil, errors.New("invalid replay header")
+	}
+	batch = batch[n:]
+
+	records := make([]*logRecord, 0, count)
+	for i := uint64(0); i < count; i++ {
+		seq, n := binary.Uvarint(batch)
+		if n <= 0 {
+			return nil, errors.New("invalid replay record header")
+		}
+		batch = batch[n:]
+
+		size, n := binary.Uvarint(batch)
+		if n <= 0 || uint64(len(batch)-n) < size {
+			return nil, errors.New("invalid replay record header")
+		}
+		records = append(records, &logRecord{seq: seq, data: batch[n : n+int(size)]})
+		batch = batch[n+int(size):]
+	}
+	return records, nil
+}
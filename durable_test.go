@@ -0,0 +1,250 @@
+// Copyright (c) 2014 Project Iris. All rights reserved.
+//
+// The current language binding is an official support library of the Iris
+// cloud messaging framework, and as such, the same licensing terms apply.
+// For details please see http://iris.karalabe.com/downloads#License
+
+package iris
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+// Tests the segmented log's appending, reading, retention and recovery.
+func TestDurableLog(t *testing.T) {
+	// Test specific configurations
+	conf := struct {
+		events  int
+		segment int64
+		retain  int64
+	}{100, 64, 512}
+
+	dir, err := ioutil.TempDir("", "iris-durable-log")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory: %v.", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Create a log with tiny segments and fill it up
+	limits := &DurableOptions{SegmentSize: conf.segment, RetainSize: conf.retain, RetainAge: time.Hour}
+	log, err := openDurableLog(dir, limits)
+	if err != nil {
+		t.Fatalf("failed to open log: %v.", err)
+	}
+	for i := 0; i < conf.events; i++ {
+		if seq, err := log.append([]byte{byte(i)}); err != nil {
+			t.Fatalf("event %d: append failed: %v.", i, err)
+		} else if seq != uint64(i+1) {
+			t.Fatalf("event %d: sequence mismatch: have %d, want %d.", i, seq, i+1)
+		}
+	}
+	// Verify that the old records were discarded and the new ones retained
+	records, err := log.read(1, 1024)
+	if err != nil {
+		t.Fatalf("failed to read log: %v.", err)
+	}
+	if len(records) == 0 || records[0].seq == 1 {
+		t.Fatalf("retention not enforced: %d records retained.", len(records))
+	}
+	for i, rec := range records {
+		if want := records[0].seq + uint64(i); rec.seq != want {
+			t.Fatalf("record %d: sequence mismatch: have %d, want %d.", i, rec.seq, want)
+		}
+		if !bytes.Equal(rec.data, []byte{byte(rec.seq - 1)}) {
+			t.Fatalf("record %d: data mismatch: have %v, want %v.", i, rec.data, []byte{byte(rec.seq - 1)})
+		}
+	}
+	if last := records[len(records)-1].seq; last != uint64(conf.events) {
+		t.Fatalf("last record mismatch: have %d, want %d.", last, conf.events)
+	}
+	// Reopen the log and verify that the sequence continues
+	if err := log.close(); err != nil {
+		t.Fatalf("failed to close log: %v.", err)
+	}
+	if log, err = openDurableLog(dir, limits); err != nil {
+		t.Fatalf("failed to reopen log: %v.", err)
+	}
+	if seq, err := log.append([]byte{0x00}); err != nil {
+		t.Fatalf("append after reopen failed: %v.", err)
+	} else if seq != uint64(conf.events+1) {
+		t.Fatalf("sequence mismatch after reopen: have %d, want %d.", seq, conf.events+1)
+	}
+	// Reopen the log with a short age limit and verify that it expires on open
+	if err := log.close(); err != nil {
+		t.Fatalf("failed to close log: %v.", err)
+	}
+	time.Sleep(10 * time.Millisecond)
+	if log, err = openDurableLog(dir, &DurableOptions{SegmentSize: conf.segment, RetainSize: conf.retain, RetainAge: time.Millisecond}); err != nil {
+		t.Fatalf("failed to reopen expiring log: %v.", err)
+	}
+	defer log.close()
+
+	if records, err := log.read(1, 1024); err != nil || len(records) != 0 {
+		t.Fatalf("expired records mismatch: have %d/%v, want %d/%v.", len(records), err, 0, nil)
+	}
+	if seq, err := log.append([]byte{0x00}); err != nil {
+		t.Fatalf("append after expiry failed: %v.", err)
+	} else if seq != uint64(conf.events+2) {
+		t.Fatalf("sequence mismatch after expiry: have %d, want %d.", seq, conf.events+2)
+	}
+}
+
+// Durable topic handler for the replay tests.
+type durableTestHandler struct {
+	delivers chan uint64
+}
+
+func (d *durableTestHandler) HandleDurableEvent(seq uint64, event []byte) { d.delivers <- seq }
+
+// Tests that late durable subscribers get the past events replayed.
+func TestDurableReplay(t *testing.T) {
+	// Test specific configurations
+	conf := struct {
+		past int
+		live int
+	}{50, 10}
+
+	dir, err := ioutil.TempDir("", "iris-durable-topic")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory: %v.", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Open a durable topic and publish a batch of events before subscribing
+	durable, err := OpenDurableTopic(config.relay, config.topic, &DurableOptions{Dir: dir})
+	if err != nil {
+		t.Fatalf("failed to open durable topic: %v.", err)
+	}
+	defer durable.Close()
+
+	for i := 0; i < conf.past; i++ {
+		if _, err := durable.Publish([]byte{byte(i)}); err != nil {
+			t.Fatalf("past publish failed: %v.", err)
+		}
+	}
+	// Connect to the local relay and subscribe from the beginning
+	conn, err := Connect(config.relay)
+	if err != nil {
+		t.Fatalf("connection failed: %v", err)
+	}
+	defer conn.Close()
+
+	handler := &durableTestHandler{
+		delivers: make(chan uint64, conf.past+conf.live),
+	}
+	sub, err := conn.SubscribeDurable(config.topic, 1, handler, nil)
+	if err != nil {
+		t.Fatalf("durable subscription failed: %v", err)
+	}
+	defer sub.Close()
+	time.Sleep(100 * time.Millisecond)
+
+	// Publish a few live events and verify the complete ordered sequence
+	for i := 0; i < conf.live; i++ {
+		if _, err := durable.Publish([]byte{byte(i)}); err != nil {
+			t.Fatalf("live publish failed: %v.", err)
+		}
+	}
+	for i := 1; i <= conf.past+conf.live; i++ {
+		select {
+		case seq := <-handler.delivers:
+			if seq != uint64(i) {
+				t.Fatalf("sequence mismatch: have %d, want %d.", seq, i)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("event #%d not received.", i)
+		}
+	}
+	if lost := sub.Lost(); lost != 0 {
+		t.Fatalf("events reported lost: %d.", lost)
+	}
+}
+
+// Tests that gaps in the live events are filled by replays, with the live events
+// arriving meanwhile held back or, beyond the memory allowance, fetched too.
+func TestDurableGap(t *testing.T) {
+	// Test specific configurations
+	conf := struct {
+		missed int
+		live   int
+	}{20, 20}
+
+	dir, err := ioutil.TempDir("", "iris-durable-gap")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory: %v.", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Open a durable topic and subscribe to its live events
+	durable, err := OpenDurableTopic(config.relay, config.topic, &DurableOptions{Dir: dir})
+	if err != nil {
+		t.Fatalf("failed to open durable topic: %v.", err)
+	}
+	defer durable.Close()
+
+	conn, err := Connect(config.relay)
+	if err != nil {
+		t.Fatalf("connection failed: %v", err)
+	}
+	defer conn.Close()
+
+	handler := &durableTestHandler{
+		delivers: make(chan uint64, 1+conf.missed+conf.live),
+	}
+	sub, err := conn.SubscribeDurable(config.topic, 0, handler, nil)
+	if err != nil {
+		t.Fatalf("durable subscription failed: %v", err)
+	}
+	defer sub.Close()
+	time.Sleep(100 * time.Millisecond)
+
+	if _, err := durable.Publish([]byte{0x00}); err != nil {
+		t.Fatalf("first publish failed: %v.", err)
+	}
+	select {
+	case <-handler.delivers:
+	case <-time.After(time.Second):
+		t.Fatalf("first event not received.")
+	}
+	// Log a few events without publishing them, opening a gap
+	for i := 0; i < conf.missed; i++ {
+		if _, err := durable.log.append([]byte{byte(i)}); err != nil {
+			t.Fatalf("unpublished append failed: %v.", err)
+		}
+	}
+	// Shrink the hold back allowance to a single event and publish a few live
+	// events while the gap's replay is pending
+	sub.lock.Lock()
+	sub.memory, sub.replaying = 1, true
+	sub.lock.Unlock()
+
+	for i := 0; i < conf.live; i++ {
+		if _, err := durable.Publish([]byte{byte(i)}); err != nil {
+			t.Fatalf("live publish failed: %v.", err)
+		}
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	// Replay the gap one event at a time and verify the complete ordered sequence
+	defer func(batch int) { durableReplayBatch = batch }(durableReplayBatch)
+	durableReplayBatch = 1
+
+	go sub.replay(uint64(2 + conf.missed))
+	for i := 2; i <= 1+conf.missed+conf.live; i++ {
+		select {
+		case seq := <-handler.delivers:
+			if seq != uint64(i) {
+				t.Fatalf("sequence mismatch: have %d, want %d.", seq, i)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("event #%d not received.", i)
+		}
+	}
+	if lost := sub.Lost(); lost != 0 {
+		t.Fatalf("events reported lost: %d.", lost)
+	}
+}
@@ -0,0 +1,260 @@
+// Copyright (c) 2014 Project Iris. All rights reserved.
+//
+// The current language binding is an official support library of the Iris
+// cloud messaging framework, and as such, the same licensing terms apply.
+// For details please see http://iris.karalabe.com/downloads#License
+
+// Contains the segmented on-disk event log backing the durable topics.
+
+package iris
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Size of a log record's header: the sequence number and the data length.
+const logRecordHeader = 12
+
+// Single log file, containing a consecutive range of records.
+type logSegment struct {
+	first uint64    // Sequence number of the first record in the segment
+	path  string    // Path to the segment file
+	size  int64     // Size of the segment file
+	mod   time.Time // Time of the last write into the segment
+}
+
+// Sequenced event read back from the log.
+type logRecord struct {
+	seq  uint64 // Sequence number of the event
+	data []byte // Event payload
+}
+
+// Segmented append-only log with size and age based retention.
+type durableLog struct {
+	dir    string          // Directory containing the segment files
+	limits *DurableOptions // Segment size and retention limits
+
+	segs []*logSegment // Live segments, oldest first
+	file *os.File      // Active (last) segment opened for appending
+	next uint64        // Sequence number to assign to the next record
+	lock sync.Mutex    // Mutex to protect the log state
+}
+
+// Opens (or creates) a durable log in dir, recovering any previous state.
+func openDurableLog(dir string, limits *DurableOptions) (*durableLog, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	log := &durableLog{
+		dir:    dir,
+		limits: limits,
+		next:   1,
+	}
+	// Collect all the existing segments, ordered by their first record
+	names, err := filepath.Glob(filepath.Join(dir, "*.seg"))
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range names {
+		first, err := strconv.ParseUint(strings.TrimSuffix(filepath.Base(name), ".seg"), 10, 64)
+		if err != nil {
+			continue
+		}
+		info, err := os.Stat(name)
+		if err != nil {
+			return nil, err
+		}
+		log.segs = append(log.segs, &logSegment{first: first, path: name, size: info.Size(), mod: info.ModTime()})
+	}
+	sort.Slice(log.segs, func(i, j int) bool { return log.segs[i].first < log.segs[j].first })
+
+	// Recover the next sequence number from the last segment, or start a new one
+	if len(log.segs) == 0 {
+		return log, log.rotate()
+	}
+	last := log.segs[len(log.segs)-1]
+	if log.file, err = os.OpenFile(last.path, os.O_RDWR, 0600); err != nil {
+		return nil, err
+	}
+	log.next = last.first
+	valid := int64(0)
+	for {
+		rec, size, err := readLogRecord(log.file)
+		if err != nil {
+			break
+		}
+		log.next, valid = rec.seq+1, valid+size
+	}
+	// Drop any partially written trailing record and position for appending
+	if valid != last.size {
+		if err := log.file.Truncate(valid); err != nil {
+			log.file.Close()
+			return nil, err
+		}
+		last.size = valid
+	}
+	if _, err := log.file.Seek(valid, io.SeekStart); err != nil {
+		log.file.Close()
+		return nil, err
+	}
+	// Discard anything expired while the log was closed
+	if err := log.expire(); err != nil {
+		log.file.Close()
+		return nil, err
+	}
+	return log, nil
+}
+
+// Appends a new record to the log, returning its assigned sequence number.
+func (l *durableLog) append(data []byte) (uint64, error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	// Start a new segment if the active one is full
+	if last := l.segs[len(l.segs)-1]; last.size >= l.limits.SegmentSize {
+		if err := l.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	// Serialize the record and write it out in one go
+	record := make([]byte, logRecordHeader+len(data))
+	binary.BigEndian.PutUint64(record, l.next)
+	binary.BigEndian.PutUint32(record[8:], uint32(len(data)))
+	copy(record[logRecordHeader:], data)
+
+	if _, err := l.file.Write(record); err != nil {
+		return 0, err
+	}
+	last := l.segs[len(l.segs)-1]
+	last.size += int64(len(record))
+	last.mod = time.Now()
+
+	seq := l.next
+	l.next++
+	return seq, nil
+}
+
+// Reads the records starting from sequence number from, up to a soft limit of
+// maxBytes payload. If from was already discarded by the retention policy, the
+// oldest available records are returned.
+func (l *durableLog) read(from uint64, maxBytes int) ([]*logRecord, error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	// Find the segment containing the requested record
+	start := 0
+	for i, seg := range l.segs {
+		if seg.first <= from {
+			start = i
+		}
+	}
+	// Collect records until the limit is reached
+	records, size := []*logRecord{}, 0
+	for _, seg := range l.segs[start:] {
+		file, err := os.Open(seg.path)
+		if err != nil {
+			return nil, err
+		}
+		for size < maxBytes {
+			rec, _, err := readLogRecord(file)
+			if err != nil {
+				break
+			}
+			if rec.seq >= from {
+				records, size = append(records, rec), size+len(rec.data)
+			}
+		}
+		file.Close()
+
+		if size >= maxBytes {
+			break
+		}
+	}
+	return records, nil
+}
+
+// Closes the active segment and opens a new one starting at the next sequence
+// number, enforcing the retention limits on the older segments.
+func (l *durableLog) rotate() error {
+	if l.file != nil {
+		if err := l.file.Close(); err != nil {
+			return err
+		}
+	}
+	path := filepath.Join(l.dir, fmt.Sprintf("%020d.seg", l.next))
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	l.file = file
+	l.segs = append(l.segs, &logSegment{first: l.next, path: path, mod: time.Now()})
+
+	return l.retain()
+}
+
+// Enforces the retention limits on a log not being appended to, starting a new
+// segment if the active one expired too.
+func (l *durableLog) expire() error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if last := l.segs[len(l.segs)-1]; last.size > 0 && time.Since(last.mod) > l.limits.RetainAge {
+		return l.rotate()
+	}
+	return l.retain()
+}
+
+// Drops the oldest segments while above the retention limits, always keeping
+// the active one. The lock needs to be held.
+func (l *durableLog) retain() error {
+	total := int64(0)
+	for _, seg := range l.segs {
+		total += seg.size
+	}
+	for len(l.segs) > 1 {
+		oldest := l.segs[0]
+		if total <= l.limits.RetainSize && time.Since(oldest.mod) <= l.limits.RetainAge {
+			break
+		}
+		if err := os.Remove(oldest.path); err != nil {
+			return err
+		}
+		total -= oldest.size
+		l.segs = l.segs[1:]
+	}
+	return nil
+}
+
+// Closes the log's active segment.
+func (l *durableLog) close() error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	return l.file.Close()
+}
+
+// Reads a single record from a segment file, returning its size on disk.
+func readLogRecord(r io.Reader) (*logRecord, int64, error) {
+	header := make([]byte, logRecordHeader)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, 0, err
+	}
+	data := make([]byte, binary.BigEndian.Uint32(header[8:]))
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, 0, err
+	}
+	rec := &logRecord{
+		seq:  binary.BigEndian.Uint64(header),
+		data: data,
+	}
+	return rec, int64(logRecordHeader + len(data)), nil
+}
@@ -0,0 +1,472 @@
+// Copyright (c) 2014 Project Iris. All rights reserved.
+//
+// The current language binding is an official support library of the Iris
+// cloud messaging framework, and as such, the same licensing terms apply.
+// For details please see http://iris.karalabe.com/downloads#License
+
+// Contains the lease based leader election among the members of a cluster.
+
+package iris
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// Prefix of the private cluster each elector joins to answer the election
+// requests, keeping them apart from the application's instance requests.
+const electionClusterPrefix = "iris-elect:"
+
+// Request types of the election protocol.
+const (
+	electionVote  byte = iota // Candidate asking for a vote in a new term
+	electionRenew             // Leader renewing its lease in its current term
+)
+
+// Leader election among the members of a cluster, built on presence heartbeats
+// to discover the electorate and request/reply votes to the private election
+// clusters of the members.
+//
+// Candidates start numbered terms and ask every known member for its vote. A
+// member grants at most one vote per term, and each vote or leader renewal binds
+// it for a lease period, during which it refuses to vote for anyone else. A
+// candidate collecting votes from a majority becomes leader and keeps renewing
+// its lease every heartbeat; if it fails to reach a majority before the lease
+// runs out, it steps down.
+//
+// Safety: at most one member considers itself leader at any time, provided that
+// the electorate size is fixed via the Members option and the clocks of the
+// members advance at roughly the same rate (the leader gives up 10% of its lease
+// as a drift margin). A leader counts its lease from before sending a renewal,
+// whereas members count from its arrival, so it always expires first locally.
+// Lost or delayed messages can only cause spurious step-downs or failed
+// elections, never two leaders. A minority side of a partition cannot elect a
+// leader, and a leader cut off from the majority steps down within a lease.
+//
+// Votes are kept in memory only, and a restarted member rejoins under a new
+// instance id, so it could vote twice in the same term. To prevent that, a new
+// elector refuses all votes and renewals for a full lease, outlasting any lease
+// granted before the restart.
+//
+// If Members is not set, the electorate is estimated from the presence view. A
+// partition then shrinks the majority seen by each side, so both may elect a
+// leader; use it only where that is tolerable.
+type Elector struct {
+	serv    *Service            // Service campaigning for leadership
+	conn    *Connection         // Connection serving the private election cluster
+	opts    *ElectionOptions    // Election timing configuration
+	handler func(leader string) // Handler for leader changes (nil if none)
+	start   time.Time           // Creation time to let the presence view fill up
+	warmup  time.Duration       // Member expiry of the presence view, bounding its fill up
+
+	term     uint64    // Latest term seen by this member
+	votedFor string    // Member voted for in the current term (empty if none)
+	bound    string    // Member this one is bound to by a lease (empty if none)
+	leaseEnd time.Time // Expiry of the lease granted to the bound member
+	leading  bool      // Whether this member is the leader
+	leadEnd  time.Time // Expiry of the local leadership
+	leader   string    // Currently known leader (empty if none)
+	lock     sync.Mutex
+
+	notify chan struct{} // Leader change signaler for the notifier
+	change chan struct{} // State change signaler for campaigns
+	quit   chan struct{} // Quit channel to stop the background go-routines
+	once   sync.Once     // Guard against multiple closes
+}
+
+// Creates a leader elector among the members of the service's cluster. The
+// service is announced via presence if not already, and the cluster watched with
+// the same presence options unless already watched. Leader changes are reported
+// to handler (if not nil) one by one, with the new leader's instance id, empty
+// if none is known.
+func (s *Service) Elector(handler func(leader string), opts *ElectionOptions) (*Elector, error) {
+	e := &Elector{
+		serv:    s,
+		opts:    finalizeElectionOptions(opts),
+		handler: handler,
+		start:   time.Now(),
+		notify:  make(chan struct{}, 1),
+		change:  make(chan struct{}, 1),
+		quit:    make(chan struct{}),
+	}
+	// Make sure the electorate can be discovered, watching it with the same timing
+	// as it is announced with (unless already watched)
+	s.presLock.Lock()
+	silent := s.pres == nil
+	s.presLock.Unlock()
+
+	if silent {
+		if err := s.Announce(nil, nil); err != nil {
+			return nil, err
+		}
+	}
+	presence := s.announceOptions()
+	if err := s.conn.WatchMembers(s.conn.cluster, nil, presence); err != nil {
+		if presence = s.conn.presenceOptions(s.conn.cluster); presence == nil {
+			return nil, err
+		}
+	}
+	e.warmup = presence.Expiry
+
+	// Join the private election cluster to answer the votes and start the elector
+	if !s.elector.CompareAndSwap(nil, e) {
+		return nil, errors.New("elector already running")
+	}
+	voter := &ServiceFuncs{
+		OnRequest: e.handleRequest,
+		OnDrop:    s.conn.handler.HandleDrop,
+	}
+	conn, err := newConnection(s.port, electionCluster(s.conn.instance), voter, nil, s.conn, s.Log.New("election", s.conn.instance))
+	if err != nil {
+		s.elector.CompareAndSwap(e, nil)
+		return nil, err
+	}
+	conn.instance = s.conn.instance
+	e.conn = conn
+
+	go e.loop()
+	go e.deliver()
+	return e, nil
+}
+
+// Merges the user requested election options with the defaults.
+func finalizeElectionOptions(user *ElectionOptions) *ElectionOptions {
+	// If the user didn't specify anything, load the full default set
+	if user == nil {
+		return &defaultElectionOptions
+	}
+	// Check each field and merge only non-specified ones
+	opts := new(ElectionOptions)
+	*opts = *user
+
+	if user.Heartbeat == 0 {
+		opts.Heartbeat = defaultElectionOptions.Heartbeat
+	}
+	if user.Lease == 0 {
+		opts.Lease = defaultElectionOptions.Lease
+	}
+	return opts
+}
+
+// Campaigns for leadership, blocking until this member becomes the leader, the
+// context is cancelled or the elector is closed. Campaigns wait for the lease of
+// any live leader to expire before standing.
+func (e *Elector) Campaign(ctx context.Context) error {
+	for {
+		if e.IsLeader() {
+			return nil
+		}
+		// Wait for the restart guard, the presence view and any binding lease
+		e.lock.Lock()
+		ready := e.start.Add(e.opts.Lease)
+		if e.leaseEnd.After(ready) {
+			ready = e.leaseEnd
+		}
+		if e.opts.Members == 0 {
+			if warmup := e.start.Add(e.warmup); warmup.After(ready) {
+				ready = warmup
+			}
+		}
+		e.lock.Unlock()
+
+		wait := time.Until(ready)
+		if wait <= 0 {
+			if e.elect() {
+				return nil
+			}
+			// Lost the election, back off randomly to avoid vote splits
+			wait = e.opts.Heartbeat + time.Duration(rand.Int63n(int64(e.opts.Heartbeat)))
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-e.quit:
+			return ErrClosed
+		case <-e.change:
+		case <-time.After(wait):
+		}
+	}
+}
+
+// Returns whether this member is currently the leader.
+func (e *Elector) IsLeader() bool {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	return e.leading && time.Now().Before(e.leadEnd)
+}
+
+// Returns the instance id of the currently known leader, or empty if none.
+// Followers learn of the leader through its lease renewals.
+func (e *Elector) Leader() string {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	return e.leader
+}
+
+// Gives up leadership, if held. Other members may take over once the leases
+// granted to this member expire.
+func (e *Elector) Resign() {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	if e.leading {
+		e.stepDown()
+	}
+}
+
+// Resigns and stops taking part in the election.
+func (e *Elector) Close() error {
+	e.Resign()
+
+	var err error
+	e.once.Do(func() {
+		close(e.quit)
+		err = e.conn.Close()
+		e.serv.elector.CompareAndSwap(e, nil)
+	})
+	return err
+}
+
+// Runs a single election round in a new term, returning whether it was won.
+func (e *Elector) elect() bool {
+	e.lock.Lock()
+	e.term++
+	term := e.term
+	e.votedFor = e.serv.Instance()
+	e.lock.Unlock()
+
+	e.serv.Log.Debug("standing for election", "term", term)
+	start := time.Now()
+	won := e.poll(electionVote, term)
+
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	if !won || e.term != term {
+		return false
+	}
+	e.serv.Log.Info("won leader election", "term", term)
+	e.leading, e.leadEnd = true, start.Add(e.opts.Lease*9/10)
+	e.setLeader(e.serv.Instance())
+	return true
+}
+
+// Asks every known member for a vote or lease renewal in term, returning whether
+// a majority of the electorate (including this member) granted it.
+func (e *Elector) poll(kind byte, term uint64) bool {
+	members, err := e.serv.conn.Members(e.serv.conn.cluster)
+	if err != nil {
+		return false
+	}
+	self := e.serv.Instance()
+
+	peers := make([]string, 0, len(members))
+	for _, member := range members {
+		if member.Instance != self {
+			peers = append(peers, member.Instance)
+		}
+	}
+	size := e.opts.Members
+	if size == 0 {
+		size = len(peers) + 1
+	}
+	// Gather the grants concurrently
+	request := []byte{kind}
+	request = binary.AppendUvarint(request, term)
+	request = append(request, self...)
+
+	grants := make(chan bool, len(peers))
+	for _, peer := range peers {
+		go func(peer string) {
+			reply, err := e.serv.conn.Request(electionCluster(peer), request, electionVoteTimeout)
+			if err != nil || len(reply) == 0 {
+				grants <- false
+				return
+			}
+			if seen, n := binary.Uvarint(reply[1:]); n > 0 {
+				e.observe(seen)
+			}
+			grants <- reply[0] == 1
+		}(peer)
+	}
+	granted := 1
+	for range peers {
+		if <-grants {
+			granted++
+		}
+	}
+	return granted > size/2
+}
+
+// Processes a term seen in a reply, stepping down if a newer one started.
+func (e *Elector) observe(term uint64) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	if term > e.term {
+		e.term, e.votedFor = term, ""
+		if e.leading {
+			e.stepDown()
+		}
+	}
+}
+
+// Renews the leader's lease every heartbeat and expires stale leaders.
+func (e *Elector) loop() {
+	ticker := time.NewTicker(e.opts.Heartbeat)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-e.quit:
+			return
+		}
+		e.lock.Lock()
+		leading, term := e.leading, e.term
+		e.lock.Unlock()
+
+		if leading {
+			start := time.Now()
+			renewed := e.poll(electionRenew, term)
+
+			e.lock.Lock()
+			if e.leading && e.term == term && renewed {
+				e.leadEnd = start.Add(e.opts.Lease * 9 / 10)
+			}
+			if e.leading && time.Now().After(e.leadEnd) {
+				e.serv.Log.Warn("failed to renew leadership", "term", term)
+				e.stepDown()
+			}
+			e.lock.Unlock()
+			continue
+		}
+		// Forget about a leader that stopped renewing
+		e.lock.Lock()
+		if e.leader != "" && time.Now().After(e.leaseEnd) {
+			e.setLeader("")
+		}
+		e.lock.Unlock()
+	}
+}
+
+// Answers a vote or lease renewal request of another member.
+func (e *Elector) handleRequest(request []byte) ([]byte, error) {
+	if len(request) < 2 {
+		return nil, errors.New("invalid election request")
+	}
+	kind := request[0]
+	term, n := binary.Uvarint(request[1:])
+	if n <= 0 {
+		return nil, errors.New("invalid election request")
+	}
+	candidate := string(request[1+n:])
+
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	granted := e.grant(kind, term, candidate)
+	reply := []byte{0}
+	if granted {
+		reply[0] = 1
+	}
+	return binary.AppendUvarint(reply, e.term), nil
+}
+
+// Decides on a vote or lease renewal request. The lock needs to be held.
+func (e *Elector) grant(kind byte, term uint64, candidate string) bool {
+	now := time.Now()
+	if term < e.term {
+		return false
+	}
+	// Refuse everything until any lease granted before a restart ran out
+	if now.Before(e.start.Add(e.opts.Lease)) {
+		return false
+	}
+	switch kind {
+	case electionVote:
+		// Refuse while bound to a live leader, or leading
+		if e.bound != "" && e.bound != candidate && now.Before(e.leaseEnd) {
+			return false
+		}
+		if e.leading && now.Before(e.leadEnd) {
+			return false
+		}
+		if term > e.term {
+			e.term, e.votedFor = term, ""
+			if e.leading {
+				e.stepDown()
+			}
+		}
+		if e.votedFor != "" && e.votedFor != candidate {
+			return false
+		}
+		e.votedFor, e.bound, e.leaseEnd = candidate, candidate, now.Add(e.opts.Lease)
+		return true
+
+	case electionRenew:
+		// A term's leader is unique, accept it as is
+		if term > e.term || e.leading {
+			e.term = term
+			if e.leading {
+				e.stepDown()
+			}
+		}
+		e.votedFor, e.bound, e.leaseEnd = candidate, candidate, now.Add(e.opts.Lease)
+		e.setLeader(candidate)
+		return true
+	}
+	return false
+}
+
+// Gives up the local leadership. The lock needs to be held.
+func (e *Elector) stepDown() {
+	e.serv.Log.Info("stepping down from leadership", "term", e.term)
+	e.leading = false
+	if e.leader == e.serv.Instance() {
+		e.setLeader("")
+	}
+}
+
+// Updates the known leader, signaling the change. The lock needs to be held.
+func (e *Elector) setLeader(leader string) {
+	if e.leader == leader {
+		return
+	}
+	e.leader = leader
+	for _, sign := range []chan struct{}{e.notify, e.change} {
+		select {
+		case sign <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Reports the leader changes to the handler one by one, coalescing any rapid
+// flips into the latest state.
+func (e *Elector) deliver() {
+	reported := ""
+	for {
+		select {
+		case <-e.notify:
+		case <-e.quit:
+			return
+		}
+		leader := e.Leader()
+		if leader != reported && e.handler != nil {
+			e.handler(leader)
+		}
+		reported = leader
+	}
+}
+
+// Returns the private election cluster of a service instance.
+func electionCluster(id string) string {
+	return electionClusterPrefix + id
+}
@@ -0,0 +1,118 @@
+// Copyright (c) 2014 Project Iris. All rights reserved.
+//
+// The current language binding is an official support library of the Iris
+// cloud messaging framework, and as such, the same licensing terms apply.
+// For details please see http://iris.karalabe.com/downloads#License
+
+package iris
+
+import (
+	"context"
+	"encoding/binary"
+	"testing"
+	"time"
+)
+
+// Tests that concurrently campaigning members elect exactly one leader, known to
+// all of them, and that another one takes over after a resignation.
+func TestElection(t *testing.T) {
+	// Test specific configurations
+	conf := struct {
+		members  int
+		presence PresenceOptions
+		election ElectionOptions
+	}{
+		3,
+		PresenceOptions{Heartbeat: 25 * time.Millisecond, Expiry: 250 * time.Millisecond},
+		ElectionOptions{Members: 3, Heartbeat: 50 * time.Millisecond, Lease: 250 * time.Millisecond},
+	}
+	// Register the members and start their electors
+	electors := make([]*Elector, conf.members)
+	changes := make(chan string, 64)
+	for i := 0; i < conf.members; i++ {
+		serv, err := Register(config.relay, config.cluster, new(ServiceFuncs), nil)
+		if err != nil {
+			t.Fatalf("registration %d failed: %v.", i, err)
+		}
+		defer serv.Unregister()
+
+		if err := serv.Announce(nil, &conf.presence); err != nil {
+			t.Fatalf("member %d: failed to announce: %v.", i, err)
+		}
+		handler := func(leader string) {}
+		if i == 0 {
+			handler = func(leader string) { changes <- leader }
+		}
+		if electors[i], err = serv.Elector(handler, &conf.election); err != nil {
+			t.Fatalf("member %d: failed to create elector: %v.", i, err)
+		}
+	}
+	// Campaign concurrently and wait for a winner
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	won := make(chan int, conf.members)
+	for i, elector := range electors {
+		go func(id int, elector *Elector) {
+			if elector.Campaign(ctx) == nil {
+				won <- id
+			}
+		}(i, elector)
+	}
+	var leader int
+	select {
+	case leader = <-won:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("leader election timed out.")
+	}
+	// Verify that the leader is unique and known to everyone
+	time.Sleep(3 * conf.election.Heartbeat)
+	for i, elector := range electors {
+		if elector.IsLeader() != (i == leader) {
+			t.Fatalf("member %d: leadership mismatch: have %v, want %v.", i, elector.IsLeader(), i == leader)
+		}
+		if have, want := elector.Leader(), electors[leader].serv.Instance(); have != want {
+			t.Fatalf("member %d: known leader mismatch: have %q, want %q.", i, have, want)
+		}
+	}
+	select {
+	case id := <-won:
+		t.Fatalf("second leader elected: %d.", id)
+	default:
+	}
+	if have := <-changes; have != electors[leader].serv.Instance() {
+		t.Fatalf("leader change notification mismatch: have %q, want %q.", have, electors[leader].serv.Instance())
+	}
+	// Resign the leader and wait for a takeover
+	electors[leader].Close()
+
+	select {
+	case id := <-won:
+		if id == leader {
+			t.Fatalf("resigned member re-elected.")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("leader takeover timed out.")
+	}
+	// Verify that a (re)started member refuses to vote for a full lease
+	serv, err := Register(config.relay, config.cluster, new(ServiceFuncs), nil)
+	if err != nil {
+		t.Fatalf("registration failed: %v.", err)
+	}
+	defer serv.Unregister()
+
+	fresh, err := serv.Elector(nil, &conf.election)
+	if err != nil {
+		t.Fatalf("failed to create elector: %v.", err)
+	}
+	vote := binary.AppendUvarint([]byte{electionVote}, 1<<32)
+	vote = append(vote, electors[leader].serv.Instance()...)
+
+	if reply, err := fresh.handleRequest(vote); err != nil || reply[0] != 0 {
+		t.Fatalf("vote granted during restart guard: %v, %v.", reply, err)
+	}
+	time.Sleep(conf.election.Lease)
+	if reply, err := fresh.handleRequest(vote); err != nil || reply[0] != 1 {
+		t.Fatalf("vote refused after restart guard: %v, %v.", reply, err)
+	}
+}
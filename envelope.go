@@ -0,0 +1,107 @@
+// Copyright (c) 2014 Project Iris. All rights reserved.
+//
+// The current language binding is an official support library of the Iris
+// cloud messaging framework, and as such, the same licensing terms apply.
+// For details please see http://iris.karalabe.com/downloads#License
+
+// Contains the envelope topics carrying the binding specific event and broadcast
+// formats.
+
+package iris
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Prefix of the internal sibling topic carrying the enveloped events of a topic.
+// Plain events are never inspected, only the ones published to the sibling.
+const envelopeTopicPrefix = "iris-envelope:"
+
+// Prefix of the internal topic carrying the enveloped broadcasts and scatter
+// requests of a cluster, subscribed to by every service of the cluster. Plain
+// broadcasts are never inspected, only the ones published to this topic.
+const broadcastTopicPrefix = "iris-broadcast:"
+
+// Flags of an enveloped message, describing the contents following them.
+const (
+	envelopeBatch   byte = 1 << iota // Contents are a batch of events
+	envelopeStamped                  // Contents are preceded by a sequence stamp
+	envelopeScatter                  // Contents are a scatter request (broadcast topic only)
+
+	envelopeKnown = envelopeBatch | envelopeStamped | envelopeScatter // All the flags understood by this binding
+)
+
+// Contents of an enveloped message.
+type envelope struct {
+	flags  byte   // Flags describing the contents
+	sender uint64 // Sequence id of the sender (if stamped)
+	seq    uint64 // Sequence number of the message (if stamped)
+	body   []byte // Message body following the envelope header
+}
+
+// Returns the sibling topic carrying the enveloped events of a topic.
+func envelopeTopic(topic string) string {
+	return envelopeTopicPrefix + topic
+}
+
+// Returns the internal topic carrying the enveloped broadcasts of a cluster.
+func broadcastTopic(cluster string) string {
+	return broadcastTopicPrefix + cluster
+}
+
+// Splits a relay topic name into the user topic and whether it's the envelope
+// sibling of it.
+func parseEnvelopeTopic(name string) (string, bool) {
+	return strings.CutPrefix(name, envelopeTopicPrefix)
+}
+
+// Wraps a body into an envelope with the given content flags, preceded by the
+// sequence stamp if not nil.
+func packEnvelope(flags byte, stamp []byte, body []byte) []byte {
+	if stamp != nil {
+		flags |= envelopeStamped
+	}
+	message := append([]byte{flags}, stamp...)
+	return append(message, body...)
+}
+
+// Unwraps an enveloped message into its stamp and body.
+func unpackEnvelope(message []byte) (*envelope, error) {
+	if len(message) == 0 {
+		return nil, errors.New("empty envelope")
+	}
+	env := &envelope{flags: message[0], body: message[1:]}
+	if env.flags&^envelopeKnown != 0 {
+		return nil, fmt.Errorf("unknown envelope flags %#x", env.flags)
+	}
+	if env.flags&envelopeStamped != 0 {
+		sender, seq, body, err := unstampSequence(env.body)
+		if err != nil {
+			return nil, err
+		}
+		env.sender, env.seq, env.body = sender, seq, body
+	}
+	return env, nil
+}
+
+// Subscribes through the relay to a topic and its envelope sibling.
+func (c *Connection) relaySubscribe(name string) error {
+	if err := c.sendSubscribe(name); err != nil {
+		return err
+	}
+	if err := c.sendSubscribe(envelopeTopic(name)); err != nil {
+		c.sendUnsubscribe(name)
+		return err
+	}
+	return nil
+}
+
+// Unsubscribes through the relay from a topic and its envelope sibling.
+func (c *Connection) relayUnsubscribe(name string) error {
+	if err := c.sendUnsubscribe(envelopeTopic(name)); err != nil {
+		return err
+	}
+	return c.sendUnsubscribe(name)
+}
@@ -14,6 +14,12 @@ var ErrTimeout = errors.New("operation timed out")
 // Returned if an operation is requested on a closed entity.
 var ErrClosed = errors.New("entity closed")
 
+// Returned if a stream of results is abandoned for not being consumed fast enough.
+var ErrOverflow = errors.New("backlog exceeded")
+
+// Returned by the default handlers if an operation is not supported.
+var ErrNotSupported = errors.New("operation not supported")
+
 // Wrapper to differentiate between local and remote errors.
 type RemoteError struct {
 	error
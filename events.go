@@ -19,14 +19,42 @@ func (c *Connection) handleBroadcast(message []byte) {
 	id := int(atomic.AddUint64(&c.bcastIdx, 1))
 	c.Log.Debug("scheduling arrived broadcast", "broadcast", id, "data", logLazyBlob(message))
 
+	c.scheduleBroadcast(id, message)
+}
+
+// Unwraps a broadcast arriving through the cluster's internal topic, tracking
+// the sequence gaps and duplicates, and schedules it for processing. Scatter
+// requests are routed to the request handler instead.
+func (c *Connection) handleEnvelopedBroadcast(message []byte) {
+	id := int(atomic.AddUint64(&c.bcastIdx, 1))
+	c.Log.Debug("scheduling arrived enveloped broadcast", "broadcast", id, "data", logLazyBlob(message))
+
+	env, err := unpackEnvelope(message)
+	if err != nil || env.flags&envelopeBatch != 0 {
+		c.Log.Warn("malformed enveloped broadcast", "broadcast", id, "reason", err)
+		return
+	}
+	if env.flags&envelopeScatter != 0 {
+		c.handleScatter(env.body)
+		return
+	}
+	if env.flags&envelopeStamped != 0 && c.bcastSeqs.track(env.sender, env.seq) && c.limits.BroadcastDedup {
+		c.Log.Debug("discarding duplicate broadcast", "broadcast", id, "sender", env.sender, "seq", env.seq)
+		return
+	}
+	c.scheduleBroadcast(id, env.body)
+}
+
+// Schedules a broadcast message for the service handler to process, if it fits
+// into the memory allowance.
+func (c *Connection) scheduleBroadcast(id int, message []byte) {
 	// Make sure there is enough memory for the message
-	used := int(atomic.LoadInt32(&c.bcastUsed)) // Safe, since only 1 thread increments!
-	if used+len(message) <= c.limits.BroadcastMemory {
-		// Increment the memory usage of the queue and schedule the broadcast
-		atomic.AddInt32(&c.bcastUsed, int32(len(message)))
-		c.bcastPool.Schedule(func() {
+	used, ok := reserveMemory(c.bcastUsed, len(message), c.limits.BroadcastMemory)
+	if ok {
+		// Memory usage of the queue reserved, schedule the broadcast
+		c.bcastPool.Schedule(message, func() {
 			// Start the processing by decrementing the memory usage
-			atomic.AddInt32(&c.bcastUsed, -int32(len(message)))
+			atomic.AddInt32(c.bcastUsed, -int32(len(message)))
 			c.Log.Debug("handling scheduled broadcast", "broadcast", id)
 			c.handler.HandleBroadcast(message)
 		})
@@ -36,22 +64,34 @@ func (c *Connection) handleBroadcast(message []byte) {
 	c.Log.Error("broadcast exceeded memory allowance", "broadcast", id, "limit", c.limits.BroadcastMemory, "used", used, "size", len(message))
 }
 
+// Reserves size bytes of a memory allowance shared by concurrent receivers,
+// returning the usage before the reservation and whether it fit.
+func reserveMemory(used *int32, size int, limit int) (int, bool) {
+	for {
+		have := atomic.LoadInt32(used)
+		if int(have)+size > limit {
+			return int(have), false
+		}
+		if atomic.CompareAndSwapInt32(used, have, have+int32(size)) {
+			return int(have), true
+		}
+	}
+}
+
 // Schedules an application request for the service handler to process.
 func (c *Connection) handleRequest(id uint64, request []byte, timeout time.Duration) {
 	logger := c.Log.New("remote_request", id)
 	logger.Debug("scheduling arrived request", "data", logLazyBlob(request), "timeout", timeout)
 
 	// Make sure there is enough memory for the request
-	used := int(atomic.LoadInt32(&c.reqUsed)) // Safe, since only 1 thread increments!
-	if used+len(request) <= c.limits.RequestMemory {
-		// Increment the memory usage of the queue
-		atomic.AddInt32(&c.reqUsed, int32(len(request)))
+	used, ok := reserveMemory(c.reqUsed, len(request), c.limits.RequestMemory)
+	if ok {
 
 		// Create the expiration timer and schedule the request
 		expiration := time.After(timeout)
 		c.reqPool.Schedule(func() {
 			// Start the processing by decrementing the memory usage
-			atomic.AddInt32(&c.reqUsed, -int32(len(request)))
+			atomic.AddInt32(c.reqUsed, -int32(len(request)))
 
 			// Make sure the request didn't expire while enqueued
 			select {
@@ -94,18 +134,63 @@ func (c *Connection) handleReply(id uint64, reply []byte, fault string) {
 	}
 }
 
-// Forwards a topic publish event to the topic subscription.
-func (c *Connection) handlePublish(topic string, event []byte) {
-	// Fetch the handler and release the lock fast
+// Extracts the dispatch key of an inbound event from its relay topic, mapping
+// the envelope siblings onto their user topics to keep their ordering.
+func publishKey(topic []byte) string {
+	name, _ := parseEnvelopeTopic(string(topic))
+	return name
+}
+
+// Forwards a topic publish event to all the local topic subscriptions.
+func (c *Connection) handlePublish(name string, event []byte) {
+	// Events arriving through the envelope sibling belong to the user topic
+	name, enveloped := parseEnvelopeTopic(name)
+
+	// Fetch the handlers and release the lock fast
 	c.subLock.RLock()
-	top, ok := c.subLive[topic]
+	subs := make([]*topic, 0, len(c.subLive[name]))
+	for _, top := range c.subLive[name] {
+		subs = append(subs, top)
+	}
 	c.subLock.RUnlock()
 
 	// Make sure the subscription is still live
-	if ok {
-		top.handlePublish(event)
-	} else {
-		c.Log.Warn("stale publish arrived", "topic", topic)
+	if len(subs) == 0 {
+		c.Log.Warn("stale publish arrived", "topic", name)
+		return
+	}
+	// Plain events are delivered as is, enveloped ones unwrapped
+	if !enveloped {
+		for _, top := range subs {
+			top.handlePublish(event)
+		}
+		return
+	}
+	env, err := unpackEnvelope(event)
+	if err == nil && env.flags&envelopeScatter != 0 {
+		err = errors.New("scatter request on event topic")
+	}
+	if err != nil {
+		c.Log.Warn("malformed enveloped event arrived", "topic", name, "reason", err)
+		return
+	}
+	events := [][]byte{env.body}
+	if env.flags&envelopeBatch != 0 {
+		if events, err = unpackEventBatch(env.body); err != nil {
+			c.Log.Warn("malformed event batch arrived", "topic", name, "reason", err)
+			return
+		}
+	}
+	// Deliver to all subscriptions not discarding it as a duplicate
+	stamped := env.flags&envelopeStamped != 0
+	for _, top := range subs {
+		if stamped && top.seqs.track(env.sender, env.seq) && top.limits.EventDedup {
+			top.logger.Debug("discarding duplicate event", "sender", env.sender, "seq", env.seq)
+			continue
+		}
+		for _, event := range events {
+			top.handlePublish(event)
+		}
 	}
 }
 
@@ -114,7 +199,7 @@ func (c *Connection) handleClose(reason error) {
 	// Notify the client of the drop if premature
 	if reason != nil {
 		c.Log.Crit("connection dropped", "reason", reason)
-		c.handler.HandleDrop(reason)
+		c.drop.Do(func() { c.handler.HandleDrop(reason) })
 	}
 	// Close all open tunnels
 	c.tunLock.Lock()
@@ -128,10 +213,19 @@ func (c *Connection) handleClose(reason error) {
 // Opens a new local tunnel endpoint and binds it to the remote side.
 func (c *Connection) handleTunnelInit(id uint64, chunkLimit int) {
 	go func() {
-		if tun, err := c.acceptTunnel(id, chunkLimit); err == nil {
+		tun, overflow, err := c.acceptTunnel(id, chunkLimit)
+		if err != nil {
+			return // Failure already logged by the acceptor
+		}
+		// Reject the tunnel if too many are open, otherwise hand it to the application
+		switch {
+		case overflow:
+			tun.reject("inbound tunnel limit exceeded")
+		case c.tunBacklog != nil:
+			c.queueTunnel(tun)
+		default:
 			c.handler.HandleTunnel(tun)
 		}
-		// Else: failure already logged by the acceptor
 	}()
 }
 
@@ -181,5 +275,8 @@ func (c *Connection) handleTunnelClose(id uint64, reason string) {
 	if tun, ok := c.tunLive[id]; ok {
 		tun.handleClose(reason)
 		delete(c.tunLive, id)
+		if tun.inbound {
+			atomic.AddInt32(c.tunInbound, -1)
+		}
 	}
 }
@@ -0,0 +1,110 @@
+// Copyright (c) 2014 Project Iris. All rights reserved.
+//
+// The current language binding is an official support library of the Iris
+// cloud messaging framework, and as such, the same licensing terms apply.
+// For details please see http://iris.karalabe.com/downloads#License
+
+// Contains the content based event filtering and the header envelope helpers.
+
+package iris
+
+import (
+	"encoding/binary"
+	"errors"
+	"sync/atomic"
+)
+
+// Predicate deciding whether an arriving event should be delivered to the
+// subscription or discarded.
+type EventFilter func(event []byte) bool
+
+// Subscribes to a topic similarly to SubscribeHandler, but only delivers the
+// events accepted by filter. The filter runs before the events are accounted
+// against the subscription limits, so discarded events consume neither memory
+// nor handler threads.
+//
+// The filter may be called concurrently and must not modify the event.
+func (c *Connection) SubscribeFiltered(topic string, handler TopicHandler, filter EventFilter, limits *TopicLimits) (*Subscription, error) {
+	// Sanity check on the arguments
+	if len(topic) == 0 {
+		return nil, errors.New("empty topic identifier")
+	}
+	if handler == nil {
+		return nil, errors.New("nil subscription handler")
+	}
+	if filter == nil {
+		return nil, errors.New("nil event filter")
+	}
+	// Make sure the subscription limits have valid values
+	limits = finalizeTopicLimits(limits)
+
+	// Subscribe with the callback handler and filter
+	return c.subscribe(topic, handler, nil, nil, filter, limits)
+}
+
+// Returns the number of events accepted and discarded by the subscription's
+// filter. Unfiltered subscriptions always report zeroes.
+func (s *Subscription) FilterStats() (matched, filtered uint64) {
+	return atomic.LoadUint64(&s.top.eventMatched), atomic.LoadUint64(&s.top.eventFiltered)
+}
+
+// Creates an event filter accepting the enveloped events (see PackHeaders) that
+// have a header called name with the given value. Malformed events are discarded.
+func HeaderFilter(name, value string) EventFilter {
+	return func(event []byte) bool {
+		headers, _, err := UnpackHeaders(event)
+		if err != nil {
+			return false
+		}
+		have, ok := headers[name]
+		return ok && have == value
+	}
+}
+
+// Envelopes an event with a set of string headers, allowing subscribers to
+// filter on them without decoding the event itself.
+func PackHeaders(headers map[string]string, event []byte) []byte {
+	envelope := binary.AppendUvarint(nil, uint64(len(headers)))
+	for name, value := range headers {
+		envelope = binary.AppendUvarint(envelope, uint64(len(name)))
+		envelope = append(envelope, name...)
+		envelope = binary.AppendUvarint(envelope, uint64(len(value)))
+		envelope = append(envelope, value...)
+	}
+	return append(envelope, event...)
+}
+
+// Extracts the headers and the original event from an envelope created by
+// PackHeaders.
+func UnpackHeaders(envelope []byte) (map[string]string, []byte, error) {
+	// Reads a single length prefixed string from the envelope
+	next := func() (string, error) {
+		size, n := binary.Uvarint(envelope)
+		if n <= 0 || uint64(len(envelope)-n) < size {
+			return "", errors.New("invalid header envelope")
+		}
+		field := string(envelope[n : n+int(size)])
+		envelope = envelope[n+int(size):]
+		return field, nil
+	}
+	// Read the header count, followed by the headers themselves
+	count, n := binary.Uvarint(envelope)
+	if n <= 0 || count > uint64(len(envelope)) {
+		return nil, nil, errors.New("invalid header envelope")
+	}
+	envelope = envelope[n:]
+
+	headers := make(map[string]string, count)
+	for i := uint64(0); i < count; i++ {
+		name, err := next()
+		if err != nil {
+			return nil, nil, err
+		}
+		value, err := next()
+		if err != nil {
+			return nil, nil, err
+		}
+		headers[name] = value
+	}
+	return headers, envelope, nil
+}
@@ -0,0 +1,110 @@
+// Copyright (c) 2014 Project Iris. All rights reserved.
+//
+// The current language binding is an official support library of the Iris
+// cloud messaging framework, and as such, the same licensing terms apply.
+// For details please see http://iris.karalabe.com/downloads#License
+
+// Contains the sticky routing to individual service instances.
+
+package iris
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"time"
+)
+
+// Prefix of the private cluster each service instance joins for sticky routing.
+const instanceClusterPrefix = "iris-instance:"
+
+// Generates a new, globally unique service instance id.
+func newInstanceId() (string, error) {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(id), nil
+}
+
+// Returns the private cluster of a service instance.
+func instanceCluster(id string) string {
+	return instanceClusterPrefix + id
+}
+
+// Registers the private instance cluster of a service, serving it through the
+// same handler, queues and allowances as the main cluster.
+func (s *Service) joinInstance(handler ServiceHandler) error {
+	inst, err := newConnection(s.port, instanceCluster(s.conn.instance), handler, nil, s.conn, s.Log.New("instance", s.conn.instance))
+	if err != nil {
+		return err
+	}
+	inst.instance = s.conn.instance
+	s.inst = inst
+	return nil
+}
+
+// Returns the globally unique id of the service instance, through which it can
+// be targeted directly via Connection.RequestInstance or a tunnel.
+func (s *Service) Instance() string {
+	return s.conn.instance
+}
+
+// Returns the instance id of the service the connection belongs to, or empty if
+// it's a client connection.
+func (c *Connection) Instance() string {
+	return c.instance
+}
+
+// Executes a synchronous request to be serviced by a specific service instance,
+// bypassing the load balancing of its cluster. Stateful services can use it to
+// route follow-up requests to the instance holding the session.
+//
+// The timeout unit is in milliseconds. Anything lower will fail with an error.
+func (c *Connection) RequestInstance(id string, request []byte, timeout time.Duration) ([]byte, error) {
+	if len(id) == 0 {
+		return nil, errors.New("empty instance id")
+	}
+	return c.Request(instanceCluster(id), request, timeout)
+}
+
+// Opens a direct tunnel to a specific service instance.
+//
+// The timeout unit is in milliseconds. Anything lower will fail with an error.
+func (c *Connection) TunnelInstance(id string, timeout time.Duration) (*Tunnel, error) {
+	if len(id) == 0 {
+		return nil, errors.New("empty instance id")
+	}
+	return c.Tunnel(instanceCluster(id), timeout)
+}
+
+// Tags a reply with the id of the serving instance, so that the caller can
+// extract it via ParseInstanceReply and route follow-ups to the same instance.
+// Only usable on service connections.
+func (c *Connection) InstanceReply(reply []byte) []byte {
+	return packInstanceReply(c.instance, reply)
+}
+
+// Splits a reply tagged by InstanceReply into the serving instance's id and the
+// original reply.
+func ParseInstanceReply(reply []byte) (string, []byte, error) {
+	return unpackInstanceReply(reply)
+}
+
+// Assembles a tagged reply from the length prefixed instance id and the reply.
+func packInstanceReply(id string, reply []byte) []byte {
+	tagged := make([]byte, 0, binary.MaxVarintLen64+len(id)+len(reply))
+	tagged = binary.AppendUvarint(tagged, uint64(len(id)))
+	tagged = append(tagged, id...)
+	return append(tagged, reply...)
+}
+
+// Splits a tagged reply into the instance id and the reply.
+func unpackInstanceReply(tagged []byte) (string, []byte, error) {
+	size, n := binary.Uvarint(tagged)
+	if n <= 0 || size == 0 || uint64(len(tagged)-n) < size {
+		return "", nil, errors.New("invalid instance reply")
+	}
+	return string(tagged[n : n+int(size)]), tagged[n+int(size):], nil
+}
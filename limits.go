@@ -8,35 +8,187 @@
 
 package iris
 
-import "runtime"
+import (
+	"runtime"
+	"time"
+)
 
 // User limits of the threading and memory usage of a registered service.
 type ServiceLimits struct {
-	BroadcastThreads int // Broadcast handlers to execute concurrently
-	BroadcastMemory  int // Memory allowance for pending broadcasts
-	RequestThreads   int // Request handlers to execute concurrently
-	RequestMemory    int // Memory allowance for pending requests
+	BroadcastThreads      int           // Broadcast handlers to execute concurrently
+	BroadcastMemory       int           // Memory allowance for pending broadcasts
+	BroadcastKey          KeyFunc       // Ordering key of the broadcasts (unordered if nil)
+	BroadcastDedup        bool          // Drop duplicated sequenced broadcasts
+	BroadcastSenderExpiry time.Duration // Idle time after which a sequenced sender is forgotten
+	RequestThreads        int           // Request handlers to execute concurrently
+	RequestMemory         int           // Memory allowance for pending requests
+	TunnelListen          bool          // Queue inbound tunnels for AcceptTunnel instead of HandleTunnel
+	TunnelBacklog         int           // Inbound tunnels pending acceptance (listener only)
+	TunnelInbound         int           // Maximum concurrently open inbound tunnels
+	TunnelBuffer          int           // Input buffer allowance of each inbound tunnel
+	TunnelRefresh         int           // Consumed input accumulated before refreshing the allowance
+}
+
+// User options of a tunnel's input buffering and flow control.
+type TunnelOptions struct {
+	Buffer  int // Input buffer allowance granted to the remote side
+	Refresh int // Consumed input accumulated before refreshing the allowance
+}
+
+// User options of a resumable tunnel session.
+type SessionOptions struct {
+	Buffer int           // Retransmit buffer allowance of unacknowledged messages
+	Expiry time.Duration // Time a detached session waits to be resumed
+}
+
+// User options of the cluster presence announcements and tracking.
+type PresenceOptions struct {
+	Heartbeat time.Duration // Interval between the announcements of a service
+	Expiry    time.Duration // Silence after which a member is considered gone
+}
+
+// User options of a leader election.
+type ElectionOptions struct {
+	Members   int           // Fixed size of the electorate (0 = estimate from presence)
+	Heartbeat time.Duration // Interval between the leader's lease renewals
+	Lease     time.Duration // Time a vote or renewal binds the granting member
+}
+
+// User options of a work queue broker.
+type QueueOptions struct {
+	Visibility  time.Duration // Time a delivered job stays hidden awaiting its ack
+	MaxAttempts int           // Deliveries after which a failing job is dead-lettered
+}
+
+// User options of a sharded cluster client.
+type ShardOptions struct {
+	Replicas int // Virtual nodes of each shard on the hash ring
 }
 
 // User limits of the threading and memory usage of a subscription.
 type TopicLimits struct {
-	EventThreads int // Event handlers to execute concurrently
-	EventMemory  int // Memory allowance for pending events
+	EventThreads      int           // Event handlers to execute concurrently
+	EventMemory       int           // Memory allowance for pending events
+	EventKey          KeyFunc       // Ordering key of the events (unordered if nil)
+	EventDedup        bool          // Drop duplicated sequenced events
+	EventSenderExpiry time.Duration // Idle time after which a sequenced sender is forgotten
+	BatchSize         int           // Maximum number of events in a batch (batch handlers only)
+	BatchLinger       time.Duration // Maximum time to wait for a batch to fill (batch handlers only)
 }
 
 // Default limits of the threading and memory usage of a registered service.
 var defaultServiceLimits = ServiceLimits{
-	BroadcastThreads: 4 * runtime.NumCPU(),
-	BroadcastMemory:  64 * 1024 * 1024,
-	RequestThreads:   4 * runtime.NumCPU(),
-	RequestMemory:    64 * 1024 * 1024,
+	BroadcastThreads:      4 * runtime.NumCPU(),
+	BroadcastMemory:       64 * 1024 * 1024,
+	BroadcastSenderExpiry: 10 * time.Minute,
+	RequestThreads:        4 * runtime.NumCPU(),
+	RequestMemory:         64 * 1024 * 1024,
+	TunnelBacklog:         128,
+	TunnelInbound:         4096,
+	TunnelBuffer:          64 * 1024 * 1024,
+	TunnelRefresh:         1024 * 1024,
 }
 
 // Default limits of the threading and memory usage of a subscription.
 var defaultTopicLimits = TopicLimits{
-	EventThreads: 4 * runtime.NumCPU(),
-	EventMemory:  64 * 1024 * 1024,
+	EventThreads:      4 * runtime.NumCPU(),
+	EventMemory:       64 * 1024 * 1024,
+	EventSenderExpiry: 10 * time.Minute,
+	BatchSize:         256,
+	BatchLinger:       10 * time.Millisecond,
+}
+
+// Default input buffering and flow control of an outbound tunnel.
+var defaultTunnelOptions = TunnelOptions{
+	Buffer:  64 * 1024 * 1024,
+	Refresh: 1024 * 1024,
+}
+
+// Flow control window of a single multiplexed stream.
+var defaultStreamWindow = 256 * 1024
+
+// Number of inbound multiplexed streams pending acceptance.
+var defaultStreamBacklog = 64
+
+// Maximum data payload of a single multiplexed stream frame, bounding the time
+// a stream may monopolize the tunnel.
+var streamFrameLimit = 16 * 1024
+
+// Default announcement interval and member expiry of the presence tracking.
+var defaultPresenceOptions = PresenceOptions{
+	Heartbeat: time.Second,
+	Expiry:    3 * time.Second,
+}
+
+// Default lease renewal interval and lease duration of the leader election.
+var defaultElectionOptions = ElectionOptions{
+	Heartbeat: 250 * time.Millisecond,
+	Lease:     time.Second,
 }
 
-// Size of a tunnel's input buffer.
-var defaultTunnelBuffer = 64 * 1024 * 1024
+// Timeout of a single vote or lease renewal request.
+var electionVoteTimeout = 100 * time.Millisecond
+
+// Interval at which the lock manager expires the timed out leases.
+var lockSweepInterval = 25 * time.Millisecond
+
+// Timeout of a single lock manager request.
+var lockRequestTimeout = time.Second
+
+// Default visibility timeout and delivery attempts of the work queue jobs.
+var defaultQueueOptions = QueueOptions{
+	Visibility:  30 * time.Second,
+	MaxAttempts: 5,
+}
+
+// Interval at which the queue broker redelivers the timed out jobs.
+var queueSweepInterval = 50 * time.Millisecond
+
+// Interval at which idle workers poll the broker in case a notification is lost.
+var queuePollInterval = time.Second
+
+// Timeout of a single work queue request.
+var queueRequestTimeout = time.Second
+
+// Default number of virtual nodes of each shard on the hash ring.
+var defaultShardOptions = ShardOptions{
+	Replicas: 128,
+}
+
+// Default retransmit buffering and expiry of a resumable session.
+var defaultSessionOptions = SessionOptions{
+	Buffer: 16 * 1024 * 1024,
+	Expiry: 5 * time.Minute,
+}
+
+// Number of delivered session messages after which an acknowledgement is sent.
+var sessionAckBatch = 64
+
+// Maximum time to delay a session acknowledgement for batching.
+var sessionAckLinger = 10 * time.Millisecond
+
+// Number of serial lanes the inbound events are spread over by topic.
+var publishLanes = 4 * runtime.NumCPU()
+
+// Number of arrived session messages buffered for the application.
+var sessionInbox = 256
+
+// Number of server-streamed call replies a caller buffers, throttling the remote
+// handler beyond it.
+var rpcStreamBacklog = 64
+
+// Default segment size and retention limits of a durable topic's log.
+var defaultDurableOptions = DurableOptions{
+	SegmentSize: 16 * 1024 * 1024,
+	RetainSize:  256 * 1024 * 1024,
+	RetainAge:   24 * time.Hour,
+}
+
+// Maximum payload size of a single durable topic replay reply.
+var durableReplayBatch = 1024 * 1024
+
+// Interval at which the durable topic logs enforce their retention limits.
+var durableRetainInterval = time.Minute
+
+// Timeout of a single durable topic replay request.
+var durableReplayTimeout = 5 * time.Second
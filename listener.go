@@ -0,0 +1,132 @@
+// Copyright (c) 2014 Project Iris. All rights reserved.
+//
+// The current language binding is an official support library of the Iris
+// cloud messaging framework, and as such, the same licensing terms apply.
+// For details please see http://iris.karalabe.com/downloads#License
+
+// Contains the accept loop based alternative to the tunnel handler callbacks.
+
+package iris
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+)
+
+// Retrieves the next inbound tunnel from the service's backlog, blocking until
+// one arrives, the context is cancelled or the service is unregistered.
+//
+// Inbound tunnels are only queued if the service was registered with the
+// TunnelListen limit set, otherwise they are delivered to HandleTunnel.
+func (s *Service) AcceptTunnel(ctx context.Context) (*Tunnel, error) {
+	tun, err := s.conn.dequeueTunnel(ctx.Done())
+	if tun == nil && err == nil {
+		err = ctx.Err()
+	}
+	return tun, err
+}
+
+// Returns a listener accepting the service's inbound tunnels as stream based
+// connections, allowing the use of net.Listener based servers.
+//
+// Inbound tunnels are only queued if the service was registered with the
+// TunnelListen limit set, otherwise they are delivered to HandleTunnel.
+func (s *Service) Listen() (*TunnelListener, error) {
+	if s.conn.tunBacklog == nil {
+		return nil, errors.New("tunnel listening not enabled")
+	}
+	return &TunnelListener{
+		serv: s,
+		quit: make(chan struct{}),
+	}, nil
+}
+
+// Stream listener over the inbound tunnels of a service, implementing
+// net.Listener. Each accepted connection is the Conn view of a tunnel.
+type TunnelListener struct {
+	serv *Service      // Service accepting the inbound tunnels
+	quit chan struct{} // Quit channel to unblock pending accepts
+	once sync.Once     // Guard against multiple closes
+}
+
+// Implements net.Listener.Accept, waiting for the next inbound tunnel.
+func (l *TunnelListener) Accept() (net.Conn, error) {
+	tun, err := l.serv.conn.dequeueTunnel(l.quit)
+	switch {
+	case err != nil:
+		return nil, err
+	case tun == nil:
+		return nil, ErrClosed
+	}
+	return tun.Conn(), nil
+}
+
+// Implements net.Listener.Close, unblocking any pending accepts and closing the
+// tunnels still queued. The service itself remains intact.
+func (l *TunnelListener) Close() error {
+	l.once.Do(func() {
+		close(l.quit)
+		l.serv.conn.drainTunnels()
+	})
+	return nil
+}
+
+// Implements net.Listener.Addr, returning the cluster of the service.
+func (l *TunnelListener) Addr() net.Addr {
+	return &TunnelAddr{Cluster: l.serv.conn.cluster}
+}
+
+// Queues an inbound tunnel into the acceptance backlog, or rejects it if the
+// backlog is full.
+func (c *Connection) queueTunnel(tun *Tunnel) {
+	select {
+	case c.tunBacklog <- tun:
+		tun.Log.Debug("queued inbound tunnel for acceptance")
+	default:
+		tun.reject("tunnel backlog full")
+	}
+}
+
+// Retrieves the next queued inbound tunnel, blocking until one arrives or the
+// connection terminates. Nil is returned for both if cancel fires first.
+func (c *Connection) dequeueTunnel(cancel <-chan struct{}) (*Tunnel, error) {
+	if c.tunBacklog == nil {
+		return nil, errors.New("tunnel listening not enabled")
+	}
+	select {
+	case tun := <-c.tunBacklog:
+		return tun, nil
+	case <-cancel:
+		return nil, nil
+	case <-c.term:
+		return nil, ErrClosed
+	}
+}
+
+// Closes all the inbound tunnels still queued in the acceptance backlog.
+func (c *Connection) drainTunnels() {
+	if c.tunBacklog == nil {
+		return
+	}
+	for {
+		select {
+		case tun := <-c.tunBacklog:
+			tun.reject("tunnel backlog closed")
+		default:
+			return
+		}
+	}
+}
+
+// Rejects an accepted tunnel by closing it before any data is exchanged.
+//
+// The relay protocol carries no close reason from the clients, so the reason is
+// only logged locally; the initiator sees a plain remote close.
+func (t *Tunnel) reject(reason string) {
+	t.Log.Warn("rejecting inbound tunnel", "reason", reason)
+	if err := t.Close(); err != nil {
+		t.Log.Warn("failed to close rejected tunnel", "reason", err)
+	}
+}
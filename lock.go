@@ -0,0 +1,523 @@
+// Copyright (c) 2014 Project Iris. All rights reserved.
+//
+// The current language binding is an official support library of the Iris
+// cloud messaging framework, and as such, the same licensing terms apply.
+// For details please see http://iris.karalabe.com/downloads#License
+
+// Contains the named lease based lock manager service and its client.
+
+package iris
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"os"
+	"sync"
+	"time"
+)
+
+// Prefix of the topic a lock manager publishes the lease releases on.
+const lockTopicPrefix = "iris-lock:"
+
+// Returned when renewing or releasing a lease that expired or was taken over.
+var ErrLeaseLost = errors.New("lease lost")
+
+// Returns the topic carrying the lease releases of a lock manager cluster.
+func lockTopic(cluster string) string {
+	return lockTopicPrefix + cluster
+}
+
+// Lock manager service granting named, time-bounded leases with fencing tokens.
+// The state is persisted into a local file after every change, before replying,
+// so a restarted manager keeps honoring the granted leases and never reissues a
+// token. The file writes happen outside the state lock, with a single write
+// covering all the changes made while the previous one was in progress.
+//
+// All the requests of a lock cluster must reach the same state, so exactly one
+// manager instance may be registered per cluster (use shard clusters to spread
+// the locks over multiple managers).
+type LockManager struct {
+	serv *Service    // Service serving the lock requests
+	conn *Connection // Connection to publish the releases through
+	path string      // Path to the state file
+
+	locks   map[string]*heldLease // Live leases, indexed by name
+	token   uint64                // Last fencing token issued
+	version uint64                // Number of changes made to the lease state
+	lock    sync.Mutex            // Mutex to protect the lease state
+
+	saved    uint64     // Version of the last persisted lease state
+	saveLock sync.Mutex // Mutex to serialize the state file writes
+
+	quit chan struct{} // Quit channel to stop the expiration
+}
+
+// Single lease held on a named lock.
+type heldLease struct {
+	owner  string    // Id of the locker holding the lease
+	token  uint64    // Fencing token of the lease
+	expiry time.Time // Time at which the lease expires
+}
+
+// Registers a lock manager service into cluster, persisting its state into the
+// file at path (recovering any previous state from it).
+func RegisterLockManager(port int, cluster string, path string, limits *ServiceLimits) (*LockManager, error) {
+	m := &LockManager{
+		path:  path,
+		locks: make(map[string]*heldLease),
+		quit:  make(chan struct{}),
+	}
+	if err := m.load(); err != nil {
+		return nil, err
+	}
+	mux := NewCallMux()
+	mux.Handle("acquire", m.acquire)
+	mux.Handle("renew", m.renew)
+	mux.Handle("release", m.release)
+
+	handler := &ServiceFuncs{
+		OnInit:    func(conn *Connection) error { m.conn = conn; return nil },
+		OnRequest: mux.HandleRequest,
+	}
+	serv, err := Register(port, cluster, handler, limits)
+	if err != nil {
+		return nil, err
+	}
+	m.serv = serv
+
+	go m.expire()
+	return m, nil
+}
+
+// Unregisters the lock manager. The persisted leases remain valid for a
+// manager restarted on the same state file.
+func (m *LockManager) Close() error {
+	close(m.quit)
+	return m.serv.Unregister()
+}
+
+// Grants a lease if the lock is free (or expired), otherwise reports the time
+// left of the current holder's lease. If the requester already holds the lease
+// (e.g. retrying after a lost reply), it's extended and its token returned.
+func (m *LockManager) acquire(request []byte) ([]byte, error) {
+	name, payload, err := unpackCall(request)
+	if err != nil {
+		return nil, err
+	}
+	ttl, n := binary.Uvarint(payload)
+	if n <= 0 || ttl == 0 {
+		return nil, errors.New("invalid lease ttl")
+	}
+	owner := string(payload[n:])
+
+	m.lock.Lock()
+	now := time.Now()
+	expiry := now.Add(time.Duration(ttl) * time.Millisecond)
+
+	held, ok := m.locks[name]
+	switch {
+	case ok && held.owner == owner && now.Before(held.expiry):
+		if expiry.After(held.expiry) {
+			held.expiry = expiry
+		}
+	case ok && now.Before(held.expiry):
+		m.lock.Unlock()
+		return binary.AppendUvarint([]byte{0}, uint64(held.expiry.Sub(now)/time.Millisecond)+1), nil
+	default:
+		m.token++
+		held = &heldLease{owner: owner, token: m.token, expiry: expiry}
+		m.locks[name] = held
+	}
+	token := held.token
+	blob, version := m.snapshot()
+	m.lock.Unlock()
+
+	if err := m.save(blob, version); err != nil {
+		return nil, err
+	}
+	return binary.AppendUvarint([]byte{1}, token), nil
+}
+
+// Extends a live lease identified by its fencing token and owner.
+func (m *LockManager) renew(request []byte) ([]byte, error) {
+	name, payload, err := unpackCall(request)
+	if err != nil {
+		return nil, err
+	}
+	token, n := binary.Uvarint(payload)
+	if n <= 0 {
+		return nil, errors.New("invalid fencing token")
+	}
+	payload = payload[n:]
+
+	ttl, n := binary.Uvarint(payload)
+	if n <= 0 || ttl == 0 {
+		return nil, errors.New("invalid lease ttl")
+	}
+	owner := string(payload[n:])
+
+	m.lock.Lock()
+	held, ok := m.locks[name]
+	if !ok || held.token != token || held.owner != owner || !time.Now().Before(held.expiry) {
+		m.lock.Unlock()
+		return nil, ErrLeaseLost
+	}
+	held.expiry = time.Now().Add(time.Duration(ttl) * time.Millisecond)
+	blob, version := m.snapshot()
+	m.lock.Unlock()
+
+	if err := m.save(blob, version); err != nil {
+		return nil, err
+	}
+	return []byte{}, nil
+}
+
+// Releases a lease identified by its fencing token and owner, notifying the
+// waiters.
+func (m *LockManager) release(request []byte) ([]byte, error) {
+	name, payload, err := unpackCall(request)
+	if err != nil {
+		return nil, err
+	}
+	token, n := binary.Uvarint(payload)
+	if n <= 0 {
+		return nil, errors.New("invalid fencing token")
+	}
+	owner := string(payload[n:])
+
+	m.lock.Lock()
+	held, ok := m.locks[name]
+	if !ok || held.token != token || held.owner != owner {
+		m.lock.Unlock()
+		return nil, ErrLeaseLost
+	}
+	delete(m.locks, name)
+	blob, version := m.snapshot()
+	m.lock.Unlock()
+
+	// The lock is free in memory either way, wake the waiters
+	err = m.save(blob, version)
+	m.notify(name)
+	if err != nil {
+		return nil, err
+	}
+	return []byte{}, nil
+}
+
+// Periodically drops the expired leases, notifying the waiters.
+func (m *LockManager) expire() {
+	ticker := time.NewTicker(lockSweepInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-m.quit:
+			return
+		}
+		var expired []string
+
+		m.lock.Lock()
+		now := time.Now()
+		for name, held := range m.locks {
+			if !now.Before(held.expiry) {
+				delete(m.locks, name)
+				expired = append(expired, name)
+			}
+		}
+		m.lock.Unlock()
+
+		for _, name := range expired {
+			m.notify(name)
+		}
+	}
+}
+
+// Publishes the release of a lock, best effort. The lock must not be held, as
+// the publish blocks on the network.
+func (m *LockManager) notify(name string) {
+	if err := m.conn.Publish(lockTopic(m.conn.cluster), []byte(name)); err != nil {
+		m.serv.Log.Warn("failed to publish lock release", "lock", name, "reason", err)
+	}
+}
+
+// Serializes the lease state after a change, returning it along with its
+// version. The lock needs to be held.
+//
+// A change failing to persist stays in effect in memory. That is safe, as the
+// client is told of the failure: an unconfirmed grant or renewal is never relied
+// upon, and a release lost on a restart only delays the lock's next grant.
+func (m *LockManager) snapshot() ([]byte, uint64) {
+	m.version++
+
+	blob := binary.AppendUvarint(nil, m.token)
+	blob = binary.AppendUvarint(blob, uint64(len(m.locks)))
+	for name, held := range m.locks {
+		blob = append(blob, packCall(name, nil)...)
+		blob = append(blob, packCall(held.owner, nil)...)
+		blob = binary.AppendUvarint(blob, held.token)
+		blob = binary.AppendVarint(blob, held.expiry.UnixNano())
+	}
+	return blob, m.version
+}
+
+// Persists a serialized lease state, atomically replacing the previous one. If
+// a newer version was already persisted, it covers this one too, so nothing is
+// written.
+func (m *LockManager) save(blob []byte, version uint64) error {
+	m.saveLock.Lock()
+	defer m.saveLock.Unlock()
+
+	if version <= m.saved {
+		return nil
+	}
+	file, err := os.OpenFile(m.path+".tmp", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(blob); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(m.path+".tmp", m.path); err != nil {
+		return err
+	}
+	m.saved = version
+	return nil
+}
+
+// Recovers the lease state persisted by a previous manager, if any.
+func (m *LockManager) load() error {
+	blob, err := os.ReadFile(m.path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	corrupt := errors.New("corrupt lock state")
+
+	token, n := binary.Uvarint(blob)
+	if n <= 0 {
+		return corrupt
+	}
+	blob = blob[n:]
+	count, n := binary.Uvarint(blob)
+	if n <= 0 {
+		return corrupt
+	}
+	blob = blob[n:]
+
+	for i := uint64(0); i < count; i++ {
+		var name, owner string
+		for _, field := range []*string{&name, &owner} {
+			size, n := binary.Uvarint(blob)
+			if n <= 0 || uint64(len(blob)-n) < size {
+				return corrupt
+			}
+			*field, blob = string(blob[n:n+int(size)]), blob[n+int(size):]
+		}
+		held, n := binary.Uvarint(blob)
+		if n <= 0 {
+			return corrupt
+		}
+		blob = blob[n:]
+		expiry, n := binary.Varint(blob)
+		if n <= 0 {
+			return corrupt
+		}
+		blob = blob[n:]
+
+		m.locks[name] = &heldLease{owner: owner, token: held, expiry: time.Unix(0, expiry)}
+	}
+	m.token = token
+	return nil
+}
+
+// Lease held on a named lock. The fencing token increases with every grant, so
+// resources guarded by the lock can reject writes carrying a stale token.
+type Lease struct {
+	Name   string    // Name of the leased lock
+	Token  uint64    // Fencing token of the lease
+	Expiry time.Time // Local time before which the lease is surely valid
+}
+
+// Client of a lock manager cluster, acquiring and maintaining leases.
+type Locker struct {
+	conn    *Connection              // Connection to reach the lock manager through
+	cluster string                   // Cluster of the lock manager
+	owner   string                   // Unique id identifying this locker's leases
+	waiters map[string]chan struct{} // Release signalers of the awaited locks
+	watch   *Subscription            // Subscription to the releases (nil if none yet)
+	closed  bool                     // Whether the locker was closed
+	lock    sync.Mutex               // Mutex to protect the waiters
+}
+
+// Creates a client of the lock manager registered as cluster.
+func (c *Connection) Locker(cluster string) (*Locker, error) {
+	if len(cluster) == 0 {
+		return nil, errors.New("empty cluster identifier")
+	}
+	owner, err := newInstanceId()
+	if err != nil {
+		return nil, err
+	}
+	return &Locker{
+		conn:    c,
+		cluster: cluster,
+		owner:   owner,
+		waiters: make(map[string]chan struct{}),
+	}, nil
+}
+
+// Acquires a lease on the named lock for ttl, blocking until the lock becomes
+// free or the context is cancelled. Waiters are woken by release notifications,
+// falling back to the expiry of the current holder's lease.
+//
+// Acquiring a lock already leased by this locker extends and returns the same
+// lease, so that a retry after a lost reply succeeds. Goroutines competing for
+// the same lock thus each need a locker of their own.
+func (l *Locker) Acquire(ctx context.Context, name string, ttl time.Duration) (*Lease, error) {
+	// Sanity check on the arguments
+	if len(name) == 0 {
+		return nil, errors.New("empty lock name")
+	}
+	ttlms := uint64(ttl / time.Millisecond)
+	if ttlms < 1 {
+		return nil, errors.New("invalid lease ttl < 1ms")
+	}
+	request := binary.AppendUvarint(nil, ttlms)
+	request = append(request, l.owner...)
+
+	for {
+		// Register for the release before trying, to not miss it
+		wake, err := l.waiter(name)
+		if err != nil {
+			return nil, err
+		}
+		start := time.Now()
+		reply, err := l.conn.Call(l.cluster, "acquire", packCall(name, request), lockRequestTimeout)
+		if err != nil {
+			return nil, err
+		}
+		if len(reply) == 0 {
+			return nil, errors.New("invalid acquire reply")
+		}
+		value, n := binary.Uvarint(reply[1:])
+		if n <= 0 {
+			return nil, errors.New("invalid acquire reply")
+		}
+		if reply[0] == 1 {
+			return &Lease{Name: name, Token: value, Expiry: start.Add(ttl)}, nil
+		}
+		// Lock held, wait for its release or expiry
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-wake:
+		case <-time.After(time.Duration(value) * time.Millisecond):
+		}
+	}
+}
+
+// Extends a lease held by this locker to ttl from now. If the lease already
+// expired or was taken over, ErrLeaseLost is returned.
+func (l *Locker) Renew(lease *Lease, ttl time.Duration) error {
+	ttlms := uint64(ttl / time.Millisecond)
+	if ttlms < 1 {
+		return errors.New("invalid lease ttl < 1ms")
+	}
+	request := binary.AppendUvarint(nil, lease.Token)
+	request = binary.AppendUvarint(request, ttlms)
+	request = append(request, l.owner...)
+
+	start := time.Now()
+	if _, err := l.conn.Call(l.cluster, "renew", packCall(lease.Name, request), lockRequestTimeout); err != nil {
+		return lockError(err)
+	}
+	lease.Expiry = start.Add(ttl)
+	return nil
+}
+
+// Releases a lease held by this locker, waking up the waiters of the lock. If
+// the lease already expired or was taken over, ErrLeaseLost is returned.
+func (l *Locker) Release(lease *Lease) error {
+	request := binary.AppendUvarint(nil, lease.Token)
+	request = append(request, l.owner...)
+	if _, err := l.conn.Call(l.cluster, "release", packCall(lease.Name, request), lockRequestTimeout); err != nil {
+		return lockError(err)
+	}
+	return nil
+}
+
+// Stops watching the lock releases, failing any pending acquisitions. Held
+// leases are left intact, expiring unless released.
+func (l *Locker) Close() error {
+	l.lock.Lock()
+	if l.closed {
+		l.lock.Unlock()
+		return ErrClosed
+	}
+	l.closed = true
+	for name, wake := range l.waiters {
+		close(wake)
+		delete(l.waiters, name)
+	}
+	watch := l.watch
+	l.lock.Unlock()
+
+	if watch != nil {
+		return watch.Close()
+	}
+	return nil
+}
+
+// Retrieves the release signaler of a lock, subscribing to the releases on
+// first use.
+func (l *Locker) waiter(name string) (chan struct{}, error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.closed {
+		return nil, ErrClosed
+	}
+	if l.watch == nil {
+		watch, err := l.conn.SubscribeHandler(lockTopic(l.cluster), TopicHandlerFunc(l.handleRelease), nil)
+		if err != nil {
+			return nil, err
+		}
+		l.watch = watch
+	}
+	wake, ok := l.waiters[name]
+	if !ok {
+		wake = make(chan struct{})
+		l.waiters[name] = wake
+	}
+	return wake, nil
+}
+
+// Wakes up all the waiters of a released lock.
+func (l *Locker) handleRelease(event []byte) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if wake, ok := l.waiters[string(event)]; ok {
+		close(wake)
+		delete(l.waiters, string(event))
+	}
+}
+
+// Maps a remote lease loss onto ErrLeaseLost.
+func lockError(err error) error {
+	if remote, ok := err.(*RemoteError); ok && remote.Error() == ErrLeaseLost.Error() {
+		return ErrLeaseLost
+	}
+	return err
+}
@@ -0,0 +1,130 @@
+// Copyright (c) 2014 Project Iris. All rights reserved.
+//
+// The current language binding is an official support library of the Iris
+// cloud messaging framework, and as such, the same licensing terms apply.
+// For details please see http://iris.karalabe.com/downloads#License
+
+package iris
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Tests that leases are exclusive, hand over on release and expiry with
+// increasing fencing tokens, and survive a lock manager restart.
+func TestLocker(t *testing.T) {
+	// Test specific configurations
+	conf := struct {
+		ttl time.Duration
+	}{250 * time.Millisecond}
+
+	path := filepath.Join(t.TempDir(), "locks")
+	manager, err := RegisterLockManager(config.relay, config.cluster, path, nil)
+	if err != nil {
+		t.Fatalf("lock manager registration failed: %v.", err)
+	}
+	// Create two competing lockers
+	conn, err := Connect(config.relay)
+	if err != nil {
+		t.Fatalf("connection failed: %v.", err)
+	}
+	defer conn.Close()
+
+	first, err := conn.Locker(config.cluster)
+	if err != nil {
+		t.Fatalf("failed to create first locker: %v.", err)
+	}
+	defer first.Close()
+
+	second, err := conn.Locker(config.cluster)
+	if err != nil {
+		t.Fatalf("failed to create second locker: %v.", err)
+	}
+	defer second.Close()
+
+	ctx := context.Background()
+
+	// Acquire the lock and verify that a competitor blocks until the release
+	lease, err := first.Acquire(ctx, "batch", conf.ttl)
+	if err != nil {
+		t.Fatalf("failed to acquire lock: %v.", err)
+	}
+	acquired := make(chan *Lease, 1)
+	go func() {
+		lease, err := second.Acquire(ctx, "batch", time.Minute)
+		if err != nil {
+			t.Errorf("failed to acquire released lock: %v.", err)
+		}
+		acquired <- lease
+	}()
+	if err := first.Renew(lease, conf.ttl); err != nil {
+		t.Fatalf("failed to renew lease: %v.", err)
+	}
+	select {
+	case <-acquired:
+		t.Fatalf("competing lease granted while lock held.")
+	case <-time.After(conf.ttl / 2):
+	}
+	if err := second.Release(lease); err != ErrLeaseLost {
+		t.Fatalf("foreign release mismatch: have %v, want %v.", err, ErrLeaseLost)
+	}
+	if err := first.Release(lease); err != nil {
+		t.Fatalf("failed to release lease: %v.", err)
+	}
+	var next *Lease
+	select {
+	case next = <-acquired:
+	case <-time.After(conf.ttl / 2):
+		t.Fatalf("release didn't wake up the waiter.")
+	}
+	if next == nil || next.Token <= lease.Token {
+		t.Fatalf("fencing token not increasing: have %v, previous %d.", next, lease.Token)
+	}
+	if err := first.Renew(lease, conf.ttl); err != ErrLeaseLost {
+		t.Fatalf("stale renewal mismatch: have %v, want %v.", err, ErrLeaseLost)
+	}
+	// Restart the lock manager and verify that the lease and tokens survive
+	if err := manager.Close(); err != nil {
+		t.Fatalf("failed to close lock manager: %v.", err)
+	}
+	if manager, err = RegisterLockManager(config.relay, config.cluster, path, nil); err != nil {
+		t.Fatalf("lock manager re-registration failed: %v.", err)
+	}
+	defer manager.Close()
+
+	if err := second.Renew(next, conf.ttl); err != nil {
+		t.Fatalf("failed to renew lease after restart: %v.", err)
+	}
+	// Let the lease expire and verify the takeover
+	ctx, cancel := context.WithTimeout(ctx, 4*conf.ttl)
+	defer cancel()
+
+	last, err := first.Acquire(ctx, "batch", conf.ttl)
+	if err != nil {
+		t.Fatalf("failed to acquire expired lock: %v.", err)
+	}
+	if last.Token <= next.Token {
+		t.Fatalf("fencing token not increasing after restart: have %d, previous %d.", last.Token, next.Token)
+	}
+	// Verify that re-acquiring a held lease returns the same one
+	again, err := first.Acquire(ctx, "batch", conf.ttl)
+	if err != nil {
+		t.Fatalf("failed to re-acquire held lock: %v.", err)
+	}
+	if again.Token != last.Token {
+		t.Fatalf("re-acquired token mismatch: have %d, want %d.", again.Token, last.Token)
+	}
+	if err := second.Release(next); err != ErrLeaseLost {
+		t.Fatalf("stale release mismatch: have %v, want %v.", err, ErrLeaseLost)
+	}
+	// Close the competing locker and verify that it stops acquiring
+	if err := second.Close(); err != nil {
+		t.Fatalf("failed to close locker: %v.", err)
+	}
+	if _, err := second.Acquire(ctx, "batch", conf.ttl); err != ErrClosed {
+		t.Fatalf("acquire after close mismatch: have %v, want %v.", err, ErrClosed)
+	}
+}
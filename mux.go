@@ -0,0 +1,561 @@
+// Copyright (c) 2014 Project Iris. All rights reserved.
+//
+// The current language binding is an official support library of the Iris
+// cloud messaging framework, and as such, the same licensing terms apply.
+// For details please see http://iris.karalabe.com/downloads#License
+
+// Contains the multiplexer running many lightweight streams inside one tunnel.
+
+package iris
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// Frame types of the stream multiplexing protocol.
+const (
+	frameOpen   byte = iota // Opens a new stream
+	frameData               // Carries stream data
+	frameWindow             // Grants the sender additional window
+	frameFin                // Half-closes the sender's direction
+	frameReset              // Aborts the stream in both directions
+)
+
+// Maximum size of a frame header (type and varint stream id).
+const frameHeaderLimit = 1 + binary.MaxVarintLen64
+
+// Stream multiplexer over a single tunnel, running many independent, flow
+// controlled, bidirectional streams without additional relay round-trips.
+type Mux struct {
+	tun *Tunnel // Tunnel carrying the multiplexed streams
+
+	streamIdx  uint64             // Index to assign the next outbound stream
+	streamLive map[uint64]*Stream // Active streams
+	streamLock sync.Mutex         // Mutex to protect the stream map
+
+	backlog  chan *Stream  // Inbound streams pending acceptance
+	sendTurn chan struct{} // FIFO token serializing the frame sends fairly
+	term     chan struct{} // Channel to signal termination to blocked go-routines
+}
+
+// Takes over the tunnel and runs a stream multiplexer on top of it. Both ends
+// of the tunnel need to multiplex it, after which Send, Recv and Conn must not
+// be used any more.
+func (t *Tunnel) Multiplex() *Mux {
+	m := &Mux{
+		tun:        t,
+		streamIdx:  2,
+		streamLive: make(map[uint64]*Stream),
+		backlog:    make(chan *Stream, defaultStreamBacklog),
+		sendTurn:   make(chan struct{}, 1),
+		term:       make(chan struct{}),
+	}
+	// Initiators use odd stream ids, acceptors even ones to avoid collisions
+	if !t.inbound {
+		m.streamIdx = 1
+	}
+	go m.process()
+	return m
+}
+
+// Opens a new stream to the remote side of the multiplexer.
+func (m *Mux) OpenStream() (*Stream, error) {
+	m.streamLock.Lock()
+	if m.streamLive == nil {
+		m.streamLock.Unlock()
+		return nil, ErrClosed
+	}
+	str := newStream(m, m.streamIdx)
+	m.streamIdx += 2
+	m.streamLive[str.id] = str
+	m.streamLock.Unlock()
+
+	if err := m.sendFrame(frameOpen, str.id, nil, nil); err != nil {
+		m.removeStream(str.id)
+		return nil, err
+	}
+	return str, nil
+}
+
+// Retrieves the next stream opened by the remote side, blocking until one
+// arrives, the context is cancelled or the multiplexer terminates.
+func (m *Mux) AcceptStream(ctx context.Context) (*Stream, error) {
+	select {
+	case str := <-m.backlog:
+		return str, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-m.term:
+		return nil, ErrClosed
+	}
+}
+
+// Closes the multiplexer along with the underlying tunnel, aborting all the
+// active streams.
+func (m *Mux) Close() error {
+	err := m.tun.Close()
+	<-m.term
+	return err
+}
+
+// Sends a single frame through the tunnel, waiting for the sending turn first.
+func (m *Mux) sendFrame(kind byte, id uint64, payload []byte, deadline <-chan time.Time) error {
+	// Acquire the sending turn (blocked senders are served in FIFO order)
+	select {
+	case m.sendTurn <- struct{}{}:
+	case <-deadline:
+		return ErrTimeout
+	case <-m.term:
+		return ErrClosed
+	}
+	defer func() { <-m.sendTurn }()
+
+	frame := packStreamFrame(kind, id, payload)
+	return m.tun.sendChunk(frame, len(frame), deadline)
+}
+
+// Reads the inbound frames and dispatches them to the streams until the tunnel
+// is torn down.
+func (m *Mux) process() {
+	for {
+		msg, err := m.tun.Recv(0)
+		if err != nil {
+			break
+		}
+		kind, id, payload, err := unpackStreamFrame(msg)
+		if err != nil {
+			m.tun.Log.Warn("discarding invalid stream frame", "reason", err)
+			continue
+		}
+		switch kind {
+		case frameOpen:
+			m.handleOpen(id)
+		case frameData:
+			m.handleData(id, payload)
+		case frameWindow:
+			m.handleWindow(id, payload)
+		case frameFin:
+			m.handleFin(id)
+		case frameReset:
+			m.handleReset(id)
+		default:
+			m.tun.Log.Warn("discarding unknown stream frame", "type", kind)
+		}
+	}
+	// Tunnel closed, abort all the streams
+	m.streamLock.Lock()
+	for _, str := range m.streamLive {
+		str.terminate(ErrClosed)
+	}
+	m.streamLive = nil
+	m.streamLock.Unlock()
+
+	close(m.term)
+}
+
+// Retrieves an active stream, or nil if not found.
+func (m *Mux) getStream(id uint64) *Stream {
+	m.streamLock.Lock()
+	defer m.streamLock.Unlock()
+
+	return m.streamLive[id]
+}
+
+// Removes a finished stream from the active ones.
+func (m *Mux) removeStream(id uint64) {
+	m.streamLock.Lock()
+	defer m.streamLock.Unlock()
+
+	delete(m.streamLive, id)
+}
+
+// Registers a remotely opened stream and queues it for acceptance, or resets
+// it if the backlog is full.
+func (m *Mux) handleOpen(id uint64) {
+	str := newStream(m, id)
+
+	m.streamLock.Lock()
+	m.streamLive[id] = str
+	m.streamLock.Unlock()
+
+	select {
+	case m.backlog <- str:
+	default:
+		m.tun.Log.Warn("stream backlog full, resetting", "stream", id)
+		m.removeStream(id)
+		go m.sendFrame(frameReset, id, nil, nil)
+	}
+}
+
+// Buffers an arrived data frame into the stream.
+func (m *Mux) handleData(id uint64, data []byte) {
+	if str := m.getStream(id); str != nil {
+		str.handleData(data)
+	}
+}
+
+// Increases the send window of a stream.
+func (m *Mux) handleWindow(id uint64, payload []byte) {
+	space, n := binary.Uvarint(payload)
+	if n <= 0 {
+		m.tun.Log.Warn("discarding invalid window update", "stream", id)
+		return
+	}
+	if str := m.getStream(id); str != nil {
+		str.handleWindow(int(space))
+	}
+}
+
+// Marks the remote direction of a stream finished.
+func (m *Mux) handleFin(id uint64) {
+	if str := m.getStream(id); str != nil {
+		str.handleFin()
+	}
+}
+
+// Aborts a stream reset by the remote side.
+func (m *Mux) handleReset(id uint64) {
+	if str := m.getStream(id); str != nil {
+		m.removeStream(id)
+		str.terminate(errors.New("stream reset by remote"))
+	}
+}
+
+// Lightweight bidirectional stream multiplexed inside a tunnel, implementing
+// net.Conn. Each direction is flow controlled independently and can be
+// finished separately via CloseWrite.
+type Stream struct {
+	id  uint64 // Stream identifier for de/multiplexing
+	mux *Mux   // Multiplexer carrying the stream
+
+	recvBuf    []byte        // Data arrived but not yet read
+	recvUsed   int           // Data read but not yet acknowledged to the remote
+	recvDone   bool          // Whether the remote finished sending
+	recvClosed bool          // Whether the local side stopped reading
+	recvSign   chan struct{} // Data or finish arrival signaler
+
+	sendSpace int           // Remaining send window
+	sendDone  bool          // Whether the local side finished sending
+	sendSign  chan struct{} // Window grant signaler
+
+	readTime  *deadline  // Deadline of the read operations
+	readLock  sync.Mutex // Mutex to serialize the readers
+	writeTime *deadline  // Deadline of the write operations
+	writeLock sync.Mutex // Mutex to serialize the writers
+
+	lock sync.Mutex    // Mutex to protect the stream state
+	term chan struct{} // Channel to signal termination to blocked go-routines
+	stat error         // Failure reason, if terminated
+}
+
+// Creates a new stream endpoint with full windows.
+func newStream(m *Mux, id uint64) *Stream {
+	return &Stream{
+		id:        id,
+		mux:       m,
+		recvSign:  make(chan struct{}, 1),
+		sendSpace: defaultStreamWindow,
+		sendSign:  make(chan struct{}, 1),
+		readTime:  newDeadline(),
+		writeTime: newDeadline(),
+		term:      make(chan struct{}),
+	}
+}
+
+// Returns the multiplexer-unique id of the stream.
+func (s *Stream) ID() uint64 {
+	return s.id
+}
+
+// Implements net.Conn.Read, reading the stream data. Once the remote side has
+// finished sending and all data was consumed, io.EOF is returned.
+func (s *Stream) Read(b []byte) (int, error) {
+	s.readLock.Lock()
+	defer s.readLock.Unlock()
+
+	for {
+		s.lock.Lock()
+		if s.recvClosed {
+			s.lock.Unlock()
+			return 0, ErrClosed
+		}
+		if len(s.recvBuf) > 0 {
+			n := copy(b, s.recvBuf)
+			s.recvBuf = s.recvBuf[n:]
+
+			// Acknowledge the consumed data if a large enough chunk accumulated
+			s.recvUsed += n
+			credit := 0
+			if s.recvUsed >= defaultStreamWindow/2 {
+				credit, s.recvUsed = s.recvUsed, 0
+			}
+			s.lock.Unlock()
+
+			if credit > 0 {
+				s.mux.sendFrame(frameWindow, s.id, binary.AppendUvarint(nil, uint64(credit)), nil)
+			}
+			return n, nil
+		}
+		if s.recvDone {
+			s.lock.Unlock()
+			return 0, io.EOF
+		}
+		select {
+		case <-s.term:
+			s.lock.Unlock()
+			return 0, s.stat
+		default:
+		}
+		// No data yet, reset the arrival flag and wait
+		select {
+		case <-s.recvSign:
+		default:
+		}
+		s.lock.Unlock()
+
+		select {
+		case <-s.recvSign:
+		case <-s.term:
+		case <-s.readTime.wait():
+			return 0, os.ErrDeadlineExceeded
+		}
+	}
+}
+
+// Implements net.Conn.Write, sending the data in bounded frames as the remote
+// window permits.
+func (s *Stream) Write(b []byte) (int, error) {
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+
+	limit := s.mux.tun.chunkLimit - frameHeaderLimit
+	if limit > streamFrameLimit {
+		limit = streamFrameLimit
+	}
+	sent := 0
+	for sent < len(b) {
+		need := len(b) - sent
+		if need > limit {
+			need = limit
+		}
+		size, err := s.reserve(need)
+		if err == nil {
+			err = s.mux.sendFrame(frameData, s.id, b[sent:sent+size], s.writeTime.wait())
+		}
+		if err != nil {
+			if err == ErrTimeout {
+				err = os.ErrDeadlineExceeded
+			}
+			return sent, err
+		}
+		sent += size
+	}
+	return sent, nil
+}
+
+// Waits until some send window is available, reserving at most need of it.
+func (s *Stream) reserve(need int) (int, error) {
+	for {
+		s.lock.Lock()
+		if s.sendDone {
+			s.lock.Unlock()
+			return 0, ErrClosed
+		}
+		select {
+		case <-s.term:
+			s.lock.Unlock()
+			return 0, s.stat
+		default:
+		}
+		if s.sendSpace > 0 {
+			if need > s.sendSpace {
+				need = s.sendSpace
+			}
+			s.sendSpace -= need
+			s.lock.Unlock()
+			return need, nil
+		}
+		// No window, reset the grant flag and wait
+		select {
+		case <-s.sendSign:
+		default:
+		}
+		s.lock.Unlock()
+
+		select {
+		case <-s.sendSign:
+		case <-s.term:
+		case <-s.writeTime.wait():
+			return 0, ErrTimeout
+		}
+	}
+}
+
+// Finishes the local sending direction, after which the remote side reads
+// io.EOF once all data is consumed. Reading remains possible.
+func (s *Stream) CloseWrite() error {
+	s.lock.Lock()
+	if s.sendDone {
+		s.lock.Unlock()
+		return nil
+	}
+	s.sendDone = true
+	done := s.recvDone
+	s.lock.Unlock()
+
+	err := s.mux.sendFrame(frameFin, s.id, nil, nil)
+	if done {
+		s.mux.removeStream(s.id)
+	}
+	return err
+}
+
+// Implements net.Conn.Close, finishing the sending direction and discarding
+// any further inbound data. If the remote side didn't finish sending yet, the
+// stream is reset instead, so that the remote writer doesn't block on window
+// that will never be granted.
+func (s *Stream) Close() error {
+	s.lock.Lock()
+	s.recvClosed = true
+	s.recvBuf = nil
+	done := s.recvDone
+	s.lock.Unlock()
+
+	select {
+	case <-s.term:
+		return nil
+	default:
+	}
+	if done {
+		err := s.CloseWrite()
+		s.terminate(ErrClosed)
+		return err
+	}
+	s.mux.removeStream(s.id)
+	s.terminate(ErrClosed)
+	return s.mux.sendFrame(frameReset, s.id, nil, nil)
+}
+
+// Implements net.Conn.LocalAddr, returning the local tunnel endpoint.
+func (s *Stream) LocalAddr() net.Addr {
+	return &TunnelAddr{Cluster: s.mux.tun.conn.cluster, Tunnel: s.mux.tun.id}
+}
+
+// Implements net.Conn.RemoteAddr, returning the remote tunnel endpoint.
+func (s *Stream) RemoteAddr() net.Addr {
+	return &TunnelAddr{Cluster: s.mux.tun.cluster, Tunnel: s.mux.tun.id}
+}
+
+// Implements net.Conn.SetDeadline, setting both read and write deadlines.
+func (s *Stream) SetDeadline(t time.Time) error {
+	s.readTime.set(t)
+	s.writeTime.set(t)
+	return nil
+}
+
+// Implements net.Conn.SetReadDeadline, affecting pending reads too.
+func (s *Stream) SetReadDeadline(t time.Time) error {
+	s.readTime.set(t)
+	return nil
+}
+
+// Implements net.Conn.SetWriteDeadline, affecting pending writes too.
+func (s *Stream) SetWriteDeadline(t time.Time) error {
+	s.writeTime.set(t)
+	return nil
+}
+
+// Buffers an arrived data frame, or discards it if the reader is gone.
+func (s *Stream) handleData(data []byte) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	// If nobody reads any more, return the window straight away
+	if s.recvClosed {
+		go s.mux.sendFrame(frameWindow, s.id, binary.AppendUvarint(nil, uint64(len(data))), nil)
+		return
+	}
+	// Make sure the remote side respects the window
+	if len(s.recvBuf)+len(data) > defaultStreamWindow {
+		s.mux.tun.Log.Warn("stream window exceeded, resetting", "stream", s.id)
+		go func() {
+			s.mux.removeStream(s.id)
+			s.mux.sendFrame(frameReset, s.id, nil, nil)
+			s.terminate(errors.New("stream window exceeded"))
+		}()
+		return
+	}
+	s.recvBuf = append(s.recvBuf, data...)
+	select {
+	case s.recvSign <- struct{}{}:
+	default:
+	}
+}
+
+// Increases the send window of the stream.
+func (s *Stream) handleWindow(space int) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.sendSpace += space
+	select {
+	case s.sendSign <- struct{}{}:
+	default:
+	}
+}
+
+// Marks the remote direction finished, removing the stream if both are.
+func (s *Stream) handleFin() {
+	s.lock.Lock()
+	s.recvDone = true
+	done := s.sendDone
+	select {
+	case s.recvSign <- struct{}{}:
+	default:
+	}
+	s.lock.Unlock()
+
+	if done {
+		s.mux.removeStream(s.id)
+	}
+}
+
+// Aborts the stream, failing all pending and future operations with err.
+func (s *Stream) terminate(err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	select {
+	case <-s.term:
+	default:
+		s.stat = err
+		close(s.term)
+	}
+}
+
+// Assembles a multiplexing frame from its type, stream id and payload.
+func packStreamFrame(kind byte, id uint64, payload []byte) []byte {
+	frame := make([]byte, 1, frameHeaderLimit+len(payload))
+	frame[0] = kind
+	frame = binary.AppendUvarint(frame, id)
+	return append(frame, payload...)
+}
+
+// Splits a multiplexing frame into its type, stream id and payload.
+func unpackStreamFrame(frame []byte) (byte, uint64, []byte, error) {
+	if len(frame) == 0 {
+		return 0, 0, nil, errors.New("empty stream frame")
+	}
+	id, n := binary.Uvarint(frame[1:])
+	if n <= 0 {
+		return 0, 0, nil, errors.New("invalid stream id")
+	}
+	return frame[0], id, frame[1+n:], nil
+}
@@ -0,0 +1,220 @@
+// Copyright (c) 2014 Project Iris. All rights reserved.
+//
+// The current language binding is an official support library of the Iris
+// cloud messaging framework, and as such, the same licensing terms apply.
+// For details please see http://iris.karalabe.com/downloads#License
+
+package iris
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Constructs a tunnel to a listening service, and multiplexes both ends.
+func newMuxTestPair(t *testing.T) (*Service, *Connection, *Mux, *Mux) {
+	serv, err := Register(config.relay, config.cluster, new(ServiceFuncs), &ServiceLimits{TunnelListen: true})
+	if err != nil {
+		t.Fatalf("registration failed: %v.", err)
+	}
+	conn, err := Connect(config.relay)
+	if err != nil {
+		serv.Unregister()
+		t.Fatalf("connection failed: %v.", err)
+	}
+	tunnel, err := conn.Tunnel(config.cluster, time.Second)
+	if err != nil {
+		conn.Close()
+		serv.Unregister()
+		t.Fatalf("tunnel construction failed: %v.", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	inbound, err := serv.AcceptTunnel(ctx)
+	if err != nil {
+		conn.Close()
+		serv.Unregister()
+		t.Fatalf("tunnel acceptance failed: %v.", err)
+	}
+	return serv, conn, tunnel.Multiplex(), inbound.Multiplex()
+}
+
+// Tests that multiple streams can be opened, echoed through and half-closed
+// concurrently inside a single tunnel.
+func TestTunnelMux(t *testing.T) {
+	// Test specific configurations
+	conf := struct {
+		streams int
+		size    int
+	}{16, 512 * 1024}
+
+	serv, conn, client, server := newMuxTestPair(t)
+	defer serv.Unregister()
+	defer conn.Close()
+	defer client.Close()
+
+	// Echo back every accepted stream until it's half-closed remotely
+	go func() {
+		for {
+			stream, err := server.AcceptStream(context.Background())
+			if err != nil {
+				return
+			}
+			go func() {
+				defer stream.Close()
+				io.Copy(stream, stream)
+			}()
+		}
+	}()
+	// Open the streams concurrently and verify the echoed data
+	errs := make(chan error, conf.streams)
+	for i := 0; i < conf.streams; i++ {
+		go func(id int) {
+			stream, err := client.OpenStream()
+			if err != nil {
+				errs <- fmt.Errorf("stream %d: open failed: %v", id, err)
+				return
+			}
+			defer stream.Close()
+
+			data := bytes.Repeat([]byte{byte(id)}, conf.size)
+			go func() {
+				stream.Write(data)
+				stream.CloseWrite()
+			}()
+			back, err := io.ReadAll(stream)
+			switch {
+			case err != nil:
+				errs <- fmt.Errorf("stream %d: read failed: %v", id, err)
+			case !bytes.Equal(back, data):
+				errs <- fmt.Errorf("stream %d: data mismatch: have %d bytes, want %d", id, len(back), len(data))
+			default:
+				errs <- nil
+			}
+		}(i)
+	}
+	for i := 0; i < conf.streams; i++ {
+		if err := <-errs; err != nil {
+			t.Fatalf("%v.", err)
+		}
+	}
+}
+
+// Tests that closing a stream while the remote side is still writing aborts the
+// remote writer instead of leaving it blocked on the exhausted window.
+func TestTunnelMuxClose(t *testing.T) {
+	serv, conn, client, server := newMuxTestPair(t)
+	defer serv.Unregister()
+	defer conn.Close()
+	defer client.Close()
+
+	// Start an upload larger than the stream window
+	stream, err := client.OpenStream()
+	if err != nil {
+		t.Fatalf("open failed: %v.", err)
+	}
+	errc := make(chan error, 1)
+	go func() {
+		_, err := stream.Write(make([]byte, 4*defaultStreamWindow))
+		errc <- err
+	}()
+	// Accept the stream, read a bit of it and close it prematurely
+	accepted, err := server.AcceptStream(context.Background())
+	if err != nil {
+		t.Fatalf("accept failed: %v.", err)
+	}
+	if _, err := accepted.Read(make([]byte, 1024)); err != nil {
+		t.Fatalf("read failed: %v.", err)
+	}
+	if err := accepted.Close(); err != nil {
+		t.Fatalf("close failed: %v.", err)
+	}
+	select {
+	case err := <-errc:
+		if err == nil {
+			t.Fatalf("write into closed stream succeeded.")
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("writer blocked on closed stream.")
+	}
+	if server.getStream(accepted.ID()) != nil {
+		t.Fatalf("closed stream still live.")
+	}
+}
+
+// Tests that concurrently writing streams share the tunnel fairly, neither of
+// them being able to starve the others.
+func TestTunnelMuxFairness(t *testing.T) {
+	// Test specific configurations
+	conf := struct {
+		streams int
+		size    int
+		share   float64
+	}{4, 8 * 1024 * 1024, 0.5}
+
+	serv, conn, client, server := newMuxTestPair(t)
+	defer serv.Unregister()
+	defer conn.Close()
+	defer client.Close()
+
+	// Start a bulk upload on every stream concurrently
+	for i := 0; i < conf.streams; i++ {
+		stream, err := client.OpenStream()
+		if err != nil {
+			t.Fatalf("stream %d: open failed: %v.", i, err)
+		}
+		defer stream.Close()
+
+		go func() {
+			stream.Write(make([]byte, conf.size))
+			stream.CloseWrite()
+		}()
+	}
+	// Consume all streams, recording the progress of each when the first ends
+	var (
+		progress = make([]int, conf.streams)
+		snapshot []int
+		lock     sync.Mutex
+		pend     sync.WaitGroup
+	)
+	for i := 0; i < conf.streams; i++ {
+		stream, err := server.AcceptStream(context.Background())
+		if err != nil {
+			t.Fatalf("stream %d: accept failed: %v.", i, err)
+		}
+		pend.Add(1)
+		go func(id int) {
+			defer pend.Done()
+
+			buf := make([]byte, 32*1024)
+			for {
+				n, err := stream.Read(buf)
+
+				lock.Lock()
+				progress[id] += n
+				if err == io.EOF && snapshot == nil {
+					snapshot = append([]int{}, progress...)
+				}
+				lock.Unlock()
+
+				if err != nil {
+					return
+				}
+			}
+		}(i)
+	}
+	pend.Wait()
+
+	// Verify that no stream lagged significantly behind the fastest one
+	for i, done := range snapshot {
+		if float64(done) < conf.share*float64(conf.size) {
+			t.Errorf("stream %d starved: have %d bytes, want at least %d.", i, done, int(conf.share*float64(conf.size)))
+		}
+	}
+}
@@ -0,0 +1,69 @@
+// Copyright (c) 2014 Project Iris. All rights reserved.
+//
+// The current language binding is an official support library of the Iris
+// cloud messaging framework, and as such, the same licensing terms apply.
+// For details please see http://iris.karalabe.com/downloads#License
+
+// Contains the thread pool variant supporting ordered per-key execution.
+
+package iris
+
+import (
+	"hash/fnv"
+
+	"github.com/project-iris/iris/pool"
+)
+
+// Extracts the ordering key of an inbound message. Messages with the same key
+// are processed serially in arrival order, others may run concurrently.
+type KeyFunc func(message []byte) string
+
+// Thread pool optionally partitioning the tasks by message key, executing each
+// partition serially. Without a key extractor, it is a plain thread pool.
+type keyedPool struct {
+	key   KeyFunc            // Ordering key extractor, nil if unordered
+	lanes []*pool.ThreadPool // Serial executors for the key partitions
+}
+
+// Creates a new thread pool, ordered by key if an extractor is specified.
+func newKeyedPool(threads int, key KeyFunc) *keyedPool {
+	// Unordered pools run all threads on a single queue
+	if key == nil {
+		return &keyedPool{
+			lanes: []*pool.ThreadPool{pool.NewThreadPool(threads)},
+		}
+	}
+	// Ordered pools run a single thread on each partition
+	lanes := make([]*pool.ThreadPool, threads)
+	for i := 0; i < threads; i++ {
+		lanes[i] = pool.NewThreadPool(1)
+	}
+	return &keyedPool{
+		key:   key,
+		lanes: lanes,
+	}
+}
+
+// Starts the execution of the scheduled tasks.
+func (k *keyedPool) Start() {
+	for _, lane := range k.lanes {
+		lane.Start()
+	}
+}
+
+// Schedules a task processing message into the partition of the message key.
+func (k *keyedPool) Schedule(message []byte, task pool.Task) error {
+	if k.key == nil {
+		return k.lanes[0].Schedule(task)
+	}
+	hash := fnv.New32a()
+	hash.Write([]byte(k.key(message)))
+	return k.lanes[hash.Sum32()%uint32(len(k.lanes))].Schedule(task)
+}
+
+// Terminates the pool, optionally dropping the unprocessed tasks.
+func (k *keyedPool) Terminate(clear bool) {
+	for _, lane := range k.lanes {
+		lane.Terminate(clear)
+	}
+}
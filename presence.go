@@ -0,0 +1,403 @@
+// Copyright (c) 2014 Project Iris. All rights reserved.
+//
+// The current language binding is an official support library of the Iris
+// cloud messaging framework, and as such, the same licensing terms apply.
+// For details please see http://iris.karalabe.com/downloads#License
+
+// Contains the heartbeat based cluster membership and presence tracking.
+
+package iris
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Prefix of the well-known topics carrying the presence announcements.
+const presenceTopicPrefix = "iris-presence:"
+
+// Announcement types of the presence protocol.
+const (
+	presenceAlive byte = iota // Periodic heartbeat of a live member
+	presenceLeave             // Farewell of a member unregistering
+)
+
+// Returns the topic carrying the presence announcements of a cluster.
+func presenceTopic(cluster string) string {
+	return presenceTopicPrefix + cluster
+}
+
+// Live member of a cluster, as seen through its presence announcements.
+type Member struct {
+	Instance string    // Instance id of the member service
+	Metadata []byte    // User metadata announced by the member
+	Load     float64   // Load reported by the member
+	Seen     time.Time // Arrival time of the last announcement
+}
+
+// Callback interface for membership changes of a watched cluster.
+type MembershipHandler interface {
+	// Callback invoked when a new member starts announcing itself.
+	HandleJoin(member *Member)
+
+	// Callback invoked when a member unregisters or its announcements expire.
+	HandleLeave(member *Member)
+}
+
+// Adapter to use plain functions as membership handlers. Unset callbacks are
+// simply skipped.
+type MembershipFuncs struct {
+	OnJoin  func(member *Member) // Handler for members joining
+	OnLeave func(member *Member) // Handler for members leaving
+}
+
+// Implements MembershipHandler.HandleJoin, calling OnJoin if set.
+func (m *MembershipFuncs) HandleJoin(member *Member) {
+	if m.OnJoin != nil {
+		m.OnJoin(member)
+	}
+}
+
+// Implements MembershipHandler.HandleLeave, calling OnLeave if set.
+func (m *MembershipFuncs) HandleLeave(member *Member) {
+	if m.OnLeave != nil {
+		m.OnLeave(member)
+	}
+}
+
+// Starts periodically announcing the service on its cluster's presence topic,
+// carrying the instance id, the metadata and the last reported load. Calling it
+// again replaces the metadata. The announcements stop when the service is
+// unregistered, notifying the watchers of the leave.
+func (s *Service) Announce(metadata []byte, opts *PresenceOptions) error {
+	s.presLock.Lock()
+	defer s.presLock.Unlock()
+
+	if s.pres != nil {
+		s.pres.update(metadata)
+		return nil
+	}
+	s.pres = &announcer{
+		conn:  s.conn,
+		topic: presenceTopic(s.conn.cluster),
+		opts:  finalizePresenceOptions(opts),
+		meta:  metadata,
+		quit:  make(chan chan struct{}),
+	}
+	if err := s.pres.announce(presenceAlive); err != nil {
+		s.pres = nil
+		return err
+	}
+	go s.pres.loop()
+	return nil
+}
+
+// Retrieves the options the service is announced with, or the defaults if it's
+// silent.
+func (s *Service) announceOptions() *PresenceOptions {
+	s.presLock.Lock()
+	defer s.presLock.Unlock()
+
+	if s.pres != nil {
+		return s.pres.opts
+	}
+	return &defaultPresenceOptions
+}
+
+// Sets the load reported in the subsequent presence announcements.
+func (s *Service) ReportLoad(load float64) {
+	s.presLock.Lock()
+	pres := s.pres
+	s.presLock.Unlock()
+
+	if pres != nil {
+		pres.lock.Lock()
+		pres.load = load
+		pres.lock.Unlock()
+	}
+}
+
+// Stops the presence announcements, if any, notifying the watchers of the leave.
+func (s *Service) withdraw() {
+	s.presLock.Lock()
+	pres := s.pres
+	s.pres = nil
+	s.presLock.Unlock()
+
+	if pres != nil {
+		done := make(chan struct{})
+		pres.quit <- done
+		<-done
+	}
+}
+
+// Periodic announcer of a single service's presence.
+type announcer struct {
+	conn  *Connection      // Connection of the announced service
+	topic string           // Presence topic of the service's cluster
+	opts  *PresenceOptions // Heartbeat configuration
+	meta  []byte           // User metadata to announce
+	load  float64          // Last load reported by the user
+	lock  sync.Mutex       // Mutex to protect the announced data
+
+	quit chan chan struct{} // Quit channel to synchronize announcer termination
+}
+
+// Replaces the announced metadata.
+func (a *announcer) update(metadata []byte) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	a.meta = metadata
+}
+
+// Publishes a single presence announcement.
+func (a *announcer) announce(kind byte) error {
+	a.lock.Lock()
+	event := []byte{kind}
+	event = binary.BigEndian.AppendUint64(event, math.Float64bits(a.load))
+	event = append(event, packCall(a.conn.instance, a.meta)...)
+	a.lock.Unlock()
+
+	return a.conn.Publish(a.topic, event)
+}
+
+// Announces the service's presence periodically until stopped, after which the
+// leave is announced.
+func (a *announcer) loop() {
+	ticker := time.NewTicker(a.opts.Heartbeat)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := a.announce(presenceAlive); err != nil {
+				a.conn.Log.Warn("failed to announce presence", "reason", err)
+			}
+		case done := <-a.quit:
+			if err := a.announce(presenceLeave); err != nil {
+				a.conn.Log.Warn("failed to announce leave", "reason", err)
+			}
+			close(done)
+			return
+		case <-a.conn.term:
+			// Connection dropped, wait for the withdrawal
+			done := <-a.quit
+			close(done)
+			return
+		}
+	}
+}
+
+// Merges the user requested presence options with the defaults.
+func finalizePresenceOptions(user *PresenceOptions) *PresenceOptions {
+	// If the user didn't specify anything, load the full default set
+	if user == nil {
+		return &defaultPresenceOptions
+	}
+	// Check each field and merge only non-specified ones
+	opts := new(PresenceOptions)
+	*opts = *user
+
+	if user.Heartbeat == 0 {
+		opts.Heartbeat = defaultPresenceOptions.Heartbeat
+	}
+	if user.Expiry == 0 {
+		opts.Expiry = defaultPresenceOptions.Expiry
+	}
+	return opts
+}
+
+// Starts tracking the members of a cluster through their presence announcements,
+// notifying handler (if not nil) of the joins and leaves. Members not announcing
+// themselves for longer than the expiry are considered gone. Notifications are
+// delivered one by one, in order.
+//
+// Only one watch per cluster may be active on a connection. Only services that
+// Announce themselves are visible, and only after their next heartbeat.
+func (c *Connection) WatchMembers(cluster string, handler MembershipHandler, opts *PresenceOptions) error {
+	// Sanity check on the arguments
+	if len(cluster) == 0 {
+		return errors.New("empty cluster identifier")
+	}
+	opts = finalizePresenceOptions(opts)
+
+	c.presLock.Lock()
+	_, ok := c.presLive[cluster]
+	c.presLock.Unlock()
+
+	if ok {
+		return errors.New("cluster already watched")
+	}
+	// Subscribe to the heartbeats without holding the lock, record the view after
+	watch := &presence{
+		handler: handler,
+		opts:    opts,
+		members: make(map[string]*Member),
+		quit:    make(chan struct{}),
+	}
+	sub, err := c.SubscribeHandler(presenceTopic(cluster), TopicHandlerFunc(watch.handleAnnounce), &TopicLimits{EventThreads: 1})
+	if err != nil {
+		return err
+	}
+	watch.sub = sub
+
+	c.presLock.Lock()
+	if _, ok := c.presLive[cluster]; ok {
+		// A concurrent watch won the race, drop ours
+		c.presLock.Unlock()
+		sub.Close()
+		return errors.New("cluster already watched")
+	}
+	c.presLive[cluster] = watch
+	c.presLock.Unlock()
+
+	go watch.expire(c.term)
+	return nil
+}
+
+// Stops tracking the members of a cluster.
+func (c *Connection) UnwatchMembers(cluster string) error {
+	c.presLock.Lock()
+	watch, ok := c.presLive[cluster]
+	delete(c.presLive, cluster)
+	c.presLock.Unlock()
+
+	if !ok {
+		return errors.New("cluster not watched")
+	}
+	close(watch.quit)
+	return watch.sub.Close()
+}
+
+// Retrieves the live members of a cluster, ordered by their instance ids. The
+// cluster is watched on first use, so the view fills up after the heartbeat.
+func (c *Connection) Members(cluster string) ([]*Member, error) {
+	c.presLock.Lock()
+	watch, ok := c.presLive[cluster]
+	c.presLock.Unlock()
+
+	if ok {
+		return watch.snapshot(), nil
+	}
+	if err := c.WatchMembers(cluster, nil, nil); err != nil {
+		// Concurrent first uses may race, fall back to the winner's view
+		c.presLock.Lock()
+		watch, ok = c.presLive[cluster]
+		c.presLock.Unlock()
+
+		if !ok {
+			return nil, err
+		}
+		return watch.snapshot(), nil
+	}
+	return []*Member{}, nil
+}
+
+// Retrieves the options the membership view of a cluster was configured with,
+// or nil if the cluster isn't watched.
+func (c *Connection) presenceOptions(cluster string) *PresenceOptions {
+	c.presLock.Lock()
+	defer c.presLock.Unlock()
+
+	if watch, ok := c.presLive[cluster]; ok {
+		return watch.opts
+	}
+	return nil
+}
+
+// Membership view of a single cluster, built from the presence announcements.
+type presence struct {
+	handler MembershipHandler  // Handler for the membership changes (nil if none)
+	opts    *PresenceOptions   // Expiry configuration
+	sub     *Subscription      // Subscription to the presence topic
+	members map[string]*Member // Live members, indexed by instance id
+	lock    sync.Mutex         // Mutex to protect the member map
+	notify  sync.Mutex         // Mutex to serialize the handler notifications
+
+	quit chan struct{} // Quit channel to stop the expiration
+}
+
+// Processes a presence announcement, updating the membership view.
+func (p *presence) handleAnnounce(event []byte) {
+	if len(event) < 9 {
+		return
+	}
+	kind, load := event[0], math.Float64frombits(binary.BigEndian.Uint64(event[1:9]))
+	instance, meta, err := unpackCall(event[9:])
+	if err != nil {
+		return
+	}
+	p.notify.Lock()
+	defer p.notify.Unlock()
+
+	p.lock.Lock()
+	member, known := p.members[instance]
+	switch kind {
+	case presenceAlive:
+		member = &Member{Instance: instance, Metadata: meta, Load: load, Seen: time.Now()}
+		p.members[instance] = member
+	case presenceLeave:
+		delete(p.members, instance)
+	}
+	p.lock.Unlock()
+
+	// Notify the handler outside the lock, so it may query the view
+	switch {
+	case p.handler == nil:
+	case kind == presenceAlive && !known:
+		p.handler.HandleJoin(member)
+	case kind == presenceLeave && known:
+		p.handler.HandleLeave(member)
+	}
+}
+
+// Periodically drops the members whose announcements expired.
+func (p *presence) expire(term chan struct{}) {
+	ticker := time.NewTicker(p.opts.Expiry / 4)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			p.notify.Lock()
+			p.lock.Lock()
+			var gone []*Member
+			for instance, member := range p.members {
+				if time.Since(member.Seen) > p.opts.Expiry {
+					delete(p.members, instance)
+					gone = append(gone, member)
+				}
+			}
+			p.lock.Unlock()
+
+			if p.handler != nil {
+				for _, member := range gone {
+					p.handler.HandleLeave(member)
+				}
+			}
+			p.notify.Unlock()
+		case <-p.quit:
+			return
+		case <-term:
+			return
+		}
+	}
+}
+
+// Returns the live members ordered by their instance ids.
+func (p *presence) snapshot() []*Member {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	members := make([]*Member, 0, len(p.members))
+	for _, member := range p.members {
+		members = append(members, member)
+	}
+	sort.Slice(members, func(i, j int) bool { return members[i].Instance < members[j].Instance })
+	return members
+}
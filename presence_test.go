@@ -0,0 +1,117 @@
+// Copyright (c) 2014 Project Iris. All rights reserved.
+//
+// The current language binding is an official support library of the Iris
+// cloud messaging framework, and as such, the same licensing terms apply.
+// For details please see http://iris.karalabe.com/downloads#License
+
+package iris
+
+import (
+	"testing"
+	"time"
+)
+
+// Tests that announcing services are tracked as cluster members, with joins,
+// leaves and expirations reported.
+func TestPresence(t *testing.T) {
+	// Test specific configurations
+	conf := struct {
+		servers int
+		opts    PresenceOptions
+	}{3, PresenceOptions{Heartbeat: 25 * time.Millisecond, Expiry: 100 * time.Millisecond}}
+
+	// Connect to the local relay and start watching the cluster
+	conn, err := Connect(config.relay)
+	if err != nil {
+		t.Fatalf("connection failed: %v.", err)
+	}
+	defer conn.Close()
+
+	joins, leaves := make(chan *Member, 16), make(chan *Member, 16)
+	handler := &MembershipFuncs{
+		OnJoin:  func(m *Member) { joins <- m },
+		OnLeave: func(m *Member) { leaves <- m },
+	}
+	if err := conn.WatchMembers(config.cluster, handler, &conf.opts); err != nil {
+		t.Fatalf("failed to watch members: %v.", err)
+	}
+	// Register a batch of announcing services and wait for their joins
+	servs := make(map[string]*Service)
+	defer func() {
+		for _, serv := range servs {
+			serv.Unregister()
+		}
+	}()
+	for i := 0; i < conf.servers; i++ {
+		serv, err := Register(config.relay, config.cluster, new(ServiceFuncs), nil)
+		if err != nil {
+			t.Fatalf("registration %d failed: %v.", i, err)
+		}
+		if err := serv.Announce([]byte{byte(i)}, &conf.opts); err != nil {
+			t.Fatalf("service %d: failed to announce: %v.", i, err)
+		}
+		servs[serv.Instance()] = serv
+	}
+	for i := 0; i < conf.servers; i++ {
+		select {
+		case member := <-joins:
+			if servs[member.Instance] == nil {
+				t.Fatalf("unknown member joined: %q.", member.Instance)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("join %d timed out.", i)
+		}
+	}
+	// Verify the membership view and the load reports
+	var loaded *Service
+	for _, serv := range servs {
+		loaded = serv
+		break
+	}
+	loaded.ReportLoad(0.75)
+	time.Sleep(3 * conf.opts.Heartbeat)
+
+	members, err := conn.Members(config.cluster)
+	if err != nil {
+		t.Fatalf("failed to retrieve members: %v.", err)
+	}
+	if len(members) != conf.servers {
+		t.Fatalf("member count mismatch: have %d, want %d.", len(members), conf.servers)
+	}
+	for _, member := range members {
+		want := 0.0
+		if member.Instance == loaded.Instance() {
+			want = 0.75
+		}
+		if member.Load != want {
+			t.Errorf("member %s load mismatch: have %v, want %v.", member.Instance, member.Load, want)
+		}
+	}
+	// Unregister a service and verify that its leave is reported promptly
+	delete(servs, loaded.Instance())
+	loaded.Unregister()
+	select {
+	case member := <-leaves:
+		if member.Instance != loaded.Instance() {
+			t.Fatalf("wrong member left: have %s, want %s.", member.Instance, loaded.Instance())
+		}
+	case <-time.After(conf.opts.Expiry / 2):
+		t.Fatalf("leave notification timed out.")
+	}
+	// Inject a single, silent announcement and verify that it expires
+	event := append(make([]byte, 9), packCall("silent", nil)...)
+	if err := conn.Publish(presenceTopic(config.cluster), event); err != nil {
+		t.Fatalf("failed to inject announcement: %v.", err)
+	}
+	if member := <-joins; member.Instance != "silent" {
+		t.Fatalf("wrong member joined: have %s, want %s.", member.Instance, "silent")
+	}
+	select {
+	case member := <-leaves:
+		if member.Instance != "silent" {
+			t.Fatalf("wrong member expired: have %s, want %s.", member.Instance, "silent")
+		}
+	case <-time.After(4 * conf.opts.Expiry):
+		t.Fatalf("member expiration timed out.")
+	}
+}
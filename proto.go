@@ -493,7 +493,12 @@ func (c *Connection) procPublish() error {
 	if err != nil {
 		return err
 	}
-	go c.handlePublish(topic, event)
+	// Enveloped broadcasts are scheduled right away, same as plain ones
+	if c.bcastTopic != "" && topic == c.bcastTopic {
+		c.handleEnvelopedBroadcast(event)
+		return nil
+	}
+	c.pubPool.Schedule([]byte(topic), func() { c.handlePublish(topic, event) })
 	return nil
 }
 
@@ -624,6 +629,7 @@ func (c *Connection) process() {
 	// Close the socket and signal termination to all blocked threads
 	c.sock.Close()
 	close(c.term)
+	c.pubPool.Terminate(true)
 
 	// Notify the application of the connection closure
 	c.handleClose(err)
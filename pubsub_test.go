@@ -7,8 +7,10 @@
 package iris
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
+	"hash/fnv"
 	"sync"
 	"testing"
 	"time"
@@ -335,6 +337,474 @@ func TestPublishMemoryLimit(t *testing.T) {
 	}
 }
 
+// Tests multiple local handlers sharing the same topic subscription.
+func TestPublishShared(t *testing.T) {
+	// Connect to the local relay
+	conn, err := Connect(config.relay)
+	if err != nil {
+		t.Fatalf("connection failed: %v", err)
+	}
+	defer conn.Close()
+
+	// Subscribe two handlers to the same topic and wait for state propagation
+	hands := make([]*publishTestTopicHandler, 2)
+	subs := make([]*Subscription, 2)
+	for i := 0; i < len(hands); i++ {
+		hands[i] = &publishTestTopicHandler{
+			delivers: make(chan []byte, 1),
+		}
+		if subs[i], err = conn.SubscribeHandler(config.topic, hands[i], nil); err != nil {
+			t.Fatalf("subscription %d failed: %v", i, err)
+		}
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	// Verify that both handlers receive the event
+	if err := conn.Publish(config.topic, []byte{0x00}); err != nil {
+		t.Fatalf("first publish failed: %v.", err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	for i, hand := range hands {
+		select {
+		case <-hand.delivers:
+		default:
+			t.Fatalf("handler %d: first event not received.", i)
+		}
+	}
+	// Remove one subscription and verify that the other is still live
+	if err := subs[0].Close(); err != nil {
+		t.Fatalf("first unsubscription failed: %v.", err)
+	}
+	if err := conn.Publish(config.topic, []byte{0x01}); err != nil {
+		t.Fatalf("second publish failed: %v.", err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	select {
+	case <-hands[0].delivers:
+		t.Fatalf("closed handler received event.")
+	default:
+	}
+	select {
+	case <-hands[1].delivers:
+	default:
+		t.Fatalf("live handler didn't receive event.")
+	}
+	if err := subs[1].Close(); err != nil {
+		t.Fatalf("second unsubscription failed: %v.", err)
+	}
+	time.Sleep(100 * time.Millisecond)
+}
+
+// Tests the hierarchical topic pattern matching semantics.
+func TestTreeTopicMatch(t *testing.T) {
+	tests := []struct {
+		pattern string
+		topic   string
+		match   bool
+	}{
+		{"orders.eu.created", "orders.eu.created", true},
+		{"orders.eu.created", "orders.eu", false},
+		{"orders.*.created", "orders.eu.created", true},
+		{"orders.*.created", "orders.created", false},
+		{"orders.*.created", "orders.eu.west.created", false},
+		{"orders.#", "orders", true},
+		{"orders.#", "orders.eu.created", true},
+		{"orders.#", "invoices.eu", false},
+		{"*.eu.#", "orders.eu", true},
+		{"#", "orders.eu.created", true},
+	}
+	for i, tt := range tests {
+		pattern, err := parseTreeTopic(tt.pattern, true)
+		if err != nil {
+			t.Fatalf("test %d: pattern parse failed: %v.", i, err)
+		}
+		topic, err := parseTreeTopic(tt.topic, false)
+		if err != nil {
+			t.Fatalf("test %d: topic parse failed: %v.", i, err)
+		}
+		if match := matchTreeTopic(pattern, topic); match != tt.match {
+			t.Errorf("test %d: match mismatch for %s on %s: have %v, want %v.", i, tt.topic, tt.pattern, match, tt.match)
+		}
+	}
+	// Check that invalid patterns and topics are rejected
+	for _, pattern := range []string{"", "orders..eu", "orders.#.created", "orders.e*"} {
+		if _, err := parseTreeTopic(pattern, true); err == nil {
+			t.Errorf("invalid pattern accepted: %s.", pattern)
+		}
+	}
+	if _, err := parseTreeTopic("orders.*", false); err == nil {
+		t.Errorf("wildcard topic accepted.")
+	}
+}
+
+// Tests that wildcard subscriptions receive matching events exactly once.
+func TestPublishTree(t *testing.T) {
+	// Connect to the local relay
+	conn, err := Connect(config.relay)
+	if err != nil {
+		t.Fatalf("connection failed: %v", err)
+	}
+	defer conn.Close()
+
+	// Subscribe with a batch of overlapping patterns
+	patterns := []string{"orders.#", "orders.*.created", "orders.eu.created", "orders.us.#"}
+	delivers := make([]chan string, len(patterns))
+	for i, pattern := range patterns {
+		delivers[i] = make(chan string, 16)
+		handler := TreeHandlerFunc(func(i int) func(string, []byte) {
+			return func(topic string, event []byte) { delivers[i] <- topic }
+		}(i))
+		sub, err := conn.SubscribeTree(pattern, handler, nil)
+		if err != nil {
+			t.Fatalf("pattern %s: subscription failed: %v", pattern, err)
+		}
+		defer sub.Close()
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	// Publish an event to the hierarchical topic and verify the deliveries
+	if err := conn.PublishTree("orders.eu.created", []byte{0x00}); err != nil {
+		t.Fatalf("tree publish failed: %v.", err)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	for i, pattern := range patterns {
+		want := 0
+		if pattern != "orders.us.#" {
+			want = 1
+		}
+		if have := len(delivers[i]); have != want {
+			t.Errorf("pattern %s: delivery count mismatch: have %d, want %d.", pattern, have, want)
+		}
+	}
+}
+
+// Tests that filtered subscriptions only receive the matching events.
+func TestPublishFiltered(t *testing.T) {
+	// Test specific configurations
+	conf := struct {
+		events int
+	}{10}
+
+	// Connect to the local relay
+	conn, err := Connect(config.relay)
+	if err != nil {
+		t.Fatalf("connection failed: %v", err)
+	}
+	defer conn.Close()
+
+	// Subscribe to a topic with a header filter and wait for state propagation
+	handler := &publishTestTopicHandler{
+		delivers: make(chan []byte, conf.events),
+	}
+	sub, err := conn.SubscribeFiltered(config.topic, handler, HeaderFilter("kind", "even"), nil)
+	if err != nil {
+		t.Fatalf("subscription failed: %v", err)
+	}
+	defer sub.Close()
+	time.Sleep(100 * time.Millisecond)
+
+	// Publish a batch of enveloped events, half of them matching
+	for i := 0; i < conf.events; i++ {
+		kind := "odd"
+		if i%2 == 0 {
+			kind = "even"
+		}
+		event := PackHeaders(map[string]string{"kind": kind}, []byte{byte(i)})
+		if err := conn.Publish(config.topic, event); err != nil {
+			t.Fatalf("event publish failed: %v.", err)
+		}
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	// Verify the deliveries and the filter counters
+	arrived := len(handler.delivers)
+	if arrived != conf.events/2 {
+		t.Errorf("delivered event count mismatch: have %d, want %d.", arrived, conf.events/2)
+	}
+	for i := 0; i < arrived; i++ {
+		headers, data, err := UnpackHeaders(<-handler.delivers)
+		if err != nil {
+			t.Fatalf("event unpack failed: %v.", err)
+		}
+		if headers["kind"] != "even" || data[0]%2 != 0 {
+			t.Errorf("non matching event delivered: %v %v.", headers, data)
+		}
+	}
+	if matched, filtered := sub.FilterStats(); matched != uint64(conf.events/2) || filtered != uint64(conf.events/2) {
+		t.Errorf("filter stats mismatch: have %d/%d, want %d/%d.", matched, filtered, conf.events/2, conf.events/2)
+	}
+}
+
+// Tests that events with the same key are processed in arrival order.
+func TestPublishOrdered(t *testing.T) {
+	// Test specific configurations
+	conf := struct {
+		keys   int
+		events int
+	}{4, 25}
+
+	// Connect to the local relay
+	conn, err := Connect(config.relay)
+	if err != nil {
+		t.Fatalf("connection failed: %v", err)
+	}
+	defer conn.Close()
+
+	// Subscribe with a key extractor and a jittery handler
+	var lock sync.Mutex
+	arrived := make(map[byte][]byte)
+	done := make(chan struct{}, conf.keys*conf.events)
+
+	handler := TopicHandlerFunc(func(event []byte) {
+		time.Sleep(time.Duration(event[1]%3) * time.Millisecond)
+
+		lock.Lock()
+		arrived[event[0]] = append(arrived[event[0]], event[1])
+		lock.Unlock()
+
+		done <- struct{}{}
+	})
+	limits := &TopicLimits{
+		EventKey: func(event []byte) string { return string(event[:1]) },
+	}
+	if err := conn.Subscribe(config.topic, handler, limits); err != nil {
+		t.Fatalf("subscription failed: %v", err)
+	}
+	defer conn.Unsubscribe(config.topic)
+	time.Sleep(100 * time.Millisecond)
+
+	// Publish interleaved sequences for all the keys
+	for i := 0; i < conf.events; i++ {
+		for key := 0; key < conf.keys; key++ {
+			if err := conn.Publish(config.topic, []byte{byte(key), byte(i)}); err != nil {
+				t.Fatalf("event publish failed: %v.", err)
+			}
+		}
+	}
+	// Wait for all the events and verify the per key ordering
+	for i := 0; i < conf.keys*conf.events; i++ {
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Fatalf("event #%d not received.", i)
+		}
+	}
+	for key, seqs := range arrived {
+		for i, seq := range seqs {
+			if int(seq) != i {
+				t.Fatalf("key %d: order mismatch: have %v.", key, seqs)
+			}
+		}
+	}
+}
+
+// Tests that a stalled topic doesn't hold up the event delivery on others.
+func TestPublishIsolated(t *testing.T) {
+	// Connect to the local relay
+	conn, err := Connect(config.relay)
+	if err != nil {
+		t.Fatalf("connection failed: %v", err)
+	}
+	defer conn.Close()
+
+	// Pick two topics dispatched on different lanes
+	lane := func(topic string) uint32 {
+		hash := fnv.New32a()
+		hash.Write([]byte(topic))
+		return hash.Sum32() % uint32(publishLanes)
+	}
+	slow, fast := config.topic+"-slow", config.topic+"-fast"
+	for i := 0; lane(slow) == lane(fast); i++ {
+		if publishLanes == 1 {
+			t.Skip("single dispatch lane.")
+		}
+		fast = fmt.Sprintf("%s-fast-%d", config.topic, i)
+	}
+	// Subscribe with a filter stalling one topic and a plain handler on the other
+	release := make(chan struct{})
+	defer close(release)
+
+	stall := func(event []byte) bool { <-release; return true }
+	stalled, err := conn.SubscribeFiltered(slow, TopicHandlerFunc(func([]byte) {}), stall, nil)
+	if err != nil {
+		t.Fatalf("stalled subscription failed: %v", err)
+	}
+	defer stalled.Close()
+
+	handler := &publishTestTopicHandler{
+		delivers: make(chan []byte, 1),
+	}
+	if err := conn.Subscribe(fast, handler, nil); err != nil {
+		t.Fatalf("subscription failed: %v", err)
+	}
+	defer conn.Unsubscribe(fast)
+	time.Sleep(100 * time.Millisecond)
+
+	// Stall the first topic and verify that the second one still delivers
+	if err := conn.Publish(slow, []byte{0x00}); err != nil {
+		t.Fatalf("stalling publish failed: %v.", err)
+	}
+	if err := conn.Publish(fast, []byte{0x01}); err != nil {
+		t.Fatalf("event publish failed: %v.", err)
+	}
+	select {
+	case <-handler.delivers:
+	case <-time.After(time.Second):
+		t.Fatalf("event delivery blocked by stalled topic.")
+	}
+}
+
+// Batch topic handler for the publish/subscribe tests.
+type publishBatchTestTopicHandler struct {
+	delivers chan [][]byte
+}
+
+func (p *publishBatchTestTopicHandler) HandleEvents(events [][]byte) { p.delivers <- events }
+
+// Tests batched publishing and batched event processing.
+func TestPublishBatch(t *testing.T) {
+	// Test specific configurations
+	conf := struct {
+		events int
+		batch  int
+	}{25, 10}
+
+	// Connect to the local relay
+	conn, err := Connect(config.relay)
+	if err != nil {
+		t.Fatalf("connection failed: %v", err)
+	}
+	defer conn.Close()
+
+	// Subscribe both a batch and a single event handler to the topic
+	batcher := &publishBatchTestTopicHandler{
+		delivers: make(chan [][]byte, conf.events),
+	}
+	limits := &TopicLimits{
+		BatchSize:   conf.batch,
+		BatchLinger: 50 * time.Millisecond,
+	}
+	sub, err := conn.SubscribeBatch(config.topic, batcher, limits)
+	if err != nil {
+		t.Fatalf("batch subscription failed: %v", err)
+	}
+	defer sub.Close()
+
+	handler := &publishTestTopicHandler{
+		delivers: make(chan []byte, conf.events+1),
+	}
+	if err := conn.Subscribe(config.topic, handler, nil); err != nil {
+		t.Fatalf("subscription failed: %v", err)
+	}
+	defer conn.Unsubscribe(config.topic)
+	time.Sleep(100 * time.Millisecond)
+
+	// Publish all the events in a single batch
+	events := make([][]byte, conf.events)
+	for i := 0; i < conf.events; i++ {
+		events[i] = []byte{byte(i)}
+	}
+	if err := conn.PublishBatch(config.topic, events); err != nil {
+		t.Fatalf("batch publish failed: %v.", err)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	// Verify that the single event handler got all events unpacked
+	if have := len(handler.delivers); have != conf.events {
+		t.Errorf("single event count mismatch: have %d, want %d.", have, conf.events)
+	}
+	// Verify that the batch handler got all events in bounded batches
+	arrived := 0
+	for done := false; !done; {
+		select {
+		case batch := <-batcher.delivers:
+			if len(batch) > conf.batch {
+				t.Errorf("batch size exceeded: have %d, want <= %d.", len(batch), conf.batch)
+			}
+			arrived += len(batch)
+		default:
+			done = true
+		}
+	}
+	if arrived != conf.events {
+		t.Errorf("batched event count mismatch: have %d, want %d.", arrived, conf.events)
+	}
+	// Verify that plain events are never interpreted as batches
+	plain := []byte("iris-batch:plain")
+	if err := conn.Publish(config.topic, plain); err != nil {
+		t.Fatalf("plain publish failed: %v.", err)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	for i := 0; i < conf.events; i++ {
+		<-handler.delivers
+	}
+	select {
+	case event := <-handler.delivers:
+		if !bytes.Equal(event, plain) {
+			t.Errorf("plain event mismatch: have %q, want %q.", event, plain)
+		}
+	default:
+		t.Errorf("plain event not delivered.")
+	}
+}
+
+// Tests the channel based subscriptions and their overflow policies.
+func TestPublishChan(t *testing.T) {
+	// Test specific configurations
+	conf := struct {
+		buffer int
+		events int
+	}{4, 8}
+
+	// Connect to the local relay
+	conn, err := Connect(config.relay)
+	if err != nil {
+		t.Fatalf("connection failed: %v", err)
+	}
+	defer conn.Close()
+
+	for _, policy := range []OverflowPolicy{DropNewest, DropOldest} {
+		// Subscribe to a topic and wait for state propagation
+		sub, err := conn.SubscribeChan(config.topic, conf.buffer, policy, nil)
+		if err != nil {
+			t.Fatalf("policy %v: subscription failed: %v", policy, err)
+		}
+		time.Sleep(100 * time.Millisecond)
+
+		// Publish more events than the buffer can hold
+		for i := 0; i < conf.events; i++ {
+			if err := conn.Publish(config.topic, []byte{byte(i)}); err != nil {
+				t.Fatalf("policy %v: event publish failed: %v.", policy, err)
+			}
+		}
+		time.Sleep(100 * time.Millisecond)
+
+		// Verify that the buffer was limited (forwarder may hold one extra)
+		arrived := 0
+		for done := false; !done; {
+			select {
+			case <-sub.Events():
+				arrived++
+			case <-time.After(10 * time.Millisecond):
+				done = true
+			}
+		}
+		if arrived < conf.buffer || arrived > conf.buffer+1 {
+			t.Errorf("policy %v: delivered event count mismatch: have %v, want %v(+1).", policy, arrived, conf.buffer)
+		}
+		// Unsubscribe and verify the channel closure
+		if err := sub.Close(); err != nil {
+			t.Fatalf("policy %v: unsubscription failed: %v", policy, err)
+		}
+		if _, ok := <-sub.Events(); ok {
+			t.Fatalf("policy %v: event channel not closed", policy)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
 // Benchmarks the latency of a single publish operation.
 func BenchmarkPublishLatency(b *testing.B) {
 	// Connect to the local relay
@@ -0,0 +1,614 @@
+// Copyright (c) 2014 Project Iris. All rights reserved.
+//
+// The current language binding is an official support library of the Iris
+// cloud messaging framework, and as such, the same licensing terms apply.
+// For details please see http://iris.karalabe.com/downloads#License
+
+// Contains the persistent work queue broker, its workers and producers.
+
+package iris
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Prefix of the topic a queue broker announces the available jobs on.
+const queueTopicPrefix = "iris-queue:"
+
+// Returns the topic announcing the available jobs of a queue broker cluster.
+func queueTopic(cluster string) string {
+	return queueTopicPrefix + cluster
+}
+
+// Single job delivered to a worker.
+type Job struct {
+	ID      uint64 // Unique id of the job within its queue
+	Attempt int    // Delivery attempt, starting from 1
+	Data    []byte // Contents of the job
+}
+
+// Handler processing the jobs of a work queue. Returning nil acknowledges the
+// job, whereas an error rejects it for redelivery (or dead-lettering).
+type JobHandler func(job *Job) error
+
+// Snapshot of a work queue's state and traffic.
+type QueueStats struct {
+	Pending  uint64 // Jobs waiting for delivery
+	InFlight uint64 // Jobs delivered but not yet acknowledged
+	Dead     uint64 // Jobs moved to the dead-letter store
+
+	Enqueued    uint64 // Jobs enqueued since the broker started
+	Acked       uint64 // Jobs acknowledged since the broker started
+	Redelivered uint64 // Rejected or timed out deliveries since the broker started
+}
+
+// Work queue broker service, storing the jobs on disk until a worker
+// acknowledges them. Delivered jobs are hidden for the visibility timeout, after
+// which they are redelivered, and moved to the dead-letter store once they fail
+// the maximum number of attempts.
+//
+// Every job is stored in its own file within the broker's directory, so that
+// a restarted broker redelivers all the unacknowledged jobs. The id counter is
+// persisted alongside, so ids are never reused, even after all the jobs were
+// acknowledged. The job contents are also cached in memory. Exactly one broker
+// instance may be registered per cluster.
+type QueueBroker struct {
+	serv *Service      // Service serving the queue requests
+	conn *Connection   // Connection to publish the job announcements through
+	dir  string        // Directory containing the job files
+	opts *QueueOptions // Visibility and dead-lettering options
+
+	jobs    map[uint64]*queuedJob // Live jobs (pending and in-flight), indexed by id
+	pending []uint64              // Ids of the jobs awaiting delivery, in order
+	next    uint64                // Id to assign to the next job
+	stats   QueueStats            // Counters of the queue traffic
+	lock    sync.Mutex            // Mutex to protect the queue state
+
+	quit chan struct{} // Quit channel to stop the redelivery
+}
+
+// Single job stored by the broker.
+type queuedJob struct {
+	id       uint64    // Unique id of the job
+	attempts int       // Number of deliveries so far
+	data     []byte    // Contents of the job
+	deadline time.Time // Visibility deadline if in-flight (zero if pending)
+}
+
+// Registers a work queue broker service into cluster, storing its jobs in dir
+// (recovering any jobs left there by a previous broker).
+func RegisterQueueBroker(port int, cluster string, dir string, opts *QueueOptions, limits *ServiceLimits) (*QueueBroker, error) {
+	b := &QueueBroker{
+		dir:  dir,
+		opts: finalizeQueueOptions(opts),
+		jobs: make(map[uint64]*queuedJob),
+		next: 1,
+		quit: make(chan struct{}),
+	}
+	if err := b.load(); err != nil {
+		return nil, err
+	}
+	mux := NewCallMux()
+	mux.Handle("enqueue", b.enqueue)
+	mux.Handle("fetch", b.fetch)
+	mux.Handle("ack", b.ack)
+	mux.Handle("nack", b.nack)
+	mux.Handle("stats", b.report)
+
+	handler := &ServiceFuncs{
+		OnInit:    func(conn *Connection) error { b.conn = conn; return nil },
+		OnRequest: mux.HandleRequest,
+	}
+	serv, err := Register(port, cluster, handler, limits)
+	if err != nil {
+		return nil, err
+	}
+	b.serv = serv
+
+	go b.expire()
+	return b, nil
+}
+
+// Merges the user requested queue options with the defaults.
+func finalizeQueueOptions(user *QueueOptions) *QueueOptions {
+	// If the user didn't specify anything, load the full default set
+	if user == nil {
+		return &defaultQueueOptions
+	}
+	// Check each field and merge only non-specified ones
+	opts := new(QueueOptions)
+	*opts = *user
+
+	if user.Visibility == 0 {
+		opts.Visibility = defaultQueueOptions.Visibility
+	}
+	if user.MaxAttempts == 0 {
+		opts.MaxAttempts = defaultQueueOptions.MaxAttempts
+	}
+	return opts
+}
+
+// Unregisters the broker. The stored jobs remain for a broker restarted on the
+// same directory.
+func (b *QueueBroker) Close() error {
+	close(b.quit)
+	return b.serv.Unregister()
+}
+
+// Retrieves the jobs moved to the dead-letter store, ordered by their ids.
+func (b *QueueBroker) DeadLetters() ([]*Job, error) {
+	files, err := os.ReadDir(filepath.Join(b.dir, "dead"))
+	if err != nil {
+		return nil, err
+	}
+	jobs := []*Job{}
+	for _, file := range files {
+		id, err := strconv.ParseUint(file.Name(), 16, 64)
+		if err != nil {
+			continue
+		}
+		attempts, data, err := readJobFile(filepath.Join(b.dir, "dead", file.Name()))
+		if err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, &Job{ID: id, Attempt: attempts, Data: data})
+	}
+	sort.Slice(jobs, func(i, j int) bool { return jobs[i].ID < jobs[j].ID })
+	return jobs, nil
+}
+
+// Stores a new job and announces it to the workers.
+func (b *QueueBroker) enqueue(data []byte) ([]byte, error) {
+	b.lock.Lock()
+
+	// Persist the id counter first, so the id is never handed out again
+	job := &queuedJob{id: b.next, data: data}
+	if err := writeSyncedFile(b.counterPath(), binary.AppendUvarint(nil, job.id+1)); err != nil {
+		b.lock.Unlock()
+		return nil, err
+	}
+	b.next++
+	if err := writeJobFile(b.jobPath(job.id), job.attempts, job.data); err != nil {
+		b.lock.Unlock()
+		return nil, err
+	}
+	b.jobs[job.id] = job
+	b.pending = append(b.pending, job.id)
+	b.stats.Enqueued++
+	b.lock.Unlock()
+
+	b.announce()
+	return binary.AppendUvarint(nil, job.id), nil
+}
+
+// Delivers the next pending job, hiding it until the visibility deadline.
+func (b *QueueBroker) fetch(request []byte) ([]byte, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	for len(b.pending) > 0 {
+		job, ok := b.jobs[b.pending[0]]
+		b.pending = b.pending[1:]
+		if !ok {
+			continue
+		}
+		// Persist the attempt before handing out the job
+		if err := writeJobFile(b.jobPath(job.id), job.attempts+1, job.data); err != nil {
+			b.pending = append([]uint64{job.id}, b.pending...)
+			return nil, err
+		}
+		job.attempts++
+		job.deadline = time.Now().Add(b.opts.Visibility)
+
+		reply := binary.AppendUvarint([]byte{1}, job.id)
+		reply = binary.AppendUvarint(reply, uint64(job.attempts))
+		return append(reply, job.data...), nil
+	}
+	return []byte{0}, nil
+}
+
+// Acknowledges an in-flight job, deleting it.
+func (b *QueueBroker) ack(request []byte) ([]byte, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	job, err := b.delivered(request)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Remove(b.jobPath(job.id)); err != nil {
+		return nil, err
+	}
+	delete(b.jobs, job.id)
+	b.stats.Acked++
+	return []byte{}, nil
+}
+
+// Rejects an in-flight job, redelivering or dead-lettering it.
+func (b *QueueBroker) nack(request []byte) ([]byte, error) {
+	b.lock.Lock()
+	job, err := b.delivered(request)
+	if err != nil {
+		b.lock.Unlock()
+		return nil, err
+	}
+	requeued := b.retry(job)
+	b.lock.Unlock()
+
+	if requeued {
+		b.announce()
+	}
+	return []byte{}, nil
+}
+
+// Reports the queue statistics.
+func (b *QueueBroker) report(request []byte) ([]byte, error) {
+	stats := b.Stats()
+	reply := []byte{}
+	for _, field := range []uint64{stats.Pending, stats.InFlight, stats.Dead, stats.Enqueued, stats.Acked, stats.Redelivered} {
+		reply = binary.AppendUvarint(reply, field)
+	}
+	return reply, nil
+}
+
+// Retrieves a snapshot of the queue statistics.
+func (b *QueueBroker) Stats() *QueueStats {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	stats := b.stats
+	for _, job := range b.jobs {
+		if job.deadline.IsZero() {
+			stats.Pending++
+		} else {
+			stats.InFlight++
+		}
+	}
+	return &stats
+}
+
+// Looks up the in-flight job referenced by an ack or nack request. The lock
+// needs to be held.
+func (b *QueueBroker) delivered(request []byte) (*queuedJob, error) {
+	id, n := binary.Uvarint(request)
+	if n <= 0 {
+		return nil, errors.New("invalid job id")
+	}
+	attempt, k := binary.Uvarint(request[n:])
+	if k <= 0 {
+		return nil, errors.New("invalid job attempt")
+	}
+	job, ok := b.jobs[id]
+	if !ok || job.deadline.IsZero() || uint64(job.attempts) != attempt {
+		return nil, fmt.Errorf("stale job delivery: %d/%d", id, attempt)
+	}
+	return job, nil
+}
+
+// Requeues a failed delivery, or moves the job to the dead-letter store if it
+// ran out of attempts, returning whether it was requeued. If the job cannot be
+// dead-lettered, it stays hidden and is retried on the next sweep. The lock
+// needs to be held.
+func (b *QueueBroker) retry(job *queuedJob) bool {
+	if job.attempts >= b.opts.MaxAttempts {
+		b.serv.Log.Warn("dead-lettering failed job", "job", job.id, "attempts", job.attempts)
+		if err := os.Rename(b.jobPath(job.id), filepath.Join(b.dir, "dead", jobName(job.id))); err != nil {
+			b.serv.Log.Error("failed to dead-letter job", "job", job.id, "reason", err)
+			job.deadline = time.Now()
+			return false
+		}
+		delete(b.jobs, job.id)
+		b.stats.Dead++
+		return false
+	}
+	job.deadline = time.Time{}
+	b.pending = append(b.pending, job.id)
+	b.stats.Redelivered++
+	return true
+}
+
+// Periodically redelivers the jobs whose visibility timeout expired.
+func (b *QueueBroker) expire() {
+	ticker := time.NewTicker(queueSweepInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-b.quit:
+			return
+		}
+		requeued := false
+
+		b.lock.Lock()
+		now := time.Now()
+		for _, job := range b.jobs {
+			if !job.deadline.IsZero() && now.After(job.deadline) {
+				if b.retry(job) {
+					requeued = true
+				}
+			}
+		}
+		b.lock.Unlock()
+
+		if requeued {
+			b.announce()
+		}
+	}
+}
+
+// Notifies the idle workers of an available job, best effort. The lock must not
+// be held, as the publish blocks on the network.
+func (b *QueueBroker) announce() {
+	if err := b.conn.Publish(queueTopic(b.conn.cluster), []byte{0}); err != nil {
+		b.serv.Log.Warn("failed to announce job", "reason", err)
+	}
+}
+
+// Returns the path of the file persisting the id counter.
+func (b *QueueBroker) counterPath() string {
+	return filepath.Join(b.dir, "next")
+}
+
+// Returns the path of a live job's file.
+func (b *QueueBroker) jobPath(id uint64) string {
+	return filepath.Join(b.dir, "jobs", jobName(id))
+}
+
+// Recovers the id counter and the jobs stored by a previous broker, queueing all
+// of them for delivery in their original order.
+func (b *QueueBroker) load() error {
+	for _, sub := range []string{"jobs", "dead"} {
+		if err := os.MkdirAll(filepath.Join(b.dir, sub), 0700); err != nil {
+			return err
+		}
+	}
+	blob, err := os.ReadFile(b.counterPath())
+	switch {
+	case err == nil:
+		next, n := binary.Uvarint(blob)
+		if n <= 0 {
+			return errors.New("corrupt job id counter")
+		}
+		if next > b.next {
+			b.next = next
+		}
+	case !os.IsNotExist(err):
+		return err
+	}
+	for _, sub := range []string{"jobs", "dead"} {
+		files, err := os.ReadDir(filepath.Join(b.dir, sub))
+		if err != nil {
+			return err
+		}
+		for _, file := range files {
+			id, err := strconv.ParseUint(file.Name(), 16, 64)
+			if err != nil {
+				continue // Leftover temporary file
+			}
+			if id >= b.next {
+				b.next = id + 1
+			}
+			if sub == "dead" {
+				b.stats.Dead++
+				continue
+			}
+			attempts, data, err := readJobFile(filepath.Join(b.dir, sub, file.Name()))
+			if err != nil {
+				return err
+			}
+			b.jobs[id] = &queuedJob{id: id, attempts: attempts, data: data}
+			b.pending = append(b.pending, id)
+		}
+	}
+	sort.Slice(b.pending, func(i, j int) bool { return b.pending[i] < b.pending[j] })
+	return nil
+}
+
+// Returns the file name of a job, sorting in id order.
+func jobName(id uint64) string {
+	return fmt.Sprintf("%016x", id)
+}
+
+// Atomically writes a job file with its attempt count and contents.
+func writeJobFile(path string, attempts int, data []byte) error {
+	blob := binary.AppendUvarint(nil, uint64(attempts))
+	blob = append(blob, data...)
+
+	return writeSyncedFile(path, blob)
+}
+
+// Atomically replaces a file with the given contents, flushed to disk.
+func writeSyncedFile(path string, blob []byte) error {
+	file, err := os.OpenFile(path+".tmp", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(blob); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// Reads back a job file's attempt count and contents.
+func readJobFile(path string) (int, []byte, error) {
+	blob, err := os.ReadFile(path)
+	if err != nil {
+		return 0, nil, err
+	}
+	attempts, n := binary.Uvarint(blob)
+	if n <= 0 {
+		return 0, nil, fmt.Errorf("corrupt job file %s", path)
+	}
+	return int(attempts), blob[n:], nil
+}
+
+// Stores a job in the work queue served by cluster, returning its id once it
+// was persisted by the broker.
+//
+// The timeout unit is in milliseconds. Anything lower will fail with an error.
+func (c *Connection) Enqueue(cluster string, job []byte, timeout time.Duration) (uint64, error) {
+	if job == nil {
+		return 0, errors.New("nil job")
+	}
+	reply, err := c.Call(cluster, "enqueue", job, timeout)
+	if err != nil {
+		return 0, err
+	}
+	id, n := binary.Uvarint(reply)
+	if n <= 0 {
+		return 0, errors.New("invalid enqueue reply")
+	}
+	return id, nil
+}
+
+// Retrieves the statistics of the work queue served by cluster.
+//
+// The timeout unit is in milliseconds. Anything lower will fail with an error.
+func (c *Connection) QueueStats(cluster string, timeout time.Duration) (*QueueStats, error) {
+	reply, err := c.Call(cluster, "stats", []byte{}, timeout)
+	if err != nil {
+		return nil, err
+	}
+	stats := new(QueueStats)
+	for _, field := range []*uint64{&stats.Pending, &stats.InFlight, &stats.Dead, &stats.Enqueued, &stats.Acked, &stats.Redelivered} {
+		value, n := binary.Uvarint(reply)
+		if n <= 0 {
+			return nil, errors.New("invalid stats reply")
+		}
+		*field, reply = value, reply[n:]
+	}
+	return stats, nil
+}
+
+// Worker consuming the jobs of a work queue one by one.
+type Worker struct {
+	conn    *Connection   // Connection to reach the broker through
+	cluster string        // Cluster of the queue broker
+	watch   *Subscription // Subscription to the job announcements
+	wake    chan struct{} // Job announcement signaler
+	quit    chan struct{} // Quit channel to stop the running loop
+	once    sync.Once     // Guard against multiple closes
+}
+
+// Creates a worker for the work queue served by cluster. Multiple workers may
+// consume the same queue concurrently.
+func (c *Connection) Worker(cluster string) (*Worker, error) {
+	if len(cluster) == 0 {
+		return nil, errors.New("empty cluster identifier")
+	}
+	w := &Worker{
+		conn:    c,
+		cluster: cluster,
+		wake:    make(chan struct{}, 1),
+		quit:    make(chan struct{}),
+	}
+	watch, err := c.SubscribeHandler(queueTopic(cluster), TopicHandlerFunc(w.handleAnnounce), nil)
+	if err != nil {
+		return nil, err
+	}
+	w.watch = watch
+	return w, nil
+}
+
+// Stops the worker, returning ErrClosed from Run once the job in progress (if
+// any) is finished, and unsubscribes from the job announcements.
+func (w *Worker) Close() error {
+	err := ErrClosed
+	w.once.Do(func() {
+		close(w.quit)
+		err = w.watch.Close()
+	})
+	return err
+}
+
+// Fetches and processes jobs until the context is cancelled or the worker or
+// connection is closed, acknowledging the successfully handled ones and rejecting the
+// failed ones. Jobs running longer than the visibility timeout are redelivered
+// to other workers, their late results discarded.
+func (w *Worker) Run(ctx context.Context, handler JobHandler) error {
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-w.quit:
+			return ErrClosed
+		default:
+		}
+		job, err := w.fetch()
+		if err == ErrClosed {
+			return err
+		}
+		if err != nil {
+			w.conn.Log.Warn("failed to fetch job", "queue", w.cluster, "reason", err)
+		}
+		if job == nil {
+			// Queue empty or unreachable, wait for an announcement
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-w.quit:
+				return ErrClosed
+			case <-w.wake:
+			case <-time.After(queuePollInterval):
+			}
+			continue
+		}
+		// Process the job and report the result
+		op := "ack"
+		if err := handler(job); err != nil {
+			w.conn.Log.Debug("job failed", "queue", w.cluster, "job", job.ID, "attempt", job.Attempt, "reason", err)
+			op = "nack"
+		}
+		request := binary.AppendUvarint(nil, job.ID)
+		request = binary.AppendUvarint(request, uint64(job.Attempt))
+		if _, err := w.conn.Call(w.cluster, op, request, queueRequestTimeout); err != nil {
+			w.conn.Log.Warn("failed to report job result", "queue", w.cluster, "job", job.ID, "op", op, "reason", err)
+		}
+	}
+}
+
+// Requests the next job from the broker, or nil if none is pending.
+func (w *Worker) fetch() (*Job, error) {
+	reply, err := w.conn.Call(w.cluster, "fetch", []byte{}, queueRequestTimeout)
+	if err != nil {
+		return nil, err
+	}
+	if len(reply) == 0 || reply[0] == 0 {
+		return nil, nil
+	}
+	id, n := binary.Uvarint(reply[1:])
+	if n <= 0 {
+		return nil, errors.New("invalid fetch reply")
+	}
+	attempt, k := binary.Uvarint(reply[1+n:])
+	if k <= 0 {
+		return nil, errors.New("invalid fetch reply")
+	}
+	return &Job{ID: id, Attempt: int(attempt), Data: reply[1+n+k:]}, nil
+}
+
+// Wakes up the idle worker on a job announcement.
+func (w *Worker) handleAnnounce(event []byte) {
+	select {
+	case w.wake <- struct{}{}:
+	default:
+	}
+}
@@ -0,0 +1,191 @@
+// Copyright (c) 2014 Project Iris. All rights reserved.
+//
+// The current language binding is an official support library of the Iris
+// cloud messaging framework, and as such, the same licensing terms apply.
+// For details please see http://iris.karalabe.com/downloads#License
+
+package iris
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Tests that queued jobs are delivered, redelivered on failure or timeout,
+// dead-lettered after the maximum attempts, and survive a broker restart.
+func TestQueue(t *testing.T) {
+	// Test specific configurations
+	conf := struct {
+		jobs int
+		opts QueueOptions
+	}{16, QueueOptions{Visibility: 100 * time.Millisecond, MaxAttempts: 3}}
+
+	dir := filepath.Join(t.TempDir(), "queue")
+	broker, err := RegisterQueueBroker(config.relay, config.cluster, dir, &conf.opts, nil)
+	if err != nil {
+		t.Fatalf("queue broker registration failed: %v.", err)
+	}
+	conn, err := Connect(config.relay)
+	if err != nil {
+		t.Fatalf("connection failed: %v.", err)
+	}
+	defer conn.Close()
+
+	// Enqueue a batch of jobs, one failing always and one timing out once
+	for i := 0; i < conf.jobs; i++ {
+		if _, err := conn.Enqueue(config.cluster, []byte(fmt.Sprintf("job-%d", i)), time.Second); err != nil {
+			t.Fatalf("job %d: failed to enqueue: %v.", i, err)
+		}
+	}
+	poison, err := conn.Enqueue(config.cluster, []byte("poison"), time.Second)
+	if err != nil {
+		t.Fatalf("failed to enqueue poison job: %v.", err)
+	}
+	slow, err := conn.Enqueue(config.cluster, []byte("slow"), time.Second)
+	if err != nil {
+		t.Fatalf("failed to enqueue slow job: %v.", err)
+	}
+	// Start a worker and wait until all the jobs are processed
+	worker, err := conn.Worker(config.cluster)
+	if err != nil {
+		t.Fatalf("failed to create worker: %v.", err)
+	}
+	defer worker.Close()
+
+	var (
+		done = make(map[string]int)
+		lock sync.Mutex
+	)
+	ctx, cancel := context.WithCancel(context.Background())
+	quit := make(chan error, 1)
+	go func() {
+		quit <- worker.Run(ctx, func(job *Job) error {
+			switch {
+			case job.ID == poison:
+				return errors.New("poisoned")
+			case job.ID == slow && job.Attempt == 1:
+				time.Sleep(2 * conf.opts.Visibility)
+			}
+			lock.Lock()
+			done[string(job.Data)]++
+			lock.Unlock()
+			return nil
+		})
+	}()
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		stats, err := conn.QueueStats(config.cluster, time.Second)
+		if err != nil {
+			t.Fatalf("failed to retrieve stats: %v.", err)
+		}
+		if stats.Pending == 0 && stats.InFlight == 0 && stats.Dead == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("queue didn't drain: %+v.", stats)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	cancel()
+	if err := <-quit; err != context.Canceled {
+		t.Fatalf("worker termination mismatch: have %v, want %v.", err, context.Canceled)
+	}
+	// Verify the processed jobs, the late result of the slow one discarded
+	lock.Lock()
+	for i := 0; i < conf.jobs; i++ {
+		if n := done[fmt.Sprintf("job-%d", i)]; n != 1 {
+			t.Errorf("job %d: processing count mismatch: have %d, want %d.", i, n, 1)
+		}
+	}
+	if n := done["slow"]; n != 2 {
+		t.Errorf("slow job processing count mismatch: have %d, want %d.", n, 2)
+	}
+	lock.Unlock()
+
+	stats, err := conn.QueueStats(config.cluster, time.Second)
+	if err != nil {
+		t.Fatalf("failed to retrieve stats: %v.", err)
+	}
+	if want := uint64(conf.jobs + 2); stats.Enqueued != want {
+		t.Errorf("enqueued count mismatch: have %d, want %d.", stats.Enqueued, want)
+	}
+	if want := uint64(conf.jobs + 1); stats.Acked != want {
+		t.Errorf("acked count mismatch: have %d, want %d.", stats.Acked, want)
+	}
+	if want := uint64(conf.opts.MaxAttempts - 1 + 1); stats.Redelivered != want { // Poison retries + slow timeout
+		t.Errorf("redelivery count mismatch: have %d, want %d.", stats.Redelivered, want)
+	}
+	dead, err := broker.DeadLetters()
+	if err != nil {
+		t.Fatalf("failed to retrieve dead letters: %v.", err)
+	}
+	if len(dead) != 1 || dead[0].ID != poison || dead[0].Attempt != conf.opts.MaxAttempts {
+		t.Fatalf("dead letter mismatch: have %+v, want poison job after %d attempts.", dead, conf.opts.MaxAttempts)
+	}
+	// Enqueue a job, restart the broker and verify that it's still delivered
+	pending, err := conn.Enqueue(config.cluster, []byte("durable"), time.Second)
+	if err != nil {
+		t.Fatalf("failed to enqueue durable job: %v.", err)
+	}
+	if err := broker.Close(); err != nil {
+		t.Fatalf("failed to close queue broker: %v.", err)
+	}
+	if broker, err = RegisterQueueBroker(config.relay, config.cluster, dir, &conf.opts, nil); err != nil {
+		t.Fatalf("queue broker re-registration failed: %v.", err)
+	}
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+
+	jobs := make(chan *Job, 1)
+	go worker.Run(ctx, func(job *Job) error {
+		jobs <- job
+		cancel()
+		return nil
+	})
+	select {
+	case job := <-jobs:
+		if job.ID != pending || string(job.Data) != "durable" {
+			t.Fatalf("recovered job mismatch: have %d/%s, want %d/%s.", job.ID, job.Data, pending, "durable")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("recovered job delivery timed out.")
+	}
+	// Wait for the queue to drain, restart the broker and verify that ids aren't reused
+	for deadline := time.Now().Add(2 * time.Second); ; {
+		stats, err := conn.QueueStats(config.cluster, time.Second)
+		if err != nil {
+			t.Fatalf("failed to retrieve stats: %v.", err)
+		}
+		if stats.Pending == 0 && stats.InFlight == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("queue didn't drain: %+v.", stats)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := broker.Close(); err != nil {
+		t.Fatalf("failed to close queue broker: %v.", err)
+	}
+	if broker, err = RegisterQueueBroker(config.relay, config.cluster, dir, &conf.opts, nil); err != nil {
+		t.Fatalf("queue broker re-registration failed: %v.", err)
+	}
+	defer broker.Close()
+
+	if id, err := conn.Enqueue(config.cluster, []byte("fresh"), time.Second); err != nil {
+		t.Fatalf("failed to enqueue after drain: %v.", err)
+	} else if id <= pending {
+		t.Fatalf("job id reused after restart: have %d, previous %d.", id, pending)
+	}
+	// Close the worker and verify that it stops running
+	if err := worker.Close(); err != nil {
+		t.Fatalf("failed to close worker: %v.", err)
+	}
+	if err := worker.Run(context.Background(), func(*Job) error { return nil }); err != ErrClosed {
+		t.Fatalf("run after close mismatch: have %v, want %v.", err, ErrClosed)
+	}
+}
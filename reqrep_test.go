@@ -157,6 +157,30 @@ func TestRequestFail(t *testing.T) {
 	}
 }
 
+// Tests that function handlers without a request callback reject requests.
+func TestRequestNotSupported(t *testing.T) {
+	// Register a new service with only an init callback to the relay
+	var conn *Connection
+	handler := &ServiceFuncs{
+		OnInit: func(c *Connection) error { conn = c; return nil },
+	}
+	serv, err := Register(config.relay, config.cluster, handler, nil)
+	if err != nil {
+		t.Fatalf("registration failed: %v.", err)
+	}
+	defer serv.Unregister()
+
+	// Verify that requests fail remotely with the unsupported error
+	reply, err := conn.Request(config.cluster, []byte{0x00}, time.Second)
+	if err == nil {
+		t.Fatalf("request didn't fail: %v.", reply)
+	} else if _, ok := err.(*RemoteError); !ok {
+		t.Fatalf("request didn't fail remotely: %v.", err)
+	} else if err.Error() != ErrNotSupported.Error() {
+		t.Fatalf("error message mismatch: have %v, want %v.", err, ErrNotSupported)
+	}
+}
+
 // Service handler for the request/reply limit tests.
 type requestTestTimedHandler struct {
 	conn  *Connection
@@ -339,6 +363,70 @@ func TestRequestExpiration(t *testing.T) {
 	}
 }
 
+// Tests that requests can be routed to a specific service instance, identified
+// through a tagged reply.
+func TestRequestInstance(t *testing.T) {
+	// Test specific configurations
+	conf := struct {
+		servers  int
+		requests int
+	}{5, 25}
+
+	// Register a batch of services tagging their replies with their instance ids
+	instances := make(map[string]bool)
+	for i := 0; i < conf.servers; i++ {
+		var conn *Connection
+		handler := &ServiceFuncs{
+			OnInit: func(c *Connection) error { conn = c; return nil },
+			OnRequest: func(req []byte) ([]byte, error) {
+				return conn.InstanceReply(req), nil
+			},
+		}
+		serv, err := Register(config.relay, config.cluster, handler, nil)
+		if err != nil {
+			t.Fatalf("registration %d failed: %v.", i, err)
+		}
+		defer serv.Unregister()
+
+		if serv.Instance() == "" || serv.Instance() != conn.Instance() || instances[serv.Instance()] {
+			t.Fatalf("service %d: invalid instance id: %q.", i, serv.Instance())
+		}
+		instances[serv.Instance()] = true
+	}
+	// Connect to the local relay and locate an instance via the load balancer
+	conn, err := Connect(config.relay)
+	if err != nil {
+		t.Fatalf("connection failed: %v.", err)
+	}
+	defer conn.Close()
+
+	reply, err := conn.Request(config.cluster, []byte{0x00}, time.Second)
+	if err != nil {
+		t.Fatalf("request failed: %v.", err)
+	}
+	id, _, err := ParseInstanceReply(reply)
+	if err != nil {
+		t.Fatalf("failed to parse instance reply: %v.", err)
+	}
+	if !instances[id] {
+		t.Fatalf("unknown serving instance: %q.", id)
+	}
+	// Verify that follow-up requests stick to the same instance
+	for i := 0; i < conf.requests; i++ {
+		reply, err := conn.RequestInstance(id, []byte{byte(i)}, time.Second)
+		if err != nil {
+			t.Fatalf("instance request %d failed: %v.", i, err)
+		}
+		have, data, err := ParseInstanceReply(reply)
+		if err != nil {
+			t.Fatalf("failed to parse instance reply %d: %v.", i, err)
+		}
+		if have != id || len(data) != 1 || data[0] != byte(i) {
+			t.Fatalf("instance reply %d mismatch: have %s/%v, want %s/%v.", i, have, data, id, []byte{byte(i)})
+		}
+	}
+}
+
 // Benchmarks the latency of a single request/reply operation.
 func BenchmarkRequestLatency(b *testing.B) {
 	// Create the service handler
@@ -0,0 +1,606 @@
+// Copyright (c) 2014 Project Iris. All rights reserved.
+//
+// The current language binding is an official support library of the Iris
+// cloud messaging framework, and as such, the same licensing terms apply.
+// For details please see http://iris.karalabe.com/downloads#License
+
+// Contains the method routed remote procedure calls over tunnels and requests.
+
+package iris
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// Frame types of the tunnel call protocol.
+const (
+	rpcRequest byte = iota // Invokes a method expecting a single reply
+	rpcStream              // Invokes a method expecting a stream of replies
+	rpcReply               // Carries the single reply of a call
+	rpcItem                // Carries one reply of a streamed call
+	rpcEnd                 // Finishes a streamed call successfully
+	rpcFault               // Fails a call with a remote error
+	rpcCancel              // Abandons a call, stopping any reply stream
+	rpcCredit              // Grants a streamed call allowance for more replies
+)
+
+// Handler of a single method call, matching ServiceHandler.HandleRequest.
+type CallHandler func(request []byte) ([]byte, error)
+
+// Handler of a server-streamed method call, sending the replies one by one via
+// reply. If the caller abandons the call, reply returns ErrClosed.
+type StreamHandler func(request []byte, reply func([]byte) error) error
+
+// Method router for remote calls. The same handlers can serve cluster requests
+// (by passing HandleRequest to the service) and tunnel calls (via Tunnel.RPC).
+type CallMux struct {
+	calls   map[string]CallHandler   // Single reply method handlers
+	streams map[string]StreamHandler // Streamed reply method handlers
+	lock    sync.RWMutex             // Mutex to protect the handler maps
+}
+
+// Creates a new, empty method router.
+func NewCallMux() *CallMux {
+	return &CallMux{
+		calls:   make(map[string]CallHandler),
+		streams: make(map[string]StreamHandler),
+	}
+}
+
+// Registers the handler of a single reply method, replacing any previous one.
+func (m *CallMux) Handle(method string, handler CallHandler) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	delete(m.streams, method)
+	m.calls[method] = handler
+}
+
+// Registers the handler of a streamed reply method, replacing any previous one.
+// Streamed methods can only be invoked over tunnels.
+func (m *CallMux) HandleStream(method string, handler StreamHandler) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	delete(m.calls, method)
+	m.streams[method] = handler
+}
+
+// Implements ServiceHandler.HandleRequest, routing requests issued through
+// Connection.Call to the registered method handlers.
+func (m *CallMux) HandleRequest(request []byte) ([]byte, error) {
+	method, payload, err := unpackCall(request)
+	if err != nil {
+		return nil, err
+	}
+	switch call, stream := m.lookup(method); {
+	case call != nil:
+		return call(payload)
+	case stream != nil:
+		return nil, fmt.Errorf("streamed method requires a tunnel: %s", method)
+	default:
+		return nil, fmt.Errorf("unknown method: %s", method)
+	}
+}
+
+// Retrieves the handlers of a method, at most one being non-nil.
+func (m *CallMux) lookup(method string) (CallHandler, StreamHandler) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	return m.calls[method], m.streams[method]
+}
+
+// Executes a method call on one member of a remote cluster, served by a CallMux
+// through a standard request.
+//
+// The timeout unit is in milliseconds. Anything lower will fail with an error.
+func (c *Connection) Call(cluster, method string, request []byte, timeout time.Duration) ([]byte, error) {
+	if request == nil {
+		return nil, errors.New("nil request")
+	}
+	return c.Request(cluster, packCall(method, request), timeout)
+}
+
+// Bidirectional remote call endpoint over a single tunnel. Both ends may issue
+// concurrent calls, served by the handlers of the other end.
+type RPC struct {
+	tun      *Tunnel  // Tunnel carrying the calls
+	handlers *CallMux // Handlers serving the remote calls (nil if none)
+
+	callIdx  uint64              // Index to assign the next outbound call
+	callLive map[uint64]*rpcCall // Outbound calls pending completion
+	callLock sync.Mutex          // Mutex to protect the outbound call state
+
+	serveLive map[uint64]*rpcServe // Inbound streamed calls being served
+	serveLock sync.Mutex           // Mutex to protect the inbound call state
+
+	sendLock sync.Mutex    // Mutex to serialize the frames on the tunnel
+	term     chan struct{} // Channel to signal termination to blocked go-routines
+	stat     error         // Failure reason, if terminated
+	termLock sync.Mutex    // Mutex to protect the termination
+}
+
+// Single outbound call waiting for its results.
+type rpcCall struct {
+	replies chan []byte   // Channel delivering the reply or reply stream
+	errc    chan error    // Channel delivering the call failure or stream end
+	done    chan struct{} // Channel closed when the call is abandoned locally
+}
+
+// Single inbound streamed call being served.
+type rpcServe struct {
+	abort  chan struct{} // Channel closed when the call is abandoned remotely
+	credit int           // Replies the caller is still willing to buffer
+	grant  chan struct{} // Signal channel for credit arrivals (capacity 1)
+	lock   sync.Mutex    // Mutex to protect the credit
+}
+
+// Takes over the tunnel and runs a call endpoint on top of it, serving the
+// remote calls through handlers (nil to reject all). Both ends of the tunnel
+// need to run an endpoint, after which Send, Recv and Conn must not be used any
+// more.
+func (t *Tunnel) RPC(handlers *CallMux) *RPC {
+	r := &RPC{
+		tun:       t,
+		handlers:  handlers,
+		callLive:  make(map[uint64]*rpcCall),
+		serveLive: make(map[uint64]*rpcServe),
+		term:      make(chan struct{}),
+	}
+	go r.process()
+	return r
+}
+
+// Executes a method call on the remote end of the tunnel, waiting for the reply
+// until the timeout expires. Remote failures are returned as RemoteError.
+//
+// Infinite blocking is supported with by setting the timeout to zero (0).
+func (r *RPC) Call(method string, request []byte, timeout time.Duration) ([]byte, error) {
+	if request == nil {
+		return nil, errors.New("nil request")
+	}
+	id, call := r.register(1)
+	defer r.unregister(id)
+
+	if err := r.send(rpcRequest, id, packCall(method, request)); err != nil {
+		return nil, err
+	}
+	// Create the timeout signaler
+	var after <-chan time.Time
+	if timeout != 0 {
+		after = time.After(timeout)
+	}
+	select {
+	case reply := <-call.replies:
+		return reply, nil
+	case err := <-call.errc:
+		return nil, err
+	case <-after:
+		go r.send(rpcCancel, id, nil)
+		return nil, ErrTimeout
+	}
+}
+
+// Executes a streamed method call on the remote end of the tunnel, returning
+// the stream of replies. The timeout bounds the whole call, after which the
+// stream is abandoned. The remote handler is throttled to the consumption rate
+// of the stream, without stalling the other calls on the tunnel.
+//
+// Infinite blocking is supported with by setting the timeout to zero (0).
+func (r *RPC) CallStream(method string, request []byte, timeout time.Duration) (*CallStream, error) {
+	if request == nil {
+		return nil, errors.New("nil request")
+	}
+	id, call := r.register(rpcStreamBacklog)
+	if err := r.send(rpcStream, id, packCall(method, request)); err != nil {
+		r.unregister(id)
+		return nil, err
+	}
+	stream := &CallStream{
+		rpc:  r,
+		id:   id,
+		call: call,
+	}
+	if timeout != 0 {
+		stream.timer = time.AfterFunc(timeout, func() { stream.abort(ErrTimeout) })
+	}
+	return stream, nil
+}
+
+// Terminates the call endpoint, failing all pending calls and closing the
+// tunnel.
+func (r *RPC) Close() error {
+	r.terminate(ErrClosed)
+	return r.tun.Close()
+}
+
+// Stream of replies of a single outbound call.
+type CallStream struct {
+	rpc   *RPC        // Endpoint the call was issued through
+	id    uint64      // Identifier of the call
+	call  *rpcCall    // Result channels of the call
+	timer *time.Timer // Timer abandoning the call on timeout (nil if infinite)
+
+	consumed int        // Replies consumed since the last credit grant
+	consLock sync.Mutex // Mutex to protect the consumption counter
+
+	stat error      // Reason for abandoning the stream
+	lock sync.Mutex // Mutex to protect the abandon state
+}
+
+// Retrieves the next reply of the stream, blocking until one arrives. Once the
+// remote handler finishes, io.EOF is returned.
+func (s *CallStream) Recv() ([]byte, error) {
+	select {
+	case reply := <-s.call.replies:
+		return s.consume(reply), nil
+	default:
+	}
+	select {
+	case reply := <-s.call.replies:
+		return s.consume(reply), nil
+	case err := <-s.call.errc:
+		// Deliver any replies that arrived before the end
+		select {
+		case reply := <-s.call.replies:
+			s.call.errc <- err
+			return reply, nil
+		default:
+		}
+		s.finish()
+		s.call.errc <- err
+		return nil, err
+	case <-s.call.done:
+		return nil, s.stat
+	}
+}
+
+// Accounts for a consumed reply, granting the remote handler allowance for more
+// once half of the backlog is drained.
+func (s *CallStream) consume(reply []byte) []byte {
+	s.consLock.Lock()
+	s.consumed++
+	grant := 0
+	if s.consumed >= cap(s.call.replies)/2 {
+		grant, s.consumed = s.consumed, 0
+	}
+	s.consLock.Unlock()
+
+	if grant > 0 {
+		s.rpc.send(rpcCredit, s.id, binary.AppendUvarint(nil, uint64(grant)))
+	}
+	return reply
+}
+
+// Abandons the call, stopping the remote handler if still running.
+func (s *CallStream) Close() error {
+	s.abort(ErrClosed)
+	return nil
+}
+
+// Abandons the call locally and notifies the remote side.
+func (s *CallStream) abort(err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	select {
+	case <-s.call.done:
+		return
+	default:
+	}
+	s.stat = err
+	close(s.call.done)
+	s.finish()
+	go s.rpc.send(rpcCancel, s.id, nil)
+}
+
+// Releases the resources of a completed or abandoned call.
+func (s *CallStream) finish() {
+	if s.timer != nil {
+		s.timer.Stop()
+	}
+	s.rpc.unregister(s.id)
+}
+
+// Registers a new outbound call, buffering at most backlog replies.
+func (r *RPC) register(backlog int) (uint64, *rpcCall) {
+	call := &rpcCall{
+		replies: make(chan []byte, backlog),
+		errc:    make(chan error, 1),
+		done:    make(chan struct{}),
+	}
+	r.callLock.Lock()
+	defer r.callLock.Unlock()
+
+	id := r.callIdx
+	r.callIdx++
+	r.callLive[id] = call
+
+	// Fail the call immediately if the endpoint is already down
+	select {
+	case <-r.term:
+		call.errc <- r.stat
+	default:
+	}
+	return id, call
+}
+
+// Removes an outbound call, discarding any late results.
+func (r *RPC) unregister(id uint64) {
+	r.callLock.Lock()
+	defer r.callLock.Unlock()
+
+	delete(r.callLive, id)
+}
+
+// Sends a single call frame to the remote side.
+func (r *RPC) send(kind byte, id uint64, payload []byte) error {
+	r.sendLock.Lock()
+	defer r.sendLock.Unlock()
+
+	select {
+	case <-r.term:
+		return r.stat
+	default:
+	}
+	return r.tun.Send(packRPCFrame(kind, id, payload), 0)
+}
+
+// Reads and dispatches the inbound call frames until the tunnel terminates.
+func (r *RPC) process() {
+	for {
+		frame, err := r.tun.Recv(0)
+		if err != nil {
+			if err == io.EOF {
+				err = ErrClosed
+			}
+			r.terminate(err)
+			return
+		}
+		kind, id, payload, err := unpackRPCFrame(frame)
+		if err != nil {
+			r.tun.Log.Warn("discarding invalid call frame", "reason", err)
+			continue
+		}
+		switch kind {
+		case rpcRequest, rpcStream:
+			r.serve(kind, id, payload)
+		case rpcReply, rpcItem:
+			r.deliver(id, payload)
+		case rpcEnd:
+			r.fail(id, io.EOF)
+		case rpcFault:
+			r.fail(id, &RemoteError{errors.New(string(payload))})
+		case rpcCancel:
+			r.serveLock.Lock()
+			if serve, ok := r.serveLive[id]; ok {
+				close(serve.abort)
+				delete(r.serveLive, id)
+			}
+			r.serveLock.Unlock()
+		case rpcCredit:
+			r.credit(id, payload)
+		default:
+			r.tun.Log.Warn("discarding unexpected call frame", "type", kind)
+		}
+	}
+}
+
+// Delivers a reply to a pending outbound call without blocking. Remote sides
+// exceeding the granted reply allowance get the call abandoned with ErrOverflow
+// instead of stalling the other calls on the tunnel.
+func (r *RPC) deliver(id uint64, reply []byte) {
+	r.callLock.Lock()
+	defer r.callLock.Unlock()
+
+	call, ok := r.callLive[id]
+	if !ok {
+		return
+	}
+	select {
+	case call.replies <- reply:
+		return
+	case <-call.done:
+		return
+	default:
+	}
+	r.tun.Log.Warn("reply allowance exceeded, abandoning call", "call", id, "limit", cap(call.replies))
+	delete(r.callLive, id)
+	select {
+	case call.errc <- ErrOverflow:
+	default:
+	}
+	go r.send(rpcCancel, id, nil)
+}
+
+// Completes a pending outbound call with an error (or io.EOF for streams).
+func (r *RPC) fail(id uint64, err error) {
+	r.callLock.Lock()
+	defer r.callLock.Unlock()
+
+	if call, ok := r.callLive[id]; ok {
+		select {
+		case call.errc <- err:
+		default:
+		}
+	}
+}
+
+// Grants an inbound streamed call allowance for more replies.
+func (r *RPC) credit(id uint64, payload []byte) {
+	grant, n := binary.Uvarint(payload)
+	if n <= 0 {
+		r.tun.Log.Warn("discarding invalid call credit", "call", id)
+		return
+	}
+	r.serveLock.Lock()
+	serve, ok := r.serveLive[id]
+	r.serveLock.Unlock()
+	if !ok {
+		return
+	}
+	serve.lock.Lock()
+	serve.credit += int(grant)
+	serve.lock.Unlock()
+
+	select {
+	case serve.grant <- struct{}{}:
+	default:
+	}
+}
+
+// Waits until the caller grants allowance for another reply of a streamed call.
+func (r *RPC) await(serve *rpcServe) error {
+	for {
+		serve.lock.Lock()
+		if serve.credit > 0 {
+			serve.credit--
+			serve.lock.Unlock()
+			return nil
+		}
+		serve.lock.Unlock()
+
+		select {
+		case <-serve.grant:
+		case <-serve.abort:
+			return ErrClosed
+		}
+	}
+}
+
+// Executes an inbound call in a new go-routine, sending back the results.
+func (r *RPC) serve(kind byte, id uint64, payload []byte) {
+	method, request, err := unpackCall(payload)
+	if err != nil {
+		go r.send(rpcFault, id, []byte(err.Error()))
+		return
+	}
+	var call CallHandler
+	var stream StreamHandler
+	if r.handlers != nil {
+		call, stream = r.handlers.lookup(method)
+	}
+	switch {
+	case kind == rpcRequest && call != nil:
+		go func() {
+			if reply, err := call(request); err != nil {
+				r.send(rpcFault, id, []byte(err.Error()))
+			} else {
+				r.send(rpcReply, id, reply)
+			}
+		}()
+
+	case kind == rpcStream && stream != nil:
+		serve := &rpcServe{
+			abort:  make(chan struct{}),
+			credit: rpcStreamBacklog,
+			grant:  make(chan struct{}, 1),
+		}
+		r.serveLock.Lock()
+		r.serveLive[id] = serve
+		r.serveLock.Unlock()
+
+		go func() {
+			defer func() {
+				r.serveLock.Lock()
+				if r.serveLive[id] == serve {
+					delete(r.serveLive, id)
+				}
+				r.serveLock.Unlock()
+			}()
+			reply := func(item []byte) error {
+				if item == nil {
+					return errors.New("nil reply")
+				}
+				if err := r.await(serve); err != nil {
+					return err
+				}
+				return r.send(rpcItem, id, item)
+			}
+			if err := stream(request, reply); err != nil {
+				r.send(rpcFault, id, []byte(err.Error()))
+			} else {
+				r.send(rpcEnd, id, nil)
+			}
+		}()
+
+	case call != nil || stream != nil:
+		go r.send(rpcFault, id, []byte(fmt.Sprintf("mismatching call kind for method: %s", method)))
+
+	default:
+		go r.send(rpcFault, id, []byte(fmt.Sprintf("unknown method: %s", method)))
+	}
+}
+
+// Terminates the endpoint, failing all pending calls.
+func (r *RPC) terminate(err error) {
+	r.termLock.Lock()
+	select {
+	case <-r.term:
+		r.termLock.Unlock()
+		return
+	default:
+	}
+	r.stat = err
+	close(r.term)
+	r.termLock.Unlock()
+
+	r.callLock.Lock()
+	for _, call := range r.callLive {
+		select {
+		case call.errc <- err:
+		default:
+		}
+	}
+	r.callLock.Unlock()
+
+	r.serveLock.Lock()
+	for id, serve := range r.serveLive {
+		close(serve.abort)
+		delete(r.serveLive, id)
+	}
+	r.serveLock.Unlock()
+}
+
+// Assembles a call frame from its type, call id and payload.
+func packRPCFrame(kind byte, id uint64, payload []byte) []byte {
+	frame := make([]byte, 1, 1+binary.MaxVarintLen64+len(payload))
+	frame[0] = kind
+	frame = binary.AppendUvarint(frame, id)
+	return append(frame, payload...)
+}
+
+// Splits a call frame into its type, call id and payload.
+func unpackRPCFrame(frame []byte) (byte, uint64, []byte, error) {
+	if len(frame) == 0 {
+		return 0, 0, nil, errors.New("empty call frame")
+	}
+	id, n := binary.Uvarint(frame[1:])
+	if n <= 0 {
+		return 0, 0, nil, errors.New("invalid call id")
+	}
+	return frame[0], id, frame[1+n:], nil
+}
+
+// Assembles a call payload from the method name and the request.
+func packCall(method string, request []byte) []byte {
+	call := make([]byte, 0, binary.MaxVarintLen64+len(method)+len(request))
+	call = binary.AppendUvarint(call, uint64(len(method)))
+	call = append(call, method...)
+	return append(call, request...)
+}
+
+// Splits a call payload into the method name and the request.
+func unpackCall(call []byte) (string, []byte, error) {
+	size, n := binary.Uvarint(call)
+	if n <= 0 || uint64(len(call)-n) < size {
+		return "", nil, errors.New("invalid call envelope")
+	}
+	return string(call[n : n+int(size)]), call[n+int(size):], nil
+}
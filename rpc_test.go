@@ -0,0 +1,187 @@
+// Copyright (c) 2014 Project Iris. All rights reserved.
+//
+// The current language binding is an official support library of the Iris
+// cloud messaging framework, and as such, the same licensing terms apply.
+// For details please see http://iris.karalabe.com/downloads#License
+
+package iris
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// Creates the method handlers shared by the cluster and tunnel call tests.
+func newRPCTestMux() *CallMux {
+	mux := NewCallMux()
+	mux.Handle("echo", func(request []byte) ([]byte, error) {
+		return request, nil
+	})
+	mux.Handle("fail", func(request []byte) ([]byte, error) {
+		return nil, errors.New(string(request))
+	})
+	mux.Handle("sleep", func(request []byte) ([]byte, error) {
+		time.Sleep(250 * time.Millisecond)
+		return request, nil
+	})
+	mux.HandleStream("count", func(request []byte, reply func([]byte) error) error {
+		n, err := strconv.Atoi(string(request))
+		if err != nil {
+			return err
+		}
+		for i := 0; i < n; i++ {
+			if err := reply([]byte(strconv.Itoa(i))); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return mux
+}
+
+// Tests that the same handlers serve both cluster requests and tunnel calls.
+func TestCallMux(t *testing.T) {
+	mux := newRPCTestMux()
+	serv, err := Register(config.relay, config.cluster, &ServiceFuncs{OnRequest: mux.HandleRequest}, nil)
+	if err != nil {
+		t.Fatalf("registration failed: %v.", err)
+	}
+	defer serv.Unregister()
+
+	conn, err := Connect(config.relay)
+	if err != nil {
+		t.Fatalf("connection failed: %v.", err)
+	}
+	defer conn.Close()
+
+	if reply, err := conn.Call(config.cluster, "echo", []byte("hello"), time.Second); err != nil || string(reply) != "hello" {
+		t.Fatalf("echo call mismatch: have %s/%v, want %s/%v.", reply, err, "hello", nil)
+	}
+	if _, err := conn.Call(config.cluster, "fail", []byte("boom"), time.Second); err == nil {
+		t.Fatalf("failing call succeeded.")
+	} else if _, ok := err.(*RemoteError); !ok || err.Error() != "boom" {
+		t.Fatalf("failure mismatch: have %v, want remote %s.", err, "boom")
+	}
+	if _, err := conn.Call(config.cluster, "count", []byte("3"), time.Second); err == nil {
+		t.Fatalf("streamed method succeeded through a request.")
+	}
+}
+
+// Tests concurrent calls in both directions, streamed replies, remote failures
+// and call timeouts over a single tunnel.
+func TestTunnelRPC(t *testing.T) {
+	// Test specific configurations
+	conf := struct {
+		calls int
+		items int
+	}{100, 1000}
+
+	// Register a service running a call endpoint on every inbound tunnel
+	endpoints := make(chan *RPC, 1)
+	handler := &ServiceFuncs{
+		OnTunnel: func(tun *Tunnel) {
+			endpoints <- tun.RPC(newRPCTestMux())
+		},
+	}
+	serv, err := Register(config.relay, config.cluster, handler, nil)
+	if err != nil {
+		t.Fatalf("registration failed: %v.", err)
+	}
+	defer serv.Unregister()
+
+	conn, err := Connect(config.relay)
+	if err != nil {
+		t.Fatalf("connection failed: %v.", err)
+	}
+	defer conn.Close()
+
+	tunnel, err := conn.Tunnel(config.cluster, time.Second)
+	if err != nil {
+		t.Fatalf("tunnel construction failed: %v.", err)
+	}
+	client := tunnel.RPC(newRPCTestMux())
+	defer client.Close()
+
+	server := <-endpoints
+
+	// Issue concurrent calls from both ends
+	errs := make(chan error, 2*conf.calls)
+	for i := 0; i < conf.calls; i++ {
+		for _, rpc := range []*RPC{client, server} {
+			go func(rpc *RPC, id int) {
+				request := []byte(fmt.Sprintf("call %d", id))
+				switch reply, err := rpc.Call("echo", request, time.Second); {
+				case err != nil:
+					errs <- fmt.Errorf("call %d: failed: %v", id, err)
+				case string(reply) != string(request):
+					errs <- fmt.Errorf("call %d: reply mismatch: have %s, want %s", id, reply, request)
+				default:
+					errs <- nil
+				}
+			}(rpc, i)
+		}
+	}
+	for i := 0; i < 2*conf.calls; i++ {
+		if err := <-errs; err != nil {
+			t.Fatalf("%v.", err)
+		}
+	}
+	// Verify the streamed replies
+	stream, err := client.CallStream("count", []byte(strconv.Itoa(conf.items)), time.Second)
+	if err != nil {
+		t.Fatalf("failed to start streamed call: %v.", err)
+	}
+	for i := 0; i < conf.items; i++ {
+		item, err := stream.Recv()
+		if err != nil {
+			t.Fatalf("failed to receive item %d: %v.", i, err)
+		}
+		if string(item) != strconv.Itoa(i) {
+			t.Fatalf("item %d mismatch: have %s, want %d.", i, item, i)
+		}
+	}
+	if _, err := stream.Recv(); err != io.EOF {
+		t.Fatalf("stream end mismatch: have %v, want %v.", err, io.EOF)
+	}
+	// Verify that an unconsumed stream doesn't stall the other calls
+	stream, err = client.CallStream("count", []byte(strconv.Itoa(4*rpcStreamBacklog)), time.Second)
+	if err != nil {
+		t.Fatalf("failed to start throttled call: %v.", err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if reply, err := client.Call("echo", []byte("throttled"), time.Second); err != nil || string(reply) != "throttled" {
+		t.Fatalf("call during throttling mismatch: have %s/%v, want %s/%v.", reply, err, "throttled", nil)
+	}
+	for i := 0; i < 4*rpcStreamBacklog; i++ {
+		if _, err := stream.Recv(); err != nil {
+			t.Fatalf("failed to receive throttled item %d: %v.", i, err)
+		}
+	}
+	if _, err := stream.Recv(); err != io.EOF {
+		t.Fatalf("throttled stream end mismatch: have %v, want %v.", err, io.EOF)
+	}
+	// Verify remote failures and timeouts
+	if _, err := server.Call("fail", []byte("boom"), time.Second); err == nil {
+		t.Fatalf("failing call succeeded.")
+	} else if _, ok := err.(*RemoteError); !ok || err.Error() != "boom" {
+		t.Fatalf("failure mismatch: have %v, want remote %s.", err, "boom")
+	}
+	if _, err := client.Call("unknown", []byte{}, time.Second); err == nil {
+		t.Fatalf("unknown method call succeeded.")
+	}
+	if _, err := client.Call("sleep", []byte{}, 50*time.Millisecond); err != ErrTimeout {
+		t.Fatalf("timeout mismatch: have %v, want %v.", err, ErrTimeout)
+	}
+	if reply, err := client.Call("echo", []byte("after"), time.Second); err != nil || string(reply) != "after" {
+		t.Fatalf("call after timeout mismatch: have %s/%v, want %s/%v.", reply, err, "after", nil)
+	}
+	// Verify that closing one end fails the calls of the other
+	client.Close()
+	if _, err := server.Call("sleep", []byte{}, time.Second); err != ErrClosed {
+		t.Fatalf("call after close mismatch: have %v, want %v.", err, ErrClosed)
+	}
+}
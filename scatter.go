@@ -0,0 +1,260 @@
+// Copyright (c) 2014 Project Iris. All rights reserved.
+//
+// The current language binding is an official support library of the Iris
+// cloud messaging framework, and as such, the same licensing terms apply.
+// For details please see http://iris.karalabe.com/downloads#License
+
+// Contains the scatter-gather requests reaching all members of a cluster.
+
+package iris
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// Prefix of the private topic a connection gathers its scatter replies on.
+const scatterTopicPrefix = "iris-gather:"
+
+// Completion condition of a scatter-gather request.
+type ScatterMode int
+
+const (
+	ScatterAll    ScatterMode = iota // Gathers replies until the timeout expires
+	ScatterFirst                     // Completes after the first Count replies
+	ScatterQuorum                    // Completes after a majority of the members replied
+)
+
+// User options of a scatter-gather request.
+type ScatterOptions struct {
+	Mode    ScatterMode // Completion condition of the gathering
+	Count   int         // Number of replies to wait for in ScatterFirst mode
+	Members int         // Expected cluster size for ScatterQuorum (0 = estimate)
+}
+
+// Single reply gathered from a member of the cluster.
+type ScatterReply struct {
+	Instance string // Instance id of the replying service
+	Reply    []byte // Reply of the service (nil if failed)
+	Err      error  // Remote failure of the service, wrapped in a RemoteError
+}
+
+// Asks every live member of a cluster to handle a request, gathering their
+// replies until the completion condition is met or the timeout expires. Members
+// handle the request through their HandleRequest, same as load balanced ones.
+//
+// In ScatterAll mode the expiration is the normal end of the gathering. In the
+// other modes ErrTimeout is returned alongside the partial results if not enough
+// replies arrived. Without an explicit Members count, the quorum is estimated
+// from the number of replies to the previous scatter to the same cluster; if no
+// such estimate exists, the request gathers until the timeout.
+//
+// Replies are gathered through a private topic subscribed on first use, so the
+// very first scatter may lose replies until the subscription propagates.
+// Requests travel through an internal topic of the cluster, so only members
+// running this binding take part.
+//
+// The timeout unit is in milliseconds. Anything lower will fail with an error.
+func (c *Connection) ScatterGather(cluster string, request []byte, timeout time.Duration, opts *ScatterOptions) ([]*ScatterReply, error) {
+	// Sanity check on the arguments
+	if len(cluster) == 0 {
+		return nil, errors.New("empty cluster identifier")
+	}
+	if request == nil {
+		return nil, errors.New("nil request")
+	}
+	timeoutms := int(timeout.Nanoseconds() / 1000000)
+	if timeoutms < 1 {
+		return nil, fmt.Errorf("invalid timeout %v < 1ms", timeout)
+	}
+	if opts == nil {
+		opts = new(ScatterOptions)
+	}
+	// Figure out how many replies are needed to complete
+	need := 0
+	switch opts.Mode {
+	case ScatterAll:
+	case ScatterFirst:
+		if opts.Count < 1 {
+			return nil, fmt.Errorf("invalid reply count %d < 1", opts.Count)
+		}
+		need = opts.Count
+	case ScatterQuorum:
+		members := opts.Members
+		if members == 0 {
+			c.scatterLock.Lock()
+			members = c.scatterSize[cluster]
+			c.scatterLock.Unlock()
+		}
+		if members > 0 {
+			need = members/2 + 1
+		}
+	default:
+		return nil, fmt.Errorf("unknown scatter mode %d", opts.Mode)
+	}
+	// Make sure the replies can be gathered and register the request
+	topic, err := c.gatherTopic()
+	if err != nil {
+		return nil, err
+	}
+	repc := make(chan *ScatterReply, 64)
+
+	c.scatterLock.Lock()
+	id := c.scatterIdx
+	c.scatterIdx++
+	c.scatterLive[id] = repc
+	c.scatterLock.Unlock()
+
+	defer func() {
+		c.scatterLock.Lock()
+		delete(c.scatterLive, id)
+		c.scatterLock.Unlock()
+	}()
+	// Scatter the request and gather the replies
+	scatter := binary.AppendUvarint(nil, id)
+	scatter = binary.AppendUvarint(scatter, uint64(timeoutms))
+	scatter = append(scatter, packCall(topic, request)...)
+
+	c.Log.Debug("scattering new request", "local_scatter", id, "cluster", cluster, "data", logLazyBlob(request), "timeout", timeout)
+	if err := c.sendPublish(broadcastTopic(cluster), packEnvelope(envelopeScatter, nil, scatter)); err != nil {
+		return nil, err
+	}
+	replies := []*ScatterReply{}
+	after := time.After(timeout)
+	for need == 0 || len(replies) < need {
+		select {
+		case reply := <-repc:
+			replies = append(replies, reply)
+		case <-after:
+			if opts.Mode == ScatterAll || need == 0 {
+				c.scatterLock.Lock()
+				c.scatterSize[cluster] = len(replies)
+				c.scatterLock.Unlock()
+				return replies, nil
+			}
+			return replies, ErrTimeout
+		case <-c.term:
+			return replies, ErrClosed
+		}
+	}
+	return replies, nil
+}
+
+// Retrieves the private topic of the connection gathering the scatter replies,
+// subscribing to it on first use.
+func (c *Connection) gatherTopic() (string, error) {
+	c.scatterLock.Lock()
+	defer c.scatterLock.Unlock()
+
+	if c.scatterTopic != "" {
+		return c.scatterTopic, nil
+	}
+	id, err := newInstanceId()
+	if err != nil {
+		return "", err
+	}
+	topic := scatterTopicPrefix + id
+	if err := c.Subscribe(topic, TopicHandlerFunc(c.handleGather), nil); err != nil {
+		return "", err
+	}
+	c.scatterTopic = topic
+	return topic, nil
+}
+
+// Delivers a gathered scatter reply to the pending request, if still live.
+func (c *Connection) handleGather(event []byte) {
+	id, n := binary.Uvarint(event)
+	if n <= 0 || len(event) == n {
+		c.Log.Warn("discarding malformed scatter reply")
+		return
+	}
+	fault := event[n] != 0
+
+	instance, payload, err := unpackCall(event[n+1:])
+	if err != nil {
+		c.Log.Warn("discarding malformed scatter reply", "reason", err)
+		return
+	}
+	reply := &ScatterReply{Instance: instance}
+	if fault {
+		reply.Err = &RemoteError{errors.New(string(payload))}
+	} else {
+		reply.Reply = payload
+	}
+	c.scatterLock.Lock()
+	repc, ok := c.scatterLive[id]
+	c.scatterLock.Unlock()
+
+	if ok {
+		select {
+		case repc <- reply:
+		default:
+			c.Log.Warn("dropping scatter reply, gatherer overloaded", "local_scatter", id)
+		}
+	}
+}
+
+// Schedules a scatter request for the service handler to process, publishing the
+// reply to the gatherer's topic.
+func (c *Connection) handleScatter(payload []byte) {
+	// Unpack the scatter request header
+	id, n := binary.Uvarint(payload)
+	if n <= 0 {
+		c.Log.Warn("discarding malformed scatter request")
+		return
+	}
+	payload = payload[n:]
+
+	timeoutms, n := binary.Uvarint(payload)
+	if n <= 0 {
+		c.Log.Warn("discarding malformed scatter request")
+		return
+	}
+	topic, request, err := unpackCall(payload[n:])
+	if err != nil {
+		c.Log.Warn("discarding malformed scatter request", "reason", err)
+		return
+	}
+	timeout := time.Duration(timeoutms) * time.Millisecond
+
+	logger := c.Log.New("remote_scatter", id)
+	logger.Debug("scheduling arrived scatter request", "data", logLazyBlob(request), "timeout", timeout)
+
+	// Make sure there is enough memory for the request
+	if used, ok := reserveMemory(c.reqUsed, len(request), c.limits.RequestMemory); !ok {
+		logger.Error("scatter request exceeded memory allowance", "limit", c.limits.RequestMemory, "used", used, "size", len(request))
+		return
+	}
+
+	// Create the expiration timer and schedule the request
+	expiration := time.After(timeout)
+	c.reqPool.Schedule(func() {
+		atomic.AddInt32(c.reqUsed, -int32(len(request)))
+
+		// Make sure the request didn't expire while enqueued
+		select {
+		case <-expiration:
+			logger.Error("dumping expired scheduled scatter request", "timeout", timeout)
+			return
+		default:
+		}
+		// Handle the request and publish the reply
+		reply, err := c.handler.HandleRequest(request)
+
+		event := binary.AppendUvarint(nil, id)
+		if err != nil {
+			event = append(event, 1)
+			event = append(event, packCall(c.instance, []byte(err.Error()))...)
+		} else {
+			event = append(event, 0)
+			event = append(event, packCall(c.instance, reply)...)
+		}
+		logger.Debug("replying to handled scatter request", "data", logLazyBlob(reply), "error", err)
+		if err := c.Publish(topic, event); err != nil {
+			logger.Error("failed to publish scatter reply", "reason", err)
+		}
+	})
+}
@@ -0,0 +1,95 @@
+// Copyright (c) 2014 Project Iris. All rights reserved.
+//
+// The current language binding is an official support library of the Iris
+// cloud messaging framework, and as such, the same licensing terms apply.
+// For details please see http://iris.karalabe.com/downloads#License
+
+package iris
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+// Tests that scatter requests reach every member of a cluster, completing
+// according to the requested mode.
+func TestScatterGather(t *testing.T) {
+	// Test specific configurations
+	conf := struct {
+		servers int
+	}{5}
+
+	// Register a batch of services echoing the requests
+	instances := make(map[string]bool)
+	bcasts := make(chan []byte, conf.servers)
+	for i := 0; i < conf.servers; i++ {
+		handler := &ServiceFuncs{
+			OnBroadcast: func(msg []byte) { bcasts <- msg },
+			OnRequest:   func(req []byte) ([]byte, error) { return req, nil },
+		}
+		serv, err := Register(config.relay, config.cluster, handler, nil)
+		if err != nil {
+			t.Fatalf("registration %d failed: %v.", i, err)
+		}
+		defer serv.Unregister()
+		instances[serv.Instance()] = true
+	}
+	// Connect to the local relay and gather from all members
+	conn, err := Connect(config.relay)
+	if err != nil {
+		t.Fatalf("connection failed: %v.", err)
+	}
+	defer conn.Close()
+
+	replies, err := conn.ScatterGather(config.cluster, []byte("all"), 250*time.Millisecond, nil)
+	if err != nil {
+		t.Fatalf("scatter to all failed: %v.", err)
+	}
+	if len(replies) != conf.servers {
+		t.Fatalf("reply count mismatch: have %d, want %d.", len(replies), conf.servers)
+	}
+	seen := make(map[string]bool)
+	for i, reply := range replies {
+		if reply.Err != nil || string(reply.Reply) != "all" {
+			t.Errorf("reply %d mismatch: have %s/%v, want %s/%v.", i, reply.Reply, reply.Err, "all", nil)
+		}
+		if !instances[reply.Instance] || seen[reply.Instance] {
+			t.Errorf("reply %d: unknown or duplicate instance %q.", i, reply.Instance)
+		}
+		seen[reply.Instance] = true
+	}
+	// Verify that the partial modes complete early
+	start := time.Now()
+	replies, err = conn.ScatterGather(config.cluster, []byte("first"), time.Second, &ScatterOptions{Mode: ScatterFirst, Count: 2})
+	if err != nil || len(replies) != 2 {
+		t.Fatalf("first-n scatter mismatch: have %d/%v, want %d/%v.", len(replies), err, 2, nil)
+	}
+	replies, err = conn.ScatterGather(config.cluster, []byte("quorum"), time.Second, &ScatterOptions{Mode: ScatterQuorum})
+	if err != nil || len(replies) != conf.servers/2+1 {
+		t.Fatalf("quorum scatter mismatch: have %d/%v, want %d/%v.", len(replies), err, conf.servers/2+1, nil)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("partial scatters didn't complete early: took %v.", elapsed)
+	}
+	// Verify that plain broadcasts are never mistaken for scatter requests
+	plain := []byte("iris-scatter:plain")
+	if err := conn.Broadcast(config.cluster, plain); err != nil {
+		t.Fatalf("plain broadcast failed: %v.", err)
+	}
+	for i := 0; i < conf.servers; i++ {
+		select {
+		case msg := <-bcasts:
+			if !bytes.Equal(msg, plain) {
+				t.Fatalf("plain broadcast mismatch: have %q, want %q.", msg, plain)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("plain broadcast %d not delivered.", i)
+		}
+	}
+	// Verify that unreachable counts time out
+	replies, err = conn.ScatterGather(config.cluster, []byte("many"), 100*time.Millisecond, &ScatterOptions{Mode: ScatterFirst, Count: conf.servers + 1})
+	if err != ErrTimeout || len(replies) != conf.servers {
+		t.Fatalf("unreachable scatter mismatch: have %d/%v, want %d/%v.", len(replies), err, conf.servers, ErrTimeout)
+	}
+}
@@ -0,0 +1,201 @@
+// Copyright (c) 2014 Project Iris. All rights reserved.
+//
+// The current language binding is an official support library of the Iris
+// cloud messaging framework, and as such, the same licensing terms apply.
+// For details please see http://iris.karalabe.com/downloads#License
+
+// Contains the optional sequencing layer for detecting lost and duplicated
+// broadcasts and events.
+
+package iris
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"sync"
+	"time"
+)
+
+// Number of sequence numbers behind the latest one for which late arrivals are
+// still told apart from duplicates.
+const seqWindow = 4096
+
+// Sequence anomaly counters of a broadcast or event receiver.
+type SequenceStats struct {
+	Senders    int    // Number of sequenced senders tracked (idle ones are forgotten)
+	Lost       uint64 // Messages missing from the sequences (never arrived, or still in flight)
+	Duplicates uint64 // Messages received more than once
+	Reordered  uint64 // Messages arriving after a later one from the same sender
+}
+
+// Starts stamping all subsequent broadcasts and publishes of the connection with
+// a unique sender id and a sequence number monotonically increasing for every
+// cluster and topic. Receivers strip the stamps transparently, tracking the gaps
+// and duplicates in the sequences (see Service.BroadcastStats and
+// Subscription.SequenceStats).
+//
+// Stamped messages travel through internal topics of the destination, so
+// receivers using other language bindings don't get them.
+func (c *Connection) EnableSequencing() error {
+	c.seqLock.Lock()
+	defer c.seqLock.Unlock()
+
+	if c.seqNext != nil {
+		return nil
+	}
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return err
+	}
+	c.seqId = binary.BigEndian.Uint64(id)
+	c.seqNext = make(map[string]uint64)
+
+	c.Log.Info("sequencing enabled", "sender", c.seqId)
+	return nil
+}
+
+// Generates the sequence stamp of the next message to the given destination, or
+// nil if sequencing is disabled.
+func (c *Connection) stampSequence(dest string) []byte {
+	c.seqLock.Lock()
+	defer c.seqLock.Unlock()
+
+	if c.seqNext == nil {
+		return nil
+	}
+	c.seqNext[dest]++
+
+	stamp := binary.AppendUvarint(nil, c.seqId)
+	return binary.AppendUvarint(stamp, c.seqNext[dest])
+}
+
+// Splits a sequence stamped message into the stamp and the payload.
+func unstampSequence(message []byte) (uint64, uint64, []byte, error) {
+	sender, n := binary.Uvarint(message)
+	if n <= 0 {
+		return 0, 0, nil, errors.New("invalid sequence sender")
+	}
+	message = message[n:]
+
+	seq, n := binary.Uvarint(message)
+	if n <= 0 {
+		return 0, 0, nil, errors.New("invalid sequence number")
+	}
+	return sender, seq, message[n:], nil
+}
+
+// Returns the sequence anomalies of the broadcasts received by the service.
+func (s *Service) BroadcastStats() SequenceStats {
+	return s.conn.bcastSeqs.snapshot()
+}
+
+// Returns the sequence anomalies of the events received by the subscription.
+func (s *Subscription) SequenceStats() SequenceStats {
+	return s.top.seqs.snapshot()
+}
+
+// Sequence state of a single sender.
+type seqSender struct {
+	last    uint64              // Highest sequence number seen
+	missing map[uint64]struct{} // Skipped sequence numbers within the window
+	seen    time.Time           // Arrival time of the sender's latest message
+}
+
+// Gap and duplicate tracker of the sequence stamped messages from all senders.
+// Senders idle for longer than the expiry are forgotten, their sequences started
+// afresh if they ever return.
+type seqTracker struct {
+	senders map[uint64]*seqSender // Sequence states of the individual senders
+	expiry  time.Duration         // Idle time after which a sender is forgotten
+	swept   time.Time             // Time of the last idle sender sweep
+	stats   SequenceStats         // Accumulated anomaly counters
+	lock    sync.Mutex            // Mutex to protect the tracker
+}
+
+// Creates a new, empty sequence tracker, forgetting the senders idle for longer
+// than expiry.
+func newSeqTracker(expiry time.Duration) *seqTracker {
+	return &seqTracker{
+		senders: make(map[uint64]*seqSender),
+		expiry:  expiry,
+		swept:   time.Now(),
+	}
+}
+
+// Records the arrival of a message, returning whether it was a duplicate.
+func (t *seqTracker) track(sender, seq uint64) bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	now := time.Now()
+	t.sweep(now)
+
+	// The first message of a sender starts its sequence
+	state, ok := t.senders[sender]
+	if !ok {
+		t.senders[sender] = &seqSender{last: seq, missing: make(map[uint64]struct{}), seen: now}
+		t.stats.Senders++
+		return false
+	}
+	state.seen = now
+
+	switch {
+	case seq == state.last+1:
+		state.last = seq
+
+	case seq > state.last:
+		// Some messages were skipped, remember them for late arrivals
+		first := state.last + 1
+		if seq-first > seqWindow {
+			first = seq - seqWindow
+		}
+		for missing := first; missing < seq; missing++ {
+			state.missing[missing] = struct{}{}
+		}
+		t.stats.Lost += seq - state.last - 1
+		state.last = seq
+
+		// Forget the ones fallen out of the window
+		for missing := range state.missing {
+			if seq-missing > seqWindow {
+				delete(state.missing, missing)
+			}
+		}
+	default:
+		// Older message, either a late arrival or a duplicate
+		if _, ok := state.missing[seq]; ok {
+			delete(state.missing, seq)
+			t.stats.Lost--
+			t.stats.Reordered++
+			return false
+		}
+		t.stats.Duplicates++
+		return true
+	}
+	return false
+}
+
+// Forgets the senders idle for longer than the expiry, at most once per expiry
+// period. The lock needs to be held.
+func (t *seqTracker) sweep(now time.Time) {
+	if now.Sub(t.swept) < t.expiry {
+		return
+	}
+	t.swept = now
+	for id, state := range t.senders {
+		if now.Sub(state.seen) > t.expiry {
+			delete(t.senders, id)
+			t.stats.Senders--
+		}
+	}
+}
+
+// Retrieves a copy of the accumulated anomaly counters.
+func (t *seqTracker) snapshot() SequenceStats {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.sweep(time.Now())
+	return t.stats
+}
@@ -9,6 +9,7 @@ package iris
 import (
 	"errors"
 	"fmt"
+	"sync"
 	"sync/atomic"
 
 	"gopkg.in/inconshreveable/log15.v2"
@@ -45,17 +46,79 @@ type ServiceHandler interface {
 	HandleDrop(reason error)
 }
 
+// Function based implementation of the ServiceHandler interface, allowing the
+// user to specify only the callbacks actually needed. Any unset field results
+// in a safe default behavior: initialization succeeds, broadcasts are ignored,
+// requests fail with ErrNotSupported (delivered remotely as a RemoteError),
+// tunnels are closed and drops are ignored.
+type ServiceFuncs struct {
+	OnInit      func(conn *Connection) error         // Handler for the service initialization
+	OnBroadcast func(message []byte)                 // Handler for inbound broadcasts
+	OnRequest   func(request []byte) ([]byte, error) // Handler for inbound requests
+	OnTunnel    func(tunnel *Tunnel)                 // Handler for inbound tunnels
+	OnDrop      func(reason error)                   // Handler for relay connection drops
+}
+
+// Implements ServiceHandler.Init, calling OnInit if set.
+func (s *ServiceFuncs) Init(conn *Connection) error {
+	if s.OnInit != nil {
+		return s.OnInit(conn)
+	}
+	return nil
+}
+
+// Implements ServiceHandler.HandleBroadcast, calling OnBroadcast if set.
+func (s *ServiceFuncs) HandleBroadcast(message []byte) {
+	if s.OnBroadcast != nil {
+		s.OnBroadcast(message)
+	}
+}
+
+// Implements ServiceHandler.HandleRequest, calling OnRequest if set.
+func (s *ServiceFuncs) HandleRequest(request []byte) ([]byte, error) {
+	if s.OnRequest != nil {
+		return s.OnRequest(request)
+	}
+	return nil, ErrNotSupported
+}
+
+// Implements ServiceHandler.HandleTunnel, calling OnTunnel if set.
+func (s *ServiceFuncs) HandleTunnel(tunnel *Tunnel) {
+	if s.OnTunnel != nil {
+		s.OnTunnel(tunnel)
+		return
+	}
+	tunnel.Log.Warn("closing unsupported inbound tunnel")
+	tunnel.Close()
+}
+
+// Implements ServiceHandler.HandleDrop, calling OnDrop if set.
+func (s *ServiceFuncs) HandleDrop(reason error) {
+	if s.OnDrop != nil {
+		s.OnDrop(reason)
+	}
+}
+
 // Service instance belonging to a particular cluster in the network.
 type Service struct {
-	conn *Connection  // Network connection to the local Iris relay
-	Log  log15.Logger // Logger with service id injected
+	conn *Connection // Network connection to the local Iris relay
+	inst *Connection // Network connection serving the private instance cluster
+	port int         // Port of the local Iris relay
+
+	pres     *announcer // Presence announcer of the service (nil if silent)
+	presLock sync.Mutex // Mutex to protect the announcer
+
+	elector atomic.Pointer[Elector] // Leader elector of the service (nil if none)
+
+	Log log15.Logger // Logger with service id injected
 }
 
 // Id to assign to the next service (used for logging purposes).
 var nextServId uint64
 
 // Connects to the Iris network and registers a new service instance as a member
-// of the specified service cluster.
+// of the specified service cluster. The instance also joins a private cluster of
+// its own, allowing sticky routing to it via its Instance id.
 func Register(port int, cluster string, handler ServiceHandler, limits *ServiceLimits) (*Service, error) {
 	// Sanity check on the arguments
 	if len(cluster) == 0 {
@@ -76,23 +139,36 @@ func Register(port int, cluster string, handler ServiceHandler, limits *ServiceL
 			return fmt.Sprintf("%dT|%dB", limits.RequestThreads, limits.RequestMemory)
 		}})
 
-	// Connect to the Iris relay as a service
-	conn, err := newConnection(port, cluster, handler, limits, logger)
+	// Connect to the Iris relay as a service, also joining the instance cluster
+	instance, err := newInstanceId()
+	if err != nil {
+		return nil, err
+	}
+	conn, err := newConnection(port, cluster, handler, limits, nil, logger)
 	if err != nil {
 		logger.Warn("failed to register new service", "reason", err)
 		return nil, err
 	}
-	// Assemble the service object and initialize it
+	conn.instance = instance
+
 	serv := &Service{
 		conn: conn,
+		port: port,
 		Log:  logger,
 	}
+	if err := serv.joinInstance(handler); err != nil {
+		logger.Warn("failed to register service instance", "reason", err)
+		conn.Close()
+		return nil, err
+	}
+	// Initialize the service object
 	if err := handler.Init(conn); err != nil {
 		logger.Warn("user failed to initialize service", "reason", err)
+		serv.inst.Close()
 		conn.Close()
 		return nil, err
 	}
-	logger.Info("service registration completed")
+	logger.Info("service registration completed", "instance", instance)
 
 	// Start the handler pools
 	conn.bcastPool.Start()
@@ -117,12 +193,27 @@ func finalizeServiceLimits(user *ServiceLimits) *ServiceLimits {
 	if user.BroadcastMemory == 0 {
 		limits.BroadcastMemory = defaultServiceLimits.BroadcastMemory
 	}
+	if user.BroadcastSenderExpiry == 0 {
+		limits.BroadcastSenderExpiry = defaultServiceLimits.BroadcastSenderExpiry
+	}
 	if user.RequestThreads == 0 {
 		limits.RequestThreads = defaultServiceLimits.RequestThreads
 	}
 	if user.RequestMemory == 0 {
 		limits.RequestMemory = defaultServiceLimits.RequestMemory
 	}
+	if user.TunnelBacklog == 0 {
+		limits.TunnelBacklog = defaultServiceLimits.TunnelBacklog
+	}
+	if user.TunnelInbound == 0 {
+		limits.TunnelInbound = defaultServiceLimits.TunnelInbound
+	}
+	if user.TunnelBuffer == 0 {
+		limits.TunnelBuffer = defaultServiceLimits.TunnelBuffer
+	}
+	if user.TunnelRefresh == 0 {
+		limits.TunnelRefresh = defaultServiceLimits.TunnelRefresh
+	}
 	return limits
 }
 
@@ -131,7 +222,14 @@ func finalizeServiceLimits(user *ServiceLimits) *ServiceLimits {
 //
 // The call blocks until the tear-down is confirmed by the Iris node.
 func (s *Service) Unregister() error {
-	// Tear-down the connection
+	// Leave any election, announce the leave and tear-down the connections,
+	// instance cluster first
+	if elector := s.elector.Load(); elector != nil {
+		elector.Close()
+	}
+	s.conn.drainTunnels()
+	s.withdraw()
+	s.inst.Close()
 	err := s.conn.Close()
 
 	// Stop all the thread pools (drop unprocessed messages)
@@ -0,0 +1,697 @@
+// Copyright (c) 2014 Project Iris. All rights reserved.
+//
+// The current language binding is an official support library of the Iris
+// cloud messaging framework, and as such, the same licensing terms apply.
+// For details please see http://iris.karalabe.com/downloads#License
+
+// Contains the resumable session layer, surviving tunnel and connection drops.
+
+package iris
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"sync"
+	"time"
+
+	"gopkg.in/inconshreveable/log15.v2"
+)
+
+// Frame types of the session protocol.
+const (
+	sessionHello byte = iota // Attaches a tunnel to a session (id, received count)
+	sessionData              // Carries a sequenced message
+	sessionAck               // Acknowledges all messages up to a sequence number
+	sessionClose             // Terminates the session
+)
+
+// Returned when resuming a session whose state the remote side already lost.
+var ErrSessionLost = errors.New("session state lost")
+
+// Resumable message session on top of tunnels. Messages are sequenced and kept
+// in a bounded retransmit buffer until acknowledged, so if the carrying tunnel
+// or connection drops, a new tunnel can be attached and the transfer continues
+// where it left off, without losses or duplicates.
+type Session struct {
+	id      uint64          // Globally unique session identifier
+	cluster string          // Remote cluster to resume towards (empty if hosted)
+	host    *SessionHost    // Registry of the session (nil if initiated locally)
+	opts    *SessionOptions // Retransmit and expiry options
+
+	outBuf   []*sessionEntry // Sent messages not yet acknowledged
+	outUsed  int             // Memory usage of the retransmit buffer
+	outSeq   uint64          // Sequence number of the last buffered message
+	outSent  uint64          // Sequence number of the last message written to the link
+	outAcked uint64          // Sequence number of the last acknowledged message
+	outSign  chan struct{}   // Retransmit buffer space release signaler
+
+	inbox  chan []byte // Arrived messages pending retrieval
+	inSeq  uint64      // Sequence number of the last delivered message
+	inAcks int         // Delivered messages not yet acknowledged
+	inTime *time.Timer // Linger timer flushing a pending acknowledgement
+	inHold bool        // Acknowledgements withheld during a resumption
+	inLock sync.Mutex  // Mutex to serialize deliveries and handshakes
+
+	link     *sessionLink  // Tunnel currently carrying the session (nil if detached)
+	linkSign chan struct{} // New message or link signaler for the writer
+	sendLock sync.Mutex    // Mutex to serialize the frames on the tunnel
+	expiry   *time.Timer   // Timer terminating a session detached for too long
+
+	lock sync.Mutex    // Mutex to protect the session state
+	term chan struct{} // Channel to signal termination to blocked go-routines
+	stat error         // Failure reason, if terminated
+
+	Log log15.Logger // Logger with session id injected
+}
+
+// Message buffered for potential retransmission.
+type sessionEntry struct {
+	seq  uint64 // Sequence number of the message
+	data []byte // Contents of the message
+}
+
+// Single attachment of a tunnel to a session.
+type sessionLink struct {
+	tun  *Tunnel       // Tunnel carrying the session frames
+	gone chan struct{} // Channel closed when the link is replaced or dropped
+}
+
+// Creates a new detached session and starts its writer.
+func newSession(id uint64, cluster string, host *SessionHost, opts *SessionOptions, logger log15.Logger) *Session {
+	s := &Session{
+		id:       id,
+		cluster:  cluster,
+		host:     host,
+		opts:     opts,
+		outSign:  make(chan struct{}, 1),
+		inbox:    make(chan []byte, sessionInbox),
+		linkSign: make(chan struct{}, 1),
+		term:     make(chan struct{}),
+		Log:      logger,
+	}
+	go s.write()
+	return s
+}
+
+// Merges the user requested session options with the defaults.
+func finalizeSessionOptions(user *SessionOptions) *SessionOptions {
+	// If the user didn't specify anything, load the full default set
+	if user == nil {
+		return &defaultSessionOptions
+	}
+	// Check each field and merge only non-specified ones
+	opts := new(SessionOptions)
+	*opts = *user
+
+	if user.Buffer == 0 {
+		opts.Buffer = defaultSessionOptions.Buffer
+	}
+	if user.Expiry == 0 {
+		opts.Expiry = defaultSessionOptions.Expiry
+	}
+	return opts
+}
+
+// Opens a resumable session to a member of a remote cluster. The remote side
+// needs to attach its inbound tunnels to a SessionHost.
+//
+// If the session's tunnel drops, messages keep being buffered and the session
+// can be resumed via Resume, possibly through a new connection.
+func (c *Connection) Session(cluster string, timeout time.Duration, opts *SessionOptions) (*Session, error) {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	sid := binary.BigEndian.Uint64(id)
+	sess := newSession(sid, cluster, nil, finalizeSessionOptions(opts), c.Log.New("session", sid))
+
+	if err := sess.Resume(c, timeout); err != nil {
+		sess.terminate(err)
+		return nil, err
+	}
+	return sess, nil
+}
+
+// Returns the globally unique id of the session.
+func (s *Session) ID() uint64 {
+	return s.id
+}
+
+// Attaches a new tunnel through conn to the session, replacing the current one
+// if any, and continues the transfer where the previous tunnel left off. Only
+// the initiating side may resume a session.
+//
+// The current tunnel keeps carrying the session until the new one completes
+// the handshake, so a failed resumption leaves a working session intact.
+func (s *Session) Resume(conn *Connection, timeout time.Duration) error {
+	if s.cluster == "" {
+		return errors.New("hosted sessions are resumed by the remote side")
+	}
+	select {
+	case <-s.term:
+		return s.stat
+	default:
+	}
+	// Build a new tunnel and exchange the received counts through it
+	received := s.withhold()
+	defer s.unhold()
+
+	tun, err := conn.Tunnel(s.cluster, timeout)
+	if err != nil {
+		return err
+	}
+	hello := packSessionFrame(sessionHello, s.id, binary.AppendUvarint(nil, received))
+	if err := tun.Send(hello, timeout); err != nil {
+		tun.Close()
+		return err
+	}
+	reply, err := tun.Recv(timeout)
+	if err != nil {
+		tun.Close()
+		return err
+	}
+	kind, id, payload, err := unpackSessionFrame(reply)
+	if err == nil && (kind != sessionHello || id != s.id) {
+		err = errors.New("invalid session handshake")
+	}
+	if err != nil {
+		tun.Close()
+		return err
+	}
+	peer, n := binary.Uvarint(payload)
+	if n <= 0 {
+		tun.Close()
+		return errors.New("invalid session handshake")
+	}
+	return s.attach(tun, peer)
+}
+
+// Buffers a message for sequenced delivery to the remote side, blocking until
+// there is enough space in the retransmit buffer or the operation times out.
+// The message is transferred asynchronously, surviving tunnel drops.
+//
+// Infinite blocking is supported with by setting the timeout to zero (0).
+func (s *Session) Send(message []byte, timeout time.Duration) error {
+	// Sanity check on the arguments
+	if message == nil {
+		return errors.New("nil message")
+	}
+	if len(message) > s.opts.Buffer {
+		return errors.New("message exceeds retransmit buffer")
+	}
+	// Create the timeout signaler
+	var after <-chan time.Time
+	if timeout != 0 {
+		after = time.After(timeout)
+	}
+	for {
+		s.lock.Lock()
+		select {
+		case <-s.term:
+			s.lock.Unlock()
+			return s.stat
+		default:
+		}
+		// Buffer the message if there's enough space
+		if s.outUsed+len(message) <= s.opts.Buffer {
+			s.outSeq++
+			s.outBuf = append(s.outBuf, &sessionEntry{seq: s.outSeq, data: message})
+			s.outUsed += len(message)
+
+			select {
+			case s.linkSign <- struct{}{}:
+			default:
+			}
+			s.lock.Unlock()
+			return nil
+		}
+		// Not enough space, reset the release flag and wait
+		select {
+		case <-s.outSign:
+		default:
+		}
+		s.lock.Unlock()
+
+		select {
+		case <-s.outSign:
+		case <-s.term:
+		case <-after:
+			return ErrTimeout
+		}
+	}
+}
+
+// Retrieves the next message of the session, blocking until one is available
+// or the operation times out. Tunnel drops are not visible, Recv just waits
+// until the session is resumed.
+//
+// Infinite blocking is supported with by setting the timeout to zero (0).
+func (s *Session) Recv(timeout time.Duration) ([]byte, error) {
+	// Short circuit if there's a message already buffered
+	select {
+	case msg := <-s.inbox:
+		return msg, nil
+	default:
+	}
+	// Create the timeout signaler
+	var after <-chan time.Time
+	if timeout != 0 {
+		after = time.After(timeout)
+	}
+	select {
+	case msg := <-s.inbox:
+		return msg, nil
+	case <-s.term:
+		// Terminated, but deliver anything that arrived before
+		select {
+		case msg := <-s.inbox:
+			return msg, nil
+		default:
+			return nil, s.stat
+		}
+	case <-after:
+		return nil, ErrTimeout
+	}
+}
+
+// Terminates the session on both sides, closing the carrying tunnel. Messages
+// not yet delivered are dropped.
+func (s *Session) Close() error {
+	s.lock.Lock()
+	link := s.link
+	s.lock.Unlock()
+
+	if link != nil {
+		s.sendFrame(link, sessionClose, s.id, nil)
+	}
+	s.terminate(ErrClosed)
+	return nil
+}
+
+// Detaches the current link, returning the number of messages delivered so far.
+func (s *Session) received() uint64 {
+	s.detach(nil)
+
+	// Wait for any in-flight delivery on the old link to finish
+	s.inLock.Lock()
+	defer s.inLock.Unlock()
+
+	return s.inSeq
+}
+
+// Withholds the acknowledgements until unhold, returning the number of messages
+// delivered so far. The current link keeps delivering meanwhile, but the remote
+// side never learns of a count beyond the returned one, which it may thus rely
+// on when resuming; anything delivered twice is dropped as a duplicate.
+func (s *Session) withhold() uint64 {
+	s.inLock.Lock()
+	defer s.inLock.Unlock()
+
+	s.inHold = true
+	return s.inSeq
+}
+
+// Resumes the acknowledgements, flushing any withheld ones on the current link.
+func (s *Session) unhold() {
+	s.lock.Lock()
+	link := s.link
+	s.lock.Unlock()
+
+	s.inLock.Lock()
+	defer s.inLock.Unlock()
+
+	s.inHold = false
+	if link != nil && s.inAcks > 0 && s.inTime == nil {
+		s.inTime = time.AfterFunc(sessionAckLinger, func() { s.flushAck(link) })
+	}
+}
+
+// Attaches a new tunnel to the session, given the remote side's received count.
+func (s *Session) attach(tun *Tunnel, peer uint64) error {
+	s.lock.Lock()
+	select {
+	case <-s.term:
+		s.lock.Unlock()
+		tun.Close()
+		return s.stat
+	default:
+	}
+	// Make sure the remote side didn't lose its state
+	if peer < s.outAcked || peer > s.outSeq {
+		s.lock.Unlock()
+		tun.Close()
+		s.terminate(ErrSessionLost)
+		return ErrSessionLost
+	}
+	// Replace any previous link, and resume after the remote's last message
+	if s.link != nil {
+		close(s.link.gone)
+		go s.link.tun.Close()
+	}
+	if s.expiry != nil {
+		s.expiry.Stop()
+		s.expiry = nil
+	}
+	s.release(peer)
+	s.outSent = peer
+
+	link := &sessionLink{tun: tun, gone: make(chan struct{})}
+	s.link = link
+	select {
+	case s.linkSign <- struct{}{}:
+	default:
+	}
+	s.lock.Unlock()
+
+	s.Log.Info("session attached", "tunnel", tun.id, "resume_from", peer+1)
+	go s.read(link)
+	return nil
+}
+
+// Detaches the link from the session if it's still the current one (or any if
+// nil), starting the expiry countdown.
+func (s *Session) detach(link *sessionLink) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.link == nil || (link != nil && s.link != link) {
+		return
+	}
+	close(s.link.gone)
+	go s.link.tun.Close()
+	s.link = nil
+
+	select {
+	case <-s.term:
+		return
+	default:
+	}
+	s.Log.Warn("session detached", "expiry", s.opts.Expiry)
+	s.expiry = time.AfterFunc(s.opts.Expiry, func() {
+		s.lock.Lock()
+		detached := s.link == nil
+		s.lock.Unlock()
+
+		if detached {
+			s.Log.Warn("detached session expired")
+			s.terminate(errors.New("session expired"))
+		}
+	})
+}
+
+// Drops the acknowledged messages from the retransmit buffer. The lock needs
+// to be held.
+func (s *Session) release(acked uint64) {
+	if acked <= s.outAcked {
+		return
+	}
+	s.outAcked = acked
+	for len(s.outBuf) > 0 && s.outBuf[0].seq <= acked {
+		s.outUsed -= len(s.outBuf[0].data)
+		s.outBuf = s.outBuf[1:]
+	}
+	select {
+	case s.outSign <- struct{}{}:
+	default:
+	}
+}
+
+// Terminates the session, failing all pending and future operations.
+func (s *Session) terminate(err error) {
+	s.lock.Lock()
+	select {
+	case <-s.term:
+		s.lock.Unlock()
+		return
+	default:
+	}
+	s.stat = err
+	close(s.term)
+
+	if s.link != nil {
+		close(s.link.gone)
+		go s.link.tun.Close()
+		s.link = nil
+	}
+	if s.expiry != nil {
+		s.expiry.Stop()
+	}
+	s.lock.Unlock()
+
+	if s.host != nil {
+		s.host.remove(s.id)
+	}
+}
+
+// Sends a single frame over a link, unless it's already gone.
+func (s *Session) sendFrame(link *sessionLink, kind byte, num uint64, payload []byte) error {
+	s.sendLock.Lock()
+	defer s.sendLock.Unlock()
+
+	select {
+	case <-link.gone:
+		return ErrClosed
+	default:
+	}
+	return link.tun.Send(packSessionFrame(kind, num, payload), 0)
+}
+
+// Writes the buffered messages in order to the current link, rewinding after
+// each resumption.
+func (s *Session) write() {
+	for {
+		s.lock.Lock()
+		select {
+		case <-s.term:
+			s.lock.Unlock()
+			return
+		default:
+		}
+		// Find the next unsent message, if any
+		var entry *sessionEntry
+		link := s.link
+		if link != nil && s.outSent < s.outSeq {
+			if first := s.outBuf[0].seq; s.outSent+1 < first {
+				s.outSent = first - 1 // Acknowledged meanwhile
+			}
+			entry = s.outBuf[s.outSent+1-s.outBuf[0].seq]
+		}
+		if entry == nil {
+			// Nothing to send, reset the signal flag and wait
+			select {
+			case <-s.linkSign:
+			default:
+			}
+			s.lock.Unlock()
+
+			select {
+			case <-s.linkSign:
+			case <-s.term:
+			}
+			continue
+		}
+		s.lock.Unlock()
+
+		// Send the message, dropping the link on failure
+		if err := s.sendFrame(link, sessionData, entry.seq, entry.data); err != nil {
+			s.detach(link)
+			continue
+		}
+		s.lock.Lock()
+		if s.link == link && s.outSent+1 == entry.seq {
+			s.outSent = entry.seq
+		}
+		s.lock.Unlock()
+	}
+}
+
+// Reads the inbound frames of a link until it's dropped or replaced.
+func (s *Session) read(link *sessionLink) {
+	defer s.detach(link)
+
+	for {
+		msg, err := link.tun.Recv(0)
+		if err != nil {
+			return
+		}
+		kind, num, payload, err := unpackSessionFrame(msg)
+		if err != nil {
+			s.Log.Warn("discarding invalid session frame", "reason", err)
+			continue
+		}
+		switch kind {
+		case sessionData:
+			if !s.deliver(link, num, payload) {
+				return
+			}
+		case sessionAck:
+			s.lock.Lock()
+			s.release(num)
+			s.lock.Unlock()
+		case sessionClose:
+			s.Log.Info("session closed remotely")
+			s.terminate(ErrClosed)
+			return
+		default:
+			s.Log.Warn("discarding unexpected session frame", "type", kind)
+		}
+	}
+}
+
+// Delivers an arrived message to the application unless it's a duplicate, and
+// schedules its acknowledgement. False is returned if the link is unusable.
+func (s *Session) deliver(link *sessionLink, seq uint64, message []byte) bool {
+	s.inLock.Lock()
+	defer s.inLock.Unlock()
+
+	// Drop retransmitted duplicates, and break the link on gaps
+	if seq <= s.inSeq {
+		return true
+	}
+	if seq != s.inSeq+1 {
+		s.Log.Warn("session sequence gap", "have", seq, "want", s.inSeq+1)
+		return false
+	}
+	select {
+	case s.inbox <- message:
+	case <-link.gone:
+		return false
+	case <-s.term:
+		return false
+	}
+	s.inSeq = seq
+
+	// Acknowledge in batches, or after a short linger
+	s.inAcks++
+	if s.inHold {
+		return true
+	}
+	if s.inAcks >= sessionAckBatch {
+		s.inAcks = 0
+		go s.sendFrame(link, sessionAck, seq, nil)
+	} else if s.inTime == nil {
+		s.inTime = time.AfterFunc(sessionAckLinger, func() { s.flushAck(link) })
+	}
+	return true
+}
+
+// Sends an acknowledgement of any delivered but unacknowledged messages.
+func (s *Session) flushAck(link *sessionLink) {
+	s.inLock.Lock()
+	s.inTime = nil
+	if s.inHold {
+		s.inLock.Unlock()
+		return
+	}
+	pend, seq := s.inAcks, s.inSeq
+	s.inAcks = 0
+	s.inLock.Unlock()
+
+	if pend > 0 {
+		s.sendFrame(link, sessionAck, seq, nil)
+	}
+}
+
+// Registry of the sessions hosted by a service, attaching inbound tunnels to
+// either new or previously interrupted sessions.
+type SessionHost struct {
+	opts *SessionOptions     // Options of the hosted sessions
+	live map[uint64]*Session // Active sessions
+	lock sync.Mutex          // Mutex to protect the session map
+}
+
+// Creates a new registry for hosting resumable sessions.
+func NewSessionHost(opts *SessionOptions) *SessionHost {
+	return &SessionHost{
+		opts: finalizeSessionOptions(opts),
+		live: make(map[uint64]*Session),
+	}
+}
+
+// Attaches an inbound tunnel to the session requested by the remote side. If
+// resumed is true, an existing session continues, whose owner keeps servicing
+// it, so the caller should simply return.
+func (h *SessionHost) Attach(tun *Tunnel, timeout time.Duration) (sess *Session, resumed bool, err error) {
+	// Retrieve the session handshake
+	hello, err := tun.Recv(timeout)
+	if err != nil {
+		tun.Close()
+		return nil, false, err
+	}
+	kind, id, payload, err := unpackSessionFrame(hello)
+	if err == nil && kind != sessionHello {
+		err = errors.New("invalid session handshake")
+	}
+	if err != nil {
+		tun.Close()
+		return nil, false, err
+	}
+	peer, n := binary.Uvarint(payload)
+	if n <= 0 {
+		tun.Close()
+		return nil, false, errors.New("invalid session handshake")
+	}
+	// Look up or create the session and reply with the local received count
+	h.lock.Lock()
+	if sess, resumed = h.live[id]; !resumed {
+		sess = newSession(id, "", h, h.opts, tun.conn.Log.New("session", id))
+		h.live[id] = sess
+	}
+	h.lock.Unlock()
+
+	reply := packSessionFrame(sessionHello, id, binary.AppendUvarint(nil, sess.received()))
+	if err := tun.Send(reply, timeout); err != nil {
+		tun.Close()
+		if !resumed {
+			sess.terminate(err)
+		}
+		return nil, false, err
+	}
+	if err := sess.attach(tun, peer); err != nil {
+		return nil, false, err
+	}
+	return sess, resumed, nil
+}
+
+// Terminates all the hosted sessions.
+func (h *SessionHost) Close() {
+	h.lock.Lock()
+	sessions := make([]*Session, 0, len(h.live))
+	for _, sess := range h.live {
+		sessions = append(sessions, sess)
+	}
+	h.lock.Unlock()
+
+	for _, sess := range sessions {
+		sess.terminate(ErrClosed)
+	}
+}
+
+// Removes a terminated session from the registry.
+func (h *SessionHost) remove(id uint64) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	delete(h.live, id)
+}
+
+// Assembles a session frame from its type, number and payload.
+func packSessionFrame(kind byte, num uint64, payload []byte) []byte {
+	frame := make([]byte, 1, 1+binary.MaxVarintLen64+len(payload))
+	frame[0] = kind
+	frame = binary.AppendUvarint(frame, num)
+	return append(frame, payload...)
+}
+
+// Splits a session frame into its type, number and payload.
+func unpackSessionFrame(frame []byte) (byte, uint64, []byte, error) {
+	if len(frame) == 0 {
+		return 0, 0, nil, errors.New("empty session frame")
+	}
+	num, n := binary.Uvarint(frame[1:])
+	if n <= 0 {
+		return 0, 0, nil, errors.New("invalid session frame number")
+	}
+	return frame[0], num, frame[1+n:], nil
+}
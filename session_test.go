@@ -0,0 +1,122 @@
+// Copyright (c) 2014 Project Iris. All rights reserved.
+//
+// The current language binding is an official support library of the Iris
+// cloud messaging framework, and as such, the same licensing terms apply.
+// For details please see http://iris.karalabe.com/downloads#License
+
+package iris
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+// Tests that a session survives a connection drop: messages sent while detached
+// are delivered after resuming, in order and without duplicates.
+func TestTunnelSession(t *testing.T) {
+	// Test specific configurations
+	conf := struct {
+		before int
+		during int
+		after  int
+	}{100, 100, 100}
+
+	// Register a service echoing back every session message
+	host := NewSessionHost(nil)
+	defer host.Close()
+
+	handler := &ServiceFuncs{
+		OnTunnel: func(tun *Tunnel) {
+			sess, resumed, err := host.Attach(tun, time.Second)
+			if err != nil || resumed {
+				return
+			}
+			for {
+				msg, err := sess.Recv(0)
+				if err != nil {
+					return
+				}
+				if err := sess.Send(msg, 0); err != nil {
+					return
+				}
+			}
+		},
+	}
+	serv, err := Register(config.relay, config.cluster, handler, nil)
+	if err != nil {
+		t.Fatalf("registration failed: %v.", err)
+	}
+	defer serv.Unregister()
+
+	// Open a session through a first connection and exchange some messages
+	conn, err := Connect(config.relay)
+	if err != nil {
+		t.Fatalf("connection failed: %v.", err)
+	}
+	sess, err := conn.Session(config.cluster, time.Second, nil)
+	if err != nil {
+		conn.Close()
+		t.Fatalf("session construction failed: %v.", err)
+	}
+	defer sess.Close()
+
+	// Fail a resumption and verify that the current link keeps working
+	dead, err := Connect(config.relay)
+	if err != nil {
+		t.Fatalf("connection failed: %v.", err)
+	}
+	dead.Close()
+	if err := sess.Resume(dead, time.Second); err == nil {
+		t.Fatalf("resumption through closed connection succeeded.")
+	}
+	next := 0
+	for ; next < conf.before; next++ {
+		if err := sess.Send([]byte(fmt.Sprintf("%d", next)), time.Second); err != nil {
+			t.Fatalf("failed to send message %d: %v.", next, err)
+		}
+	}
+	for i := 0; i < conf.before; i++ {
+		msg, err := sess.Recv(time.Second)
+		if err != nil {
+			t.Fatalf("failed to receive message %d: %v.", i, err)
+		}
+		if string(msg) != fmt.Sprintf("%d", i) {
+			t.Fatalf("message %d mismatch: have %s, want %d.", i, msg, i)
+		}
+	}
+	// Drop the connection and keep sending while detached
+	conn.Close()
+	for ; next < conf.before+conf.during; next++ {
+		if err := sess.Send([]byte(fmt.Sprintf("%d", next)), time.Second); err != nil {
+			t.Fatalf("failed to send detached message %d: %v.", next, err)
+		}
+	}
+	// Resume through a new connection and finish the transfer
+	conn, err = Connect(config.relay)
+	if err != nil {
+		t.Fatalf("reconnection failed: %v.", err)
+	}
+	defer conn.Close()
+
+	if err := sess.Resume(conn, time.Second); err != nil {
+		t.Fatalf("failed to resume session: %v.", err)
+	}
+	for ; next < conf.before+conf.during+conf.after; next++ {
+		if err := sess.Send([]byte(fmt.Sprintf("%d", next)), time.Second); err != nil {
+			t.Fatalf("failed to send message %d: %v.", next, err)
+		}
+	}
+	for i := conf.before; i < next; i++ {
+		msg, err := sess.Recv(time.Second)
+		if err != nil {
+			t.Fatalf("failed to receive message %d: %v.", i, err)
+		}
+		if string(msg) != fmt.Sprintf("%d", i) {
+			t.Fatalf("message %d mismatch: have %s, want %d.", i, msg, i)
+		}
+	}
+	if msg, err := sess.Recv(100 * time.Millisecond); err != ErrTimeout {
+		t.Fatalf("unexpected extra message: %s, %v.", msg, err)
+	}
+}
@@ -0,0 +1,203 @@
+// Copyright (c) 2014 Project Iris. All rights reserved.
+//
+// The current language binding is an official support library of the Iris
+// cloud messaging framework, and as such, the same licensing terms apply.
+// For details please see http://iris.karalabe.com/downloads#License
+
+// Contains the consistent hash based key sharding across service clusters.
+
+package iris
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Returns the cluster name of a single shard of a sharded service.
+func ShardCluster(name string, shard int) string {
+	return fmt.Sprintf("%s/shard-%d", name, shard)
+}
+
+// Connects to the Iris network and registers a new service instance as a member
+// of a single shard of a sharded service. Multiple instances may serve the same
+// shard, in which case requests are load balanced between them.
+func RegisterShard(port int, name string, shard int, handler ServiceHandler, limits *ServiceLimits) (*Service, error) {
+	if len(name) == 0 {
+		return nil, errors.New("empty sharded service name")
+	}
+	if shard < 0 {
+		return nil, fmt.Errorf("invalid shard index %d", shard)
+	}
+	return Register(port, ShardCluster(name, shard), handler, limits)
+}
+
+// Consistent hash ring mapping keys onto a fixed number of shards.
+//
+// Each shard is placed onto the ring at a number of pseudo-random positions
+// (replicas) derived solely from its index. When the shard count changes, only
+// the keys between the moved positions are remapped: growing from N to M shards
+// moves keys solely onto the new shards, shrinking moves solely the keys of the
+// removed shards, each roughly |M-N|/max(M,N) of the key space.
+type ShardRing struct {
+	shards int      // Number of shards on the ring
+	hashes []uint64 // Sorted positions of the virtual nodes
+	owners []int    // Shard owning each virtual node position
+}
+
+// Creates a hash ring of the given number of shards, each having replicas
+// virtual nodes.
+func NewShardRing(shards, replicas int) (*ShardRing, error) {
+	if shards <= 0 {
+		return nil, fmt.Errorf("invalid shard count %d", shards)
+	}
+	if replicas <= 0 {
+		return nil, fmt.Errorf("invalid replica count %d", replicas)
+	}
+	type vnode struct {
+		hash  uint64
+		shard int
+	}
+	nodes := make([]vnode, 0, shards*replicas)
+	for shard := 0; shard < shards; shard++ {
+		for replica := 0; replica < replicas; replica++ {
+			nodes = append(nodes, vnode{shardHash(fmt.Sprintf("%d#%d", shard, replica)), shard})
+		}
+	}
+	sort.Slice(nodes, func(i, j int) bool {
+		if nodes[i].hash != nodes[j].hash {
+			return nodes[i].hash < nodes[j].hash
+		}
+		return nodes[i].shard < nodes[j].shard // Deterministic on collisions
+	})
+	ring := &ShardRing{
+		shards: shards,
+		hashes: make([]uint64, len(nodes)),
+		owners: make([]int, len(nodes)),
+	}
+	for i, node := range nodes {
+		ring.hashes[i], ring.owners[i] = node.hash, node.shard
+	}
+	return ring, nil
+}
+
+// Returns the number of shards on the ring.
+func (r *ShardRing) Shards() int {
+	return r.shards
+}
+
+// Locates the shard owning a key: the first virtual node clockwise from the
+// key's position on the ring.
+func (r *ShardRing) Locate(key string) int {
+	hash := shardHash(key)
+	idx := sort.Search(len(r.hashes), func(i int) bool { return r.hashes[i] >= hash })
+	if idx == len(r.hashes) {
+		idx = 0
+	}
+	return r.owners[idx]
+}
+
+// Hashes a key or virtual node onto the ring, using FNV-1a with a final mixing
+// step to spread similar inputs.
+func shardHash(key string) uint64 {
+	hasher := fnv.New64a()
+	hasher.Write([]byte(key))
+	hash := hasher.Sum64()
+
+	hash ^= hash >> 33
+	hash *= 0xff51afd7ed558ccd
+	hash ^= hash >> 33
+	hash *= 0xc4ceb9fe1a85ec53
+	hash ^= hash >> 33
+	return hash
+}
+
+// Client routing keyed requests to the owning shards of a sharded service.
+type ShardedClient struct {
+	conn *Connection   // Connection through which to reach the shards
+	name string        // Name of the sharded service
+	opts *ShardOptions // Hash ring configuration
+
+	ring *ShardRing   // Current hash ring of the shards
+	lock sync.RWMutex // Mutex to protect the ring during resizes
+}
+
+// Creates a client routing keyed requests to the given number of shards of the
+// sharded service name.
+func (c *Connection) Sharded(name string, shards int, opts *ShardOptions) (*ShardedClient, error) {
+	if len(name) == 0 {
+		return nil, errors.New("empty sharded service name")
+	}
+	opts = finalizeShardOptions(opts)
+
+	ring, err := NewShardRing(shards, opts.Replicas)
+	if err != nil {
+		return nil, err
+	}
+	return &ShardedClient{
+		conn: c,
+		name: name,
+		opts: opts,
+		ring: ring,
+	}, nil
+}
+
+// Merges the user requested shard options with the defaults.
+func finalizeShardOptions(user *ShardOptions) *ShardOptions {
+	// If the user didn't specify anything, load the full default set
+	if user == nil {
+		return &defaultShardOptions
+	}
+	// Check each field and merge only non-specified ones
+	opts := new(ShardOptions)
+	*opts = *user
+
+	if user.Replicas == 0 {
+		opts.Replicas = defaultShardOptions.Replicas
+	}
+	return opts
+}
+
+// Returns the shard currently owning a key.
+func (s *ShardedClient) Shard(key string) int {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	return s.ring.Locate(key)
+}
+
+// Executes a synchronous request on the shard owning key, load balanced between
+// the instances serving that shard.
+//
+// The timeout unit is in milliseconds. Anything lower will fail with an error.
+func (s *ShardedClient) Request(key string, request []byte, timeout time.Duration) ([]byte, error) {
+	return s.conn.Request(ShardCluster(s.name, s.Shard(key)), request, timeout)
+}
+
+// Opens a tunnel to an instance of the shard owning key.
+//
+// The timeout unit is in milliseconds. Anything lower will fail with an error.
+func (s *ShardedClient) Tunnel(key string, timeout time.Duration) (*Tunnel, error) {
+	return s.conn.Tunnel(ShardCluster(s.name, s.Shard(key)), timeout)
+}
+
+// Changes the number of shards keys are distributed over, returning the
+// previous ring. Subsequent requests are routed according to the new ring; it
+// is the services' responsibility to hand off the keys whose owner changed
+// (those where the old and new rings' Locate differ) before or while the
+// clients switch over.
+func (s *ShardedClient) Resize(shards int) (*ShardRing, error) {
+	ring, err := NewShardRing(shards, s.opts.Replicas)
+	if err != nil {
+		return nil, err
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	old := s.ring
+	s.ring = ring
+	return old, nil
+}
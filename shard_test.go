@@ -0,0 +1,114 @@
+// Copyright (c) 2014 Project Iris. All rights reserved.
+//
+// The current language binding is an official support library of the Iris
+// cloud messaging framework, and as such, the same licensing terms apply.
+// For details please see http://iris.karalabe.com/downloads#License
+
+package iris
+
+import (
+	"fmt"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// Tests that the hash ring spreads keys evenly, and that resizing it only moves
+// keys between the added or removed shards.
+func TestShardRing(t *testing.T) {
+	// Test specific configurations
+	conf := struct {
+		keys     int
+		replicas int
+		skew     float64
+	}{100000, 128, 0.25}
+
+	rings := make(map[int]*ShardRing)
+	for _, shards := range []int{4, 5, 3} {
+		ring, err := NewShardRing(shards, conf.replicas)
+		if err != nil {
+			t.Fatalf("failed to create ring of %d shards: %v.", shards, err)
+		}
+		rings[shards] = ring
+
+		// Verify that the keys are balanced between the shards
+		counts := make([]int, shards)
+		for i := 0; i < conf.keys; i++ {
+			counts[ring.Locate(strconv.Itoa(i))]++
+		}
+		fair := float64(conf.keys) / float64(shards)
+		for shard, count := range counts {
+			if float64(count) < (1-conf.skew)*fair || float64(count) > (1+conf.skew)*fair {
+				t.Errorf("%d shards: shard %d unbalanced: have %d keys, want %d±%.0f%%.", shards, shard, count, int(fair), 100*conf.skew)
+			}
+		}
+	}
+	// Verify that growing only moves keys onto the new shard, and shrinking only
+	// off the removed one
+	for i := 0; i < conf.keys; i++ {
+		key := strconv.Itoa(i)
+		if prev, next := rings[4].Locate(key), rings[5].Locate(key); prev != next && next != 4 {
+			t.Fatalf("key %s moved between old shards when growing: %d -> %d.", key, prev, next)
+		}
+		if prev, next := rings[4].Locate(key), rings[3].Locate(key); prev != next && prev != 3 {
+			t.Fatalf("key %s moved between kept shards when shrinking: %d -> %d.", key, prev, next)
+		}
+	}
+}
+
+// Tests that keyed requests are routed to the owning shard services.
+func TestShardedRequest(t *testing.T) {
+	// Test specific configurations
+	conf := struct {
+		shards int
+		keys   int
+	}{3, 100}
+
+	// Register a service for each shard, replying with its index
+	for i := 0; i < conf.shards; i++ {
+		shard := []byte(strconv.Itoa(i))
+		handler := &ServiceFuncs{
+			OnRequest: func(req []byte) ([]byte, error) { return shard, nil },
+		}
+		serv, err := RegisterShard(config.relay, config.cluster, i, handler, nil)
+		if err != nil {
+			t.Fatalf("shard %d: registration failed: %v.", i, err)
+		}
+		defer serv.Unregister()
+	}
+	// Connect to the local relay and verify the key routing
+	conn, err := Connect(config.relay)
+	if err != nil {
+		t.Fatalf("connection failed: %v.", err)
+	}
+	defer conn.Close()
+
+	client, err := conn.Sharded(config.cluster, conf.shards, nil)
+	if err != nil {
+		t.Fatalf("failed to create sharded client: %v.", err)
+	}
+	for i := 0; i < conf.keys; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		reply, err := client.Request(key, []byte{0x00}, time.Second)
+		if err != nil {
+			t.Fatalf("request for key %s failed: %v.", key, err)
+		}
+		if want := strconv.Itoa(client.Shard(key)); string(reply) != want {
+			t.Fatalf("key %s served by wrong shard: have %s, want %s.", key, reply, want)
+		}
+	}
+	// Shrink the shard count and verify that the removed shard is not used
+	if _, err := client.Resize(conf.shards - 1); err != nil {
+		t.Fatalf("failed to resize client: %v.", err)
+	}
+	for i := 0; i < conf.keys; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		reply, err := client.Request(key, []byte{0x00}, time.Second)
+		if err != nil {
+			t.Fatalf("request for key %s failed after resize: %v.", key, err)
+		}
+		if string(reply) == strconv.Itoa(conf.shards-1) {
+			t.Fatalf("key %s served by removed shard.", key)
+		}
+	}
+}
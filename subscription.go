@@ -0,0 +1,189 @@
+// Copyright (c) 2014 Project Iris. All rights reserved.
+//
+// The current language binding is an official support library of the Iris
+// cloud messaging framework, and as such, the same licensing terms apply.
+// For details please see http://iris.karalabe.com/downloads#License
+
+// Contains the topic subscription handles and the channel based delivery.
+
+package iris
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/project-iris/iris/container/queue"
+	"gopkg.in/inconshreveable/log15.v2"
+)
+
+// Behavior of a channel subscription when its event buffer is full.
+type OverflowPolicy int
+
+const (
+	DropNewest OverflowPolicy = iota // Discards the newly arrived event
+	DropOldest                       // Discards the oldest buffered events to make space
+)
+
+// Handle of a single local subscription to a topic, delivering the arriving
+// events either to a callback handler or through a Go channel.
+type Subscription struct {
+	conn  *Connection // Connection through which the subscription was made
+	topic string      // Name of the subscribed topic
+	id    uint64      // Local subscription id within the topic
+	top   *topic      // Local subscription enforcing the limits
+}
+
+// Subscribes to a topic, delivering the arriving events through the channel
+// returned by the subscription's Events method.
+//
+// At most bufferSize events are queued for the consumer, any further arrivals
+// being handled according to policy. The EventMemory of the limits caps the
+// total size of the queued events, whereas EventThreads is unused.
+func (c *Connection) SubscribeChan(topic string, bufferSize int, policy OverflowPolicy, limits *TopicLimits) (*Subscription, error) {
+	// Sanity check on the arguments
+	if len(topic) == 0 {
+		return nil, errors.New("empty topic identifier")
+	}
+	if bufferSize < 1 {
+		return nil, fmt.Errorf("invalid buffer size %d < 1", bufferSize)
+	}
+	if policy != DropNewest && policy != DropOldest {
+		return nil, fmt.Errorf("unknown overflow policy %d", policy)
+	}
+	// Make sure the subscription limits have valid values
+	limits = finalizeTopicLimits(limits)
+
+	// Subscribe with the channel feeding stream
+	return c.subscribe(topic, nil, nil, newEventStream(bufferSize, policy, limits), nil, limits)
+}
+
+// Returns the channel through which the topic events are delivered, or nil for
+// handler based subscriptions. The channel is closed when the subscription
+// terminates.
+func (s *Subscription) Events() <-chan []byte {
+	if s.top.stream == nil {
+		return nil
+	}
+	return s.top.stream.events
+}
+
+// Removes this subscription from the topic, leaving any others intact. Channel
+// subscriptions discard their undelivered events and close the event channel.
+//
+// If this was the last local subscription to the topic, the method blocks until
+// the unsubscription is forwarded to the local Iris node.
+func (s *Subscription) Close() error {
+	return s.conn.unsubscribe(s.topic, s.id)
+}
+
+// Bounded event buffer feeding the delivery channel of a subscription.
+type eventStream struct {
+	// Quality of service fields
+	limits *TopicLimits   // Limits on the buffered memory
+	size   int            // Maximum number of buffered events
+	policy OverflowPolicy // Behavior when the buffer is full
+
+	buffer *queue.Queue  // Events pending delivery to the channel
+	used   int           // Memory usage of the pending events
+	sign   chan struct{} // Event arrival signaler
+	lock   sync.Mutex    // Protects the buffer and signaler
+
+	// Bookkeeping fields
+	events chan []byte   // Delivery channel of the subscription
+	term   chan struct{} // Channel to signal termination to the forwarder
+	done   chan struct{} // Channel to signal the forwarder's completion
+}
+
+// Creates a new event stream. The channel forwarder is started by the topic.
+func newEventStream(size int, policy OverflowPolicy, limits *TopicLimits) *eventStream {
+	return &eventStream{
+		limits: limits,
+		size:   size,
+		policy: policy,
+		buffer: queue.New(),
+		sign:   make(chan struct{}, 1),
+		events: make(chan []byte),
+		term:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+}
+
+// Queues an arrived event for channel delivery, enforcing the buffer limits.
+func (s *eventStream) push(id int, event []byte, logger log15.Logger) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	// Discard events that can never fit into the buffer
+	if len(event) > s.limits.EventMemory {
+		logger.Error("event exceeded memory allowance", "event", id, "limit", s.limits.EventMemory, "size", len(event))
+		return
+	}
+	// Make space for the new event, or drop it, based on the overflow policy
+	for s.buffer.Size() >= s.size || s.used+len(event) > s.limits.EventMemory {
+		if s.policy == DropNewest {
+			logger.Error("event exceeded buffer allowance", "event", id, "limit", s.size, "used", s.used, "size", len(event))
+			return
+		}
+		dropped := s.buffer.Pop().([]byte)
+		s.used -= len(dropped)
+		logger.Warn("discarding oldest buffered event", "size", len(dropped))
+	}
+	// Queue the event and signal the forwarder
+	s.buffer.Push(event)
+	s.used += len(event)
+
+	select {
+	case s.sign <- struct{}{}:
+	default:
+	}
+}
+
+// Fetches the next buffered event, if any is available.
+func (s *eventStream) fetch() ([]byte, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if !s.buffer.Empty() {
+		event := s.buffer.Pop().([]byte)
+		s.used -= len(event)
+		return event, true
+	}
+	// No event, reset arrival flag
+	select {
+	case <-s.sign:
+	default:
+	}
+	return nil, false
+}
+
+// Moves the buffered events into the delivery channel until terminated.
+func (s *eventStream) forward() {
+	defer close(s.done)
+	defer close(s.events)
+
+	for {
+		// Wait for an event to become available
+		event, ok := s.fetch()
+		if !ok {
+			select {
+			case <-s.term:
+				return
+			case <-s.sign:
+				continue
+			}
+		}
+		// Deliver it to the consumer
+		select {
+		case <-s.term:
+			return
+		case s.events <- event:
+		}
+	}
+}
+
+// Terminates the forwarder, discarding any undelivered events.
+func (s *eventStream) terminate() {
+	close(s.term)
+	<-s.done
+}
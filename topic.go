@@ -7,9 +7,10 @@
 package iris
 
 import (
+	"sync"
 	"sync/atomic"
+	"time"
 
-	"github.com/project-iris/iris/pool"
 	"gopkg.in/inconshreveable/log15.v2"
 )
 
@@ -20,37 +21,67 @@ type TopicHandler interface {
 	HandleEvent(event []byte)
 }
 
+// Adapter to allow the use of ordinary functions as topic handlers.
+type TopicHandlerFunc func(event []byte)
+
+// Implements TopicHandler.HandleEvent, calling f(event).
+func (f TopicHandlerFunc) HandleEvent(event []byte) {
+	f(event)
+}
+
 // Topic subscription, responsible for enforcing the quality of service limits.
 type topic struct {
 	// Application layer fields
-	handler TopicHandler // Handler for topic events
+	handler TopicHandler      // Handler for topic events
+	batcher BatchTopicHandler // Handler for batches of topic events (if not single event based)
+	stream  *eventStream      // Channel feeder for topic events (if not handler based)
+	filter  EventFilter       // Predicate to discard unwanted events early, if any
 
 	// Quality of service fields
 	limits *TopicLimits // Limits on the inbound message processing
 
-	eventIdx  uint64           // Index to assign to inbound events for logging purposes
-	eventPool *pool.ThreadPool // Queue and concurrency limiter for the event handlers
-	eventUsed int32            // Actual memory usage of the event queue
+	eventMatched  uint64      // Number of events accepted by the filter
+	eventFiltered uint64      // Number of events discarded by the filter
+	seqs          *seqTracker // Gap and duplicate tracker of the sequenced events
+
+	eventIdx  uint64     // Index to assign to inbound events for logging purposes
+	eventPool *keyedPool // Queue and concurrency limiter for the event handlers
+	eventUsed int32      // Actual memory usage of the event queue
+
+	batchBuf  [][]byte    // Events accumulated for the next batch
+	batchUsed int         // Memory usage of the accumulated events
+	batchGen  uint64      // Generation of the current batch (stale linger timer detection)
+	batchTime *time.Timer // Linger timer flushing an incomplete batch
+	batchLock sync.Mutex  // Mutex to protect the batch fields
 
 	// Bookkeeping fields
 	logger log15.Logger
 }
 
-// Creates a new topic subscription.
-func newTopic(handler TopicHandler, limits *TopicLimits, logger log15.Logger) *topic {
+// Creates a new topic subscription, delivering events either to one of the
+// handlers or into the channel stream.
+func newTopic(handler TopicHandler, batcher BatchTopicHandler, stream *eventStream, filter EventFilter, limits *TopicLimits, logger log15.Logger) *topic {
 	top := &topic{
 		// Application layer
 		handler: handler,
+		batcher: batcher,
+		stream:  stream,
+		filter:  filter,
 
 		// Quality of service
-		limits:    limits,
-		eventPool: pool.NewThreadPool(limits.EventThreads),
+		limits: limits,
+		seqs:   newSeqTracker(limits.EventSenderExpiry),
 
 		// Bookkeeping
 		logger: logger,
 	}
 	// Start the event processing and return
-	top.eventPool.Start()
+	if stream != nil {
+		go stream.forward()
+	} else {
+		top.eventPool = newKeyedPool(limits.EventThreads, limits.EventKey)
+		top.eventPool.Start()
+	}
 	return top
 }
 
@@ -70,6 +101,15 @@ func finalizeTopicLimits(user *TopicLimits) *TopicLimits {
 	if user.EventMemory == 0 {
 		limits.EventMemory = defaultTopicLimits.EventMemory
 	}
+	if user.EventSenderExpiry == 0 {
+		limits.EventSenderExpiry = defaultTopicLimits.EventSenderExpiry
+	}
+	if user.BatchSize == 0 {
+		limits.BatchSize = defaultTopicLimits.BatchSize
+	}
+	if user.BatchLinger == 0 {
+		limits.BatchLinger = defaultTopicLimits.BatchLinger
+	}
 	return limits
 }
 
@@ -78,12 +118,30 @@ func (t *topic) handlePublish(event []byte) {
 	id := int(atomic.AddUint64(&t.eventIdx, 1))
 	t.logger.Debug("scheduling arrived event", "event", id, "data", logLazyBlob(event))
 
+	// Discard unwanted events before any resources are spent on them
+	if t.filter != nil {
+		if !t.filter(event) {
+			atomic.AddUint64(&t.eventFiltered, 1)
+			t.logger.Debug("discarding filtered event", "event", id)
+			return
+		}
+		atomic.AddUint64(&t.eventMatched, 1)
+	}
+	// Channel subscriptions are limited by the stream buffer
+	if t.stream != nil {
+		t.stream.push(id, event, t.logger)
+		return
+	}
 	// Make sure there is enough memory for the event
 	used := int(atomic.LoadInt32(&t.eventUsed)) // Safe, since only 1 thread increments!
 	if used+len(event) <= t.limits.EventMemory {
 		// Increment the memory usage of the queue and schedule the event
 		atomic.AddInt32(&t.eventUsed, int32(len(event)))
-		t.eventPool.Schedule(func() {
+		if t.batcher != nil {
+			t.batchEvent(event)
+			return
+		}
+		t.eventPool.Schedule(event, func() {
 			// Start the processing by decrementing the memory usage
 			atomic.AddInt32(&t.eventUsed, -int32(len(event)))
 			t.logger.Debug("handling scheduled event", "event", id)
@@ -97,6 +155,13 @@ func (t *topic) handlePublish(event []byte) {
 
 // Terminates a topic subscription's internal processing pool.
 func (t *topic) terminate() {
-	// Wait for queued events to finish running
-	t.eventPool.Terminate(false)
+	// Stop feeding the subscription channel, or wait for queued events to finish
+	if t.stream != nil {
+		t.stream.terminate()
+	} else {
+		if t.batcher != nil {
+			t.flushBatch()
+		}
+		t.eventPool.Terminate(false)
+	}
 }
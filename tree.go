@@ -0,0 +1,187 @@
+// Copyright (c) 2014 Project Iris. All rights reserved.
+//
+// The current language binding is an official support library of the Iris
+// cloud messaging framework, and as such, the same licensing terms apply.
+// For details please see http://iris.karalabe.com/downloads#License
+
+// Contains the hierarchical topic layer built on top of the flat Iris topics.
+
+package iris
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Separator between the levels of a hierarchical topic.
+const treeSeparator = "."
+
+// Prefix of the relay topics backing the hierarchical ones, to avoid collision
+// with plain topics.
+const treeTopicPrefix = "iris-tree:"
+
+// Callback interface for processing events from a hierarchical topic pattern.
+type TreeHandler interface {
+	// Callback invoked whenever an event is published to a topic matching the
+	// pattern subscribed to by this particular handler.
+	HandleTreeEvent(topic string, event []byte)
+}
+
+// Adapter to allow the use of ordinary functions as hierarchical topic handlers.
+type TreeHandlerFunc func(topic string, event []byte)
+
+// Implements TreeHandler.HandleTreeEvent, calling f(topic, event).
+func (f TreeHandlerFunc) HandleTreeEvent(topic string, event []byte) {
+	f(topic, event)
+}
+
+// Subscribes to all the hierarchical topics matching pattern, using handler as
+// the callback for arriving events.
+//
+// A hierarchical topic is a sequence of non-empty levels separated by dots (e.g.
+// orders.eu.created). Patterns may additionally contain two kinds of wildcards,
+// each occupying a full level:
+//
+//   - "*" matches exactly one level: orders.*.created matches orders.eu.created
+//     but neither orders.created nor orders.eu.west.created
+//   - "#" matches zero or more levels and may only be the last one: orders.#
+//     matches orders, orders.eu and orders.eu.created
+//
+// Since the relay only knows flat topics, an event published to a topic of N
+// levels is forwarded to N+1 relay topics, one for each prefix of the topic
+// (including the empty one). A pattern subscribes to the single relay topic of
+// its literal prefix (the levels preceding the first wildcard) and filters the
+// events locally (see SubscribeFiltered), hence every matching handler receives
+// each event exactly once.
+//
+// Only events published via PublishTree are delivered. Similarly to Subscribe,
+// the method blocks until the subscription is forwarded to the relay.
+func (c *Connection) SubscribeTree(pattern string, handler TreeHandler, limits *TopicLimits) (*Subscription, error) {
+	// Sanity check on the arguments
+	levels, err := parseTreeTopic(pattern, true)
+	if err != nil {
+		return nil, err
+	}
+	if handler == nil {
+		return nil, errors.New("nil subscription handler")
+	}
+	// Make sure the subscription limits have valid values
+	limits = finalizeTopicLimits(limits)
+
+	// Find the literal prefix of the pattern and subscribe to it
+	prefix := 0
+	for prefix < len(levels) && levels[prefix] != "*" && levels[prefix] != "#" {
+		prefix++
+	}
+	tree := &treeHandler{
+		conn:    c,
+		pattern: levels,
+		handler: handler,
+	}
+	return c.subscribe(treeRelayTopic(levels[:prefix]), tree, nil, nil, tree.match, limits)
+}
+
+// Publishes an event asynchronously to a hierarchical topic, reaching all the
+// subscribers with a matching pattern. No guarantees are made that all of them
+// receive the message (best effort).
+//
+// The method blocks until the message is forwarded to the local Iris node.
+func (c *Connection) PublishTree(topic string, event []byte) error {
+	// Sanity check on the arguments
+	levels, err := parseTreeTopic(topic, false)
+	if err != nil {
+		return err
+	}
+	if event == nil {
+		return errors.New("nil event")
+	}
+	// Publish the enveloped event to every prefix level of the topic
+	envelope := packTreeEvent(topic, event)
+	for i := 0; i <= len(levels); i++ {
+		if err := c.Publish(treeRelayTopic(levels[:i]), envelope); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Topic handler delivering the events of a relay topic matching a hierarchical
+// pattern.
+type treeHandler struct {
+	conn    *Connection // Connection for logging malformed events
+	pattern []string    // Pattern levels to match the event topics against
+	handler TreeHandler // User handler for the matching events
+}
+
+// Event filter accepting only the events with a topic matching the pattern.
+func (t *treeHandler) match(event []byte) bool {
+	topic, _, err := unpackTreeEvent(event)
+	if err != nil {
+		t.conn.Log.Warn("malformed hierarchical event", "reason", err)
+		return false
+	}
+	return matchTreeTopic(t.pattern, strings.Split(topic, treeSeparator))
+}
+
+// Unpacks an enveloped event and delivers it to the user handler.
+func (t *treeHandler) HandleEvent(event []byte) {
+	topic, data, _ := unpackTreeEvent(event) // Already validated by the filter
+	t.handler.HandleTreeEvent(topic, data)
+}
+
+// Splits a hierarchical topic or pattern into its levels, verifying its format.
+func parseTreeTopic(topic string, pattern bool) ([]string, error) {
+	if len(topic) == 0 {
+		return nil, errors.New("empty topic identifier")
+	}
+	levels := strings.Split(topic, treeSeparator)
+	for i, level := range levels {
+		switch {
+		case len(level) == 0:
+			return nil, fmt.Errorf("empty topic level #%d", i)
+		case strings.ContainsAny(level, "*#") && !pattern:
+			return nil, fmt.Errorf("wildcard in topic level #%d", i)
+		case strings.ContainsAny(level, "*#") && level != "*" && level != "#":
+			return nil, fmt.Errorf("wildcard mixed into topic level #%d", i)
+		case level == "#" && i != len(levels)-1:
+			return nil, fmt.Errorf("multi-level wildcard not last: level #%d", i)
+		}
+	}
+	return levels, nil
+}
+
+// Checks whether the levels of a topic match those of a pattern.
+func matchTreeTopic(pattern, topic []string) bool {
+	for i, level := range pattern {
+		if level == "#" {
+			return true
+		}
+		if i >= len(topic) || (level != "*" && level != topic[i]) {
+			return false
+		}
+	}
+	return len(pattern) == len(topic)
+}
+
+// Assembles the name of the relay topic backing a hierarchical topic prefix.
+func treeRelayTopic(levels []string) string {
+	return treeTopicPrefix + strings.Join(levels, treeSeparator)
+}
+
+// Envelopes an event with the hierarchical topic it was published to.
+func packTreeEvent(topic string, event []byte) []byte {
+	envelope := binary.AppendUvarint(nil, uint64(len(topic)))
+	envelope = append(envelope, topic...)
+	return append(envelope, event...)
+}
+
+// Extracts the hierarchical topic and the original event from an envelope.
+func unpackTreeEvent(envelope []byte) (string, []byte, error) {
+	size, n := binary.Uvarint(envelope)
+	if n <= 0 || uint64(len(envelope)-n) < size {
+		return "", nil, errors.New("invalid topic header")
+	}
+	return string(envelope[n : n+int(size)]), envelope[n+int(size):], nil
+}
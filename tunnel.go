@@ -9,33 +9,63 @@ package iris
 import (
 	"errors"
 	"fmt"
+	"io"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/project-iris/iris/container/queue"
 	"gopkg.in/inconshreveable/log15.v2"
 )
 
+// Message fragment arrived through a tunnel. An empty continuation chunk is
+// never sent as data, so it doubles as the end-of-stream marker.
+type tunnelChunk struct {
+	size int    // Total size of the message if its first chunk, zero otherwise
+	data []byte // Payload of the chunk
+}
+
+// Checks whether the chunk is an end-of-stream marker.
+func (c *tunnelChunk) eof() bool {
+	return c.size == 0 && len(c.data) == 0
+}
+
 // Communication stream between the local application and a remote endpoint. The
 // ordered delivery of messages is guaranteed and the message flow between the
 // peers is throttled.
 type Tunnel struct {
-	id   uint64      // Tunnel identifier for de/multiplexing
-	conn *Connection // Connection to the local relay
+	id      uint64      // Tunnel identifier for de/multiplexing
+	conn    *Connection // Connection to the local relay
+	cluster string      // Remote cluster of the tunnel (empty if inbound)
+	inbound bool        // Whether the tunnel was initiated remotely
 
 	// Chunking fields
-	chunkLimit int    // Maximum length of a data payload
-	chunkBuf   []byte // Current message being assembled
+	chunkLimit int // Maximum length of a data payload
 
 	// Quality of service fields
-	itoaBuf  *queue.Queue  // Iris to application message buffer
-	itoaSign chan struct{} // Message arrival signaler
-	itoaLock sync.Mutex    // Protects the buffer and signaler
+	itoaBuf   *queue.Queue  // Iris to application chunk buffer
+	itoaPart  []byte        // Current message being assembled
+	itoaSign  chan struct{} // Chunk arrival signaler
+	itoaMsgs  int           // Number of messages started arriving
+	itoaBytes uint64        // Number of payload bytes arrived
+	itoaUsed  int           // Payload bytes queued, not yet consumed
+	itoaFree  int           // Consumed input not yet granted back as allowance
+	itoaEOF   bool          // Whether the end-of-stream marker was consumed
+	itoaFin   chan struct{} // Channel closed when the end-of-stream marker arrives
+	itoaLock  sync.Mutex    // Protects the buffers and signaler
+
+	itoaLimit   int // Input buffer allowance granted to the remote side
+	itoaRefresh int // Consumed input accumulated before refreshing the allowance
 
 	atoiSpace int           // Application to Iris space allowance
 	atoiSign  chan struct{} // Allowance grant signaler
+	atoiDone  bool          // Whether the local side finished sending
 	atoiLock  sync.Mutex    // Protects the allowance and signaler
 
+	atoiMsgs  uint64 // Number of messages started sending (atomic)
+	atoiBytes uint64 // Number of payload bytes sent (atomic)
+	atoiWait  int64  // Nanoseconds spent blocked on the send allowance (atomic)
+
 	// Bookkeeping fields
 	init chan bool     // Initialization channel for outbound tunnels
 	term chan struct{} // Channel to signal termination to blocked go-routines
@@ -44,7 +74,9 @@ type Tunnel struct {
 	Log log15.Logger // Logger with connection and tunnel ids injected
 }
 
-func (c *Connection) newTunnel() (*Tunnel, error) {
+// Creates a new tunnel endpoint and stores it among the live ones. The remote
+// cluster and direction are fixed before the tunnel becomes reachable.
+func (c *Connection) newTunnel(cluster string, inbound bool) (*Tunnel, error) {
 	c.tunLock.Lock()
 	defer c.tunLock.Unlock()
 
@@ -58,11 +90,14 @@ func (c *Connection) newTunnel() (*Tunnel, error) {
 
 	// Assemble and store the live tunnel
 	tun := &Tunnel{
-		id:   tunId,
-		conn: c,
+		id:      tunId,
+		conn:    c,
+		cluster: cluster,
+		inbound: inbound,
 
 		itoaBuf:  queue.New(),
 		itoaSign: make(chan struct{}, 1),
+		itoaFin:  make(chan struct{}),
 		atoiSign: make(chan struct{}, 1),
 
 		init: make(chan bool),
@@ -75,8 +110,40 @@ func (c *Connection) newTunnel() (*Tunnel, error) {
 	return tun, nil
 }
 
+// Merges the user requested tunnel options with the defaults.
+func finalizeTunnelOptions(user *TunnelOptions) *TunnelOptions {
+	// If the user didn't specify anything, load the full default set
+	if user == nil {
+		return &defaultTunnelOptions
+	}
+	// Check each field and merge only non-specified ones
+	opts := new(TunnelOptions)
+	*opts = *user
+
+	if user.Buffer == 0 {
+		opts.Buffer = defaultTunnelOptions.Buffer
+	}
+	if user.Refresh == 0 {
+		opts.Refresh = defaultTunnelOptions.Refresh
+	}
+	return opts
+}
+
+// Sets the input buffer allowance and refresh threshold of the tunnel, making
+// sure the remote side can always send at least a full chunk and is never
+// starved of allowance by the batching.
+func (t *Tunnel) setBuffer(buffer, refresh int) {
+	if buffer < t.chunkLimit {
+		buffer = t.chunkLimit
+	}
+	if refresh > buffer-t.chunkLimit {
+		refresh = buffer - t.chunkLimit
+	}
+	t.itoaLimit, t.itoaRefresh = buffer, refresh
+}
+
 // Initiates a new tunnel to a remote cluster.
-func (c *Connection) initTunnel(cluster string, timeout time.Duration) (*Tunnel, error) {
+func (c *Connection) initTunnel(cluster string, timeout time.Duration, opts *TunnelOptions) (*Tunnel, error) {
 	// Sanity check on the arguments
 	if len(cluster) == 0 {
 		return nil, errors.New("empty cluster identifier")
@@ -86,7 +153,7 @@ func (c *Connection) initTunnel(cluster string, timeout time.Duration) (*Tunnel,
 		return nil, fmt.Errorf("invalid timeout %v < 1ms", timeout)
 	}
 	// Create a potential tunnel
-	tun, err := c.newTunnel()
+	tun, err := c.newTunnel(cluster, false)
 	if err != nil {
 		return nil, err
 	}
@@ -100,7 +167,8 @@ func (c *Connection) initTunnel(cluster string, timeout time.Duration) (*Tunnel,
 		case init := <-tun.init:
 			if init {
 				// Send the data allowance
-				if err = c.sendTunnelAllowance(tun.id, defaultTunnelBuffer); err == nil {
+				tun.setBuffer(opts.Buffer, opts.Refresh)
+				if err = c.sendTunnelAllowance(tun.id, tun.itoaLimit); err == nil {
 					tun.Log.Info("tunnel construction completed", "chunk_limit", tun.chunkLimit)
 					return tun, nil
 				}
@@ -120,32 +188,40 @@ func (c *Connection) initTunnel(cluster string, timeout time.Duration) (*Tunnel,
 	return nil, err
 }
 
-// Accepts an incoming tunneling request and confirms its local id.
-func (c *Connection) acceptTunnel(initId uint64, chunkLimit int) (*Tunnel, error) {
+// Accepts an incoming tunneling request and confirms its local id, reporting
+// whether the tunnel exceeds the inbound limit.
+func (c *Connection) acceptTunnel(initId uint64, chunkLimit int) (*Tunnel, bool, error) {
 	// Create the local tunnel endpoint
-	tun, err := c.newTunnel()
+	tun, err := c.newTunnel("", true)
 	if err != nil {
-		return nil, err
+		return nil, false, err
 	}
 	tun.chunkLimit = chunkLimit
 	tun.Log.Info("accepting inbound tunnel", "chunk_limit", chunkLimit)
 
+	// Reserve an inbound slot, checking the limit in the same step
+	overflow := int(atomic.AddInt32(c.tunInbound, 1)) > c.limits.TunnelInbound
+
 	// Confirm the tunnel creation to the relay node
 	err = c.sendTunnelConfirm(initId, tun.id)
 	if err == nil {
 		// Send the data allowance
-		err = c.sendTunnelAllowance(tun.id, defaultTunnelBuffer)
+		tun.setBuffer(c.limits.TunnelBuffer, c.limits.TunnelRefresh)
+		err = c.sendTunnelAllowance(tun.id, tun.itoaLimit)
 		if err == nil {
 			tun.Log.Info("tunnel acceptance completed")
-			return tun, nil
+			return tun, overflow, nil
 		}
 	}
 	c.tunLock.Lock()
-	delete(c.tunLive, tun.id)
+	if _, ok := c.tunLive[tun.id]; ok {
+		delete(c.tunLive, tun.id)
+		atomic.AddInt32(c.tunInbound, -1)
+	}
 	c.tunLock.Unlock()
 
 	tun.Log.Warn("tunnel acceptance failed", "reason", err)
-	return nil, err
+	return nil, false, err
 }
 
 // Sends a message over the tunnel to the remote pair, blocking until the local
@@ -183,16 +259,38 @@ func (t *Tunnel) Send(message []byte, timeout time.Duration) error {
 
 // Sends a single message chunk to the remote endpoint.
 func (t *Tunnel) sendChunk(chunk []byte, sizeOrCont int, deadline <-chan time.Time) error {
+	t.atoiLock.Lock()
+	done := t.atoiDone
+	t.atoiLock.Unlock()
+	if done {
+		return ErrClosed
+	}
+	var blocked time.Time
 	for {
 		// Short circuit if there's enough space allowance already
 		if t.drainAllowance(len(chunk)) {
-			return t.conn.sendTunnelTransfer(t.id, sizeOrCont, chunk)
+			if !blocked.IsZero() {
+				atomic.AddInt64(&t.atoiWait, int64(time.Since(blocked)))
+			}
+			if err := t.conn.sendTunnelTransfer(t.id, sizeOrCont, chunk); err != nil {
+				return err
+			}
+			if sizeOrCont != 0 {
+				atomic.AddUint64(&t.atoiMsgs, 1)
+			}
+			atomic.AddUint64(&t.atoiBytes, uint64(len(chunk)))
+			return nil
+		}
+		// Query for a send allowance, tracking the time spent blocked
+		if blocked.IsZero() {
+			blocked = time.Now()
 		}
-		// Query for a send allowance
 		select {
 		case <-t.term:
+			atomic.AddInt64(&t.atoiWait, int64(time.Since(blocked)))
 			return ErrClosed
 		case <-deadline:
+			atomic.AddInt64(&t.atoiWait, int64(time.Since(blocked)))
 			return ErrTimeout
 		case <-t.atoiSign:
 			// Potentially enough space allowance, retry
@@ -222,11 +320,16 @@ func (t *Tunnel) drainAllowance(need int) bool {
 // Retrieves a message from the tunnel, blocking until one is available or the
 // operation times out.
 //
+// Messages arrived before the remote side finished sending or closed the tunnel
+// are delivered first, after which io.EOF or ErrClosed is returned respectively.
+//
 // Infinite blocking is supported with by setting the timeout to zero (0).
 func (t *Tunnel) Recv(timeout time.Duration) ([]byte, error) {
 	// Short circuit if there's a message already buffered
-	if msg := t.fetchMessage(); msg != nil {
+	if msg, eof := t.fetchMessage(); msg != nil {
 		return msg, nil
+	} else if eof {
+		return nil, io.EOF
 	}
 	// Create the timeout signaler
 	var after <-chan time.Time
@@ -234,38 +337,121 @@ func (t *Tunnel) Recv(timeout time.Duration) ([]byte, error) {
 		after = time.After(timeout)
 	}
 	// Wait for a message to arrive
-	select {
-	case <-t.term:
-		return nil, ErrClosed
-	case <-after:
-		return nil, ErrTimeout
-	case <-t.itoaSign:
-		if msg := t.fetchMessage(); msg != nil {
-			return msg, nil
+	for {
+		select {
+		case <-t.term:
+			// Closed, but deliver anything that arrived before
+			if msg, eof := t.fetchMessage(); msg != nil {
+				return msg, nil
+			} else if eof {
+				return nil, io.EOF
+			}
+			return nil, ErrClosed
+		case <-after:
+			return nil, ErrTimeout
+		case <-t.itoaSign:
+			// Potentially the last chunk of a message arrived, retry
+			if msg, eof := t.fetchMessage(); msg != nil {
+				return msg, nil
+			} else if eof {
+				return nil, io.EOF
+			}
 		}
-		panic("signal raised but message unavailable")
 	}
 }
 
-// Fetches the next buffered message, or nil if none is available. If a message
-// was available, grants the remote side the space allowance just consumed.
-func (t *Tunnel) fetchMessage() []byte {
+// Fetches the next buffered message, or nil if none is complete yet. Each
+// consumed chunk grants the remote side the space allowance it used up. The
+// eof flag reports whether the remote side finished sending.
+func (t *Tunnel) fetchMessage() (message []byte, eof bool) {
 	t.itoaLock.Lock()
 	defer t.itoaLock.Unlock()
 
-	if !t.itoaBuf.Empty() {
-		message := t.itoaBuf.Pop().([]byte)
-		go t.conn.sendTunnelAllowance(t.id, len(message))
+	for !t.itoaEOF && !t.itoaBuf.Empty() {
+		chunk := t.itoaBuf.Pop().(*tunnelChunk)
+		t.releaseAllowance(len(chunk.data))
+
+		// If the remote side finished, dump anything assembled before
+		if chunk.eof() {
+			if t.itoaPart != nil {
+				t.Log.Warn("incomplete message discarded", "size", cap(t.itoaPart), "arrived", len(t.itoaPart))
+				t.itoaPart = nil
+			}
+			t.itoaEOF = true
+			break
+		}
 
-		t.Log.Debug("fetching queued message", "data", logLazyBlob(message))
-		return message
+		// If a new message is starting, dump anything assembled before
+		if chunk.size != 0 {
+			if t.itoaPart != nil {
+				t.Log.Warn("incomplete message discarded", "size", cap(t.itoaPart), "arrived", len(t.itoaPart))
+			}
+			t.itoaPart = make([]byte, 0, chunk.size)
+		} else if t.itoaPart == nil {
+			continue // Remainder of an already discarded message
+		}
+		// Append the chunk and check completion
+		t.itoaPart = append(t.itoaPart, chunk.data...)
+		if len(t.itoaPart) == cap(t.itoaPart) {
+			message := t.itoaPart
+			t.itoaPart = nil
+
+			t.Log.Debug("fetching queued message", "data", logLazyBlob(message))
+			return message, false
+		}
 	}
-	// No message, reset arrival flag
+	// No complete message, reset arrival flag
 	select {
 	case <-t.itoaSign:
 	default:
 	}
-	return nil
+	return nil, t.itoaEOF
+}
+
+// Finishes the local sending direction, delivering an end-of-stream marker to
+// the remote side after all previously sent messages. The remote side will get
+// io.EOF after draining them, while receiving here remains possible.
+//
+// The method must not be called concurrently with sends.
+func (t *Tunnel) CloseWrite() error {
+	t.atoiLock.Lock()
+	if t.atoiDone {
+		t.atoiLock.Unlock()
+		return nil
+	}
+	t.atoiDone = true
+	t.atoiLock.Unlock()
+
+	t.Log.Info("finishing tunnel output")
+	return t.conn.sendTunnelTransfer(t.id, 0, nil)
+}
+
+// Closes the tunnel gracefully: finishes the local sending direction, waits for
+// the remote side to do the same (or tear the tunnel down) and closes it. Any
+// messages not yet received are discarded.
+//
+// Infinite waiting is supported with by setting the timeout to zero (0). If
+// the timeout is reached, the tunnel is closed nonetheless and ErrTimeout is
+// returned.
+func (t *Tunnel) CloseGraceful(timeout time.Duration) error {
+	if err := t.CloseWrite(); err != nil {
+		return err
+	}
+	// Create the timeout signaler
+	var after <-chan time.Time
+	if timeout != 0 {
+		after = time.After(timeout)
+	}
+	// Wait for the remote end-of-stream and close
+	select {
+	case <-t.itoaFin:
+	case <-t.term:
+	case <-after:
+		t.Log.Warn("remote end-of-stream timed out", "timeout", timeout)
+		t.Close()
+		return ErrTimeout
+	}
+	return t.Close()
 }
 
 // Closes the tunnel between the pair. Any blocked read and write operation will
@@ -308,34 +494,45 @@ func (t *Tunnel) handleAllowance(space int) {
 	}
 }
 
-// Adds the chunk to the currently building message and delivers it upon
-// completion. If a new message starts, the old is discarded.
-func (t *Tunnel) handleTransfer(size int, chunk []byte) {
-	// If a new message is arriving, dump anything stored before
-	if size != 0 {
-		if t.chunkBuf != nil {
-			t.Log.Warn("incomplete message discarded", "size", cap(t.chunkBuf), "arrived", len(t.chunkBuf))
-
-			// A large transfer timed out, new started, grant the partials allowance
-			go t.conn.sendTunnelAllowance(t.id, len(t.chunkBuf))
-		}
-		t.chunkBuf = make([]byte, 0, size)
+// Marks consumed input space, granting it back to the remote side as allowance
+// in batches of the refresh threshold. The itoaLock needs to be held.
+func (t *Tunnel) releaseAllowance(space int) {
+	t.itoaUsed -= space
+	t.itoaFree += space
+	if t.itoaFree > 0 && t.itoaFree >= t.itoaRefresh {
+		go t.conn.sendTunnelAllowance(t.id, t.itoaFree)
+		t.itoaFree = 0
 	}
-	// Append the new chunk and check completion
-	t.chunkBuf = append(t.chunkBuf, chunk...)
-	if len(t.chunkBuf) == cap(t.chunkBuf) {
-		t.itoaLock.Lock()
-		defer t.itoaLock.Unlock()
+}
 
-		t.Log.Debug("queuing arrived message", "data", logLazyBlob(t.chunkBuf))
-		t.itoaBuf.Push(t.chunkBuf)
-		t.chunkBuf = nil
+// Queues an arrived message chunk for the application to consume, either as
+// part of an assembled message or a stream.
+func (t *Tunnel) handleTransfer(size int, chunk []byte) {
+	t.itoaLock.Lock()
+	defer t.itoaLock.Unlock()
 
+	if size != 0 {
+		t.itoaMsgs++
+	}
+	t.Log.Debug("queuing arrived chunk", "size", size, "data", logLazyBlob(chunk))
+	t.itoaBuf.Push(&tunnelChunk{size: size, data: chunk})
+	t.itoaBytes += uint64(len(chunk))
+	t.itoaUsed += len(chunk)
+
+	// Notify any graceful closers of the end-of-stream
+	if size == 0 && len(chunk) == 0 {
+		t.Log.Info("tunnel input finished remotely")
 		select {
-		case t.itoaSign <- struct{}{}:
+		case <-t.itoaFin:
 		default:
+			close(t.itoaFin)
 		}
 	}
+
+	select {
+	case t.itoaSign <- struct{}{}:
+	default:
+	}
 }
 
 // Handles the graceful remote closure of the tunnel.
@@ -8,7 +8,10 @@ package iris
 
 import (
 	"bytes"
+	"context"
 	"fmt"
+	"io"
+	"net"
 	"sync"
 	"testing"
 	"time"
@@ -256,6 +259,437 @@ func TestTunnelOverload(t *testing.T) {
 	}
 }
 
+// Tests that a tunnel can be used as a stream through its net.Conn view.
+func TestTunnelConn(t *testing.T) {
+	// Create the service handler
+	handler := new(tunnelTestHandler)
+
+	// Register a new service to the relay
+	serv, err := Register(config.relay, config.cluster, handler, nil)
+	if err != nil {
+		t.Fatalf("registration failed: %v.", err)
+	}
+	defer serv.Unregister()
+
+	// Construct the tunnel and its stream view
+	tunnel, err := handler.conn.Tunnel(config.cluster, time.Second)
+	if err != nil {
+		t.Fatalf("tunnel construction failed: %v.", err)
+	}
+	conn := tunnel.Conn()
+	defer conn.Close()
+
+	// Stream a blob larger than the chunk limit and read it back piecewise
+	blob := make([]byte, 4*1024*1024+13)
+	for i := 0; i < len(blob); i++ {
+		blob[i] = byte(i)
+	}
+	errc := make(chan error, 1)
+	go func() {
+		_, err := io.Copy(conn, bytes.NewReader(blob))
+		errc <- err
+	}()
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	back := make([]byte, len(blob))
+	if _, err := io.ReadFull(conn, back); err != nil {
+		t.Fatalf("failed to retrieve stream: %v.", err)
+	}
+	if err := <-errc; err != nil {
+		t.Fatalf("failed to send stream: %v.", err)
+	}
+	if bytes.Compare(back, blob) != 0 {
+		t.Fatalf("stream data mismatch")
+	}
+	// Verify that an expired deadline fails reads with a timeout
+	conn.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	if _, err := conn.Read(back); err == nil {
+		t.Fatalf("read succeeded without data")
+	} else if nerr, ok := err.(net.Error); !ok || !nerr.Timeout() {
+		t.Fatalf("mismatching read error: have %v, want timeout.", err)
+	}
+}
+
+// Tests that inbound tunnels can be accepted through the listener API, and that
+// tunnels beyond the inbound limit get rejected.
+func TestTunnelListener(t *testing.T) {
+	// Register a new listening service to the relay
+	limits := &ServiceLimits{TunnelListen: true, TunnelInbound: 1}
+	serv, err := Register(config.relay, config.cluster, new(ServiceFuncs), limits)
+	if err != nil {
+		t.Fatalf("registration failed: %v.", err)
+	}
+	defer serv.Unregister()
+
+	// Connect to the local relay
+	conn, err := Connect(config.relay)
+	if err != nil {
+		t.Fatalf("connection failed: %v.", err)
+	}
+	defer conn.Close()
+
+	// Construct a tunnel and accept it on the service side
+	tunnel, err := conn.Tunnel(config.cluster, time.Second)
+	if err != nil {
+		t.Fatalf("tunnel construction failed: %v.", err)
+	}
+	defer tunnel.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	inbound, err := serv.AcceptTunnel(ctx)
+	if err != nil {
+		t.Fatalf("tunnel acceptance failed: %v.", err)
+	}
+	defer inbound.Close()
+
+	// Verify that the accepted tunnel is operational
+	data := []byte{0x00, 0x01, 0x02, 0x03}
+	if err := tunnel.Send(data, time.Second); err != nil {
+		t.Fatalf("failed to send data: %v.", err)
+	}
+	if back, err := inbound.Recv(time.Second); err != nil {
+		t.Fatalf("failed to retrieve data: %v.", err)
+	} else if bytes.Compare(back, data) != 0 {
+		t.Fatalf("data mismatch: have %v, want %v.", back, data)
+	}
+	// Construct a tunnel beyond the inbound limit and verify its rejection
+	rejected, err := conn.Tunnel(config.cluster, time.Second)
+	if err != nil {
+		t.Fatalf("tunnel construction failed: %v.", err)
+	}
+	if _, err := rejected.Recv(time.Second); err != ErrClosed {
+		t.Fatalf("mismatching receive result: have %v, want %v.", err, ErrClosed)
+	}
+	rejected.Close()
+
+	// Verify that a pending accept can be cancelled
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	if _, err := serv.AcceptTunnel(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("mismatching accept result: have %v, want %v.", err, context.DeadlineExceeded)
+	}
+	// Queue a tunnel, close the listener and verify that the queued one is closed
+	listener, err := serv.Listen()
+	if err != nil {
+		t.Fatalf("listening failed: %v.", err)
+	}
+	inbound.Close()
+	tunnel.Close()
+
+	queued, err := conn.Tunnel(config.cluster, time.Second)
+	if err != nil {
+		t.Fatalf("tunnel construction failed: %v.", err)
+	}
+	defer queued.Close()
+
+	time.Sleep(100 * time.Millisecond)
+	listener.Close()
+
+	if _, err := queued.Recv(time.Second); err != ErrClosed {
+		t.Fatalf("mismatching receive result: have %v, want %v.", err, ErrClosed)
+	}
+}
+
+// Tests that messages larger than the tunnel buffer can be streamed through
+// without being fully assembled on either side.
+func TestTunnelStream(t *testing.T) {
+	// Test specific configurations
+	conf := struct {
+		size int64
+	}{2*int64(defaultTunnelOptions.Buffer) + 13}
+
+	// Register a service streaming back every inbound message
+	handler := &ServiceFuncs{
+		OnTunnel: func(tun *Tunnel) {
+			defer tun.Close()
+			for {
+				stream, size, err := tun.RecvStream()
+				if err != nil {
+					return
+				}
+				if err := tun.SendStream(stream, size); err != nil {
+					return
+				}
+			}
+		},
+	}
+	serv, err := Register(config.relay, config.cluster, handler, nil)
+	if err != nil {
+		t.Fatalf("registration failed: %v.", err)
+	}
+	defer serv.Unregister()
+
+	// Connect to the local relay and construct the tunnel
+	conn, err := Connect(config.relay)
+	if err != nil {
+		t.Fatalf("connection failed: %v.", err)
+	}
+	defer conn.Close()
+
+	tunnel, err := conn.Tunnel(config.cluster, time.Second)
+	if err != nil {
+		t.Fatalf("tunnel construction failed: %v.", err)
+	}
+	defer tunnel.Close()
+
+	// Stream a large pseudo random blob through and verify the echo
+	errc := make(chan error, 1)
+	go func() {
+		errc <- tunnel.SendStream(io.LimitReader(newTunnelTestSource(), conf.size), conf.size)
+	}()
+	stream, size, err := tunnel.RecvStream()
+	if err != nil {
+		t.Fatalf("failed to receive stream: %v.", err)
+	}
+	if size != conf.size {
+		t.Fatalf("stream size mismatch: have %d, want %d.", size, conf.size)
+	}
+	want := io.LimitReader(newTunnelTestSource(), conf.size)
+	if ok, err := tunnelTestStreamsEqual(stream, want); err != nil {
+		t.Fatalf("failed to read stream: %v.", err)
+	} else if !ok {
+		t.Fatalf("stream data mismatch")
+	}
+	if err := <-errc; err != nil {
+		t.Fatalf("failed to send stream: %v.", err)
+	}
+}
+
+// Tests that tunnels with small custom buffers and batched allowance refreshes
+// keep transferring data without stalling.
+func TestTunnelOptions(t *testing.T) {
+	// Test specific configurations
+	conf := struct {
+		buffer  int
+		refresh int
+		size    int64
+	}{256 * 1024, 64 * 1024, 16 * 1024 * 1024}
+
+	// Register a service streaming back every inbound message
+	handler := &ServiceFuncs{
+		OnTunnel: func(tun *Tunnel) {
+			defer tun.Close()
+			for {
+				stream, size, err := tun.RecvStream()
+				if err != nil {
+					return
+				}
+				if err := tun.SendStream(stream, size); err != nil {
+					return
+				}
+			}
+		},
+	}
+	limits := &ServiceLimits{TunnelBuffer: conf.buffer, TunnelRefresh: conf.refresh}
+	serv, err := Register(config.relay, config.cluster, handler, limits)
+	if err != nil {
+		t.Fatalf("registration failed: %v.", err)
+	}
+	defer serv.Unregister()
+
+	// Connect to the local relay and construct a tunnel with small buffers
+	conn, err := Connect(config.relay)
+	if err != nil {
+		t.Fatalf("connection failed: %v.", err)
+	}
+	defer conn.Close()
+
+	opts := &TunnelOptions{Buffer: conf.buffer, Refresh: conf.refresh}
+	tunnel, err := conn.TunnelWithOptions(config.cluster, time.Second, opts)
+	if err != nil {
+		t.Fatalf("tunnel construction failed: %v.", err)
+	}
+	defer tunnel.Close()
+
+	// Stream data many times the buffer size through and verify the echo
+	errc := make(chan error, 1)
+	go func() {
+		errc <- tunnel.SendStream(io.LimitReader(newTunnelTestSource(), conf.size), conf.size)
+	}()
+	stream, _, err := tunnel.RecvStream()
+	if err != nil {
+		t.Fatalf("failed to receive stream: %v.", err)
+	}
+	want := io.LimitReader(newTunnelTestSource(), conf.size)
+	if ok, err := tunnelTestStreamsEqual(stream, want); err != nil {
+		t.Fatalf("failed to read stream: %v.", err)
+	} else if !ok {
+		t.Fatalf("stream data mismatch")
+	}
+	if err := <-errc; err != nil {
+		t.Fatalf("failed to send stream: %v.", err)
+	}
+}
+
+// Tests that half-closing a tunnel delivers all pending messages before the
+// remote side gets an end-of-stream, and that replies can still flow back.
+func TestTunnelCloseWrite(t *testing.T) {
+	// Test specific configurations
+	conf := struct {
+		messages int
+	}{1000}
+
+	// Register a service counting the inbound messages until end-of-stream
+	handler := &ServiceFuncs{
+		OnTunnel: func(tun *Tunnel) {
+			count := 0
+			for {
+				if _, err := tun.Recv(0); err == io.EOF {
+					break
+				} else if err != nil {
+					tun.Close()
+					return
+				}
+				count++
+			}
+			tun.Send([]byte(fmt.Sprintf("%d", count)), time.Second)
+			tun.CloseGraceful(time.Second)
+		},
+	}
+	serv, err := Register(config.relay, config.cluster, handler, nil)
+	if err != nil {
+		t.Fatalf("registration failed: %v.", err)
+	}
+	defer serv.Unregister()
+
+	// Connect to the local relay and construct the tunnel
+	conn, err := Connect(config.relay)
+	if err != nil {
+		t.Fatalf("connection failed: %v.", err)
+	}
+	defer conn.Close()
+
+	tunnel, err := conn.Tunnel(config.cluster, time.Second)
+	if err != nil {
+		t.Fatalf("tunnel construction failed: %v.", err)
+	}
+	// Send a batch of messages and finish the output
+	for i := 0; i < conf.messages; i++ {
+		if err := tunnel.Send([]byte{byte(i)}, time.Second); err != nil {
+			t.Fatalf("failed to send message %d: %v.", i, err)
+		}
+	}
+	if err := tunnel.CloseWrite(); err != nil {
+		t.Fatalf("failed to finish output: %v.", err)
+	}
+	if err := tunnel.Send([]byte{0x00}, time.Second); err != ErrClosed {
+		t.Fatalf("mismatching send result after finish: have %v, want %v.", err, ErrClosed)
+	}
+	// Verify the remote count and the end-of-stream
+	reply, err := tunnel.Recv(time.Second)
+	if err != nil {
+		t.Fatalf("failed to receive reply: %v.", err)
+	}
+	if string(reply) != fmt.Sprintf("%d", conf.messages) {
+		t.Fatalf("message count mismatch: have %s, want %d.", reply, conf.messages)
+	}
+	if _, err := tunnel.Recv(time.Second); err != io.EOF {
+		t.Fatalf("mismatching receive result: have %v, want %v.", err, io.EOF)
+	}
+	if err := tunnel.CloseGraceful(time.Second); err != nil {
+		t.Fatalf("failed to close tunnel: %v.", err)
+	}
+}
+
+// Tests that the tunnel statistics track the traffic and are listed by the
+// connection.
+func TestTunnelStats(t *testing.T) {
+	// Test specific configurations
+	conf := struct {
+		messages int
+		size     int
+	}{100, 1024}
+
+	// Create the service handler
+	handler := new(tunnelTestHandler)
+
+	// Register a new service to the relay
+	serv, err := Register(config.relay, config.cluster, handler, nil)
+	if err != nil {
+		t.Fatalf("registration failed: %v.", err)
+	}
+	defer serv.Unregister()
+
+	// Construct the tunnel and exchange a batch of messages
+	tunnel, err := handler.conn.Tunnel(config.cluster, time.Second)
+	if err != nil {
+		t.Fatalf("tunnel construction failed: %v.", err)
+	}
+	defer tunnel.Close()
+
+	for i := 0; i < conf.messages; i++ {
+		if err := tunnel.Send(make([]byte, conf.size), time.Second); err != nil {
+			t.Fatalf("failed to send message %d: %v.", i, err)
+		}
+		if _, err := tunnel.Recv(time.Second); err != nil {
+			t.Fatalf("failed to receive message %d: %v.", i, err)
+		}
+	}
+	// Verify the traffic counters
+	stats := tunnel.Stats()
+	if stats.SentMessages != uint64(conf.messages) || stats.SentBytes != uint64(conf.messages*conf.size) {
+		t.Errorf("sent traffic mismatch: have %d msgs/%d bytes, want %d msgs/%d bytes.", stats.SentMessages, stats.SentBytes, conf.messages, conf.messages*conf.size)
+	}
+	if stats.RecvMessages != uint64(conf.messages) || stats.RecvBytes != uint64(conf.messages*conf.size) {
+		t.Errorf("received traffic mismatch: have %d msgs/%d bytes, want %d msgs/%d bytes.", stats.RecvMessages, stats.RecvBytes, conf.messages, conf.messages*conf.size)
+	}
+	if stats.QueuedChunks != 0 || stats.QueuedBytes != 0 || stats.PartialBytes != 0 {
+		t.Errorf("leftover input: have %d chunks/%d bytes/%d partial, want none.", stats.QueuedChunks, stats.QueuedBytes, stats.PartialBytes)
+	}
+	if stats.Cluster != config.cluster || stats.Inbound {
+		t.Errorf("endpoint mismatch: have %s/%v, want %s/%v.", stats.Cluster, stats.Inbound, config.cluster, false)
+	}
+	// Verify that both ends are listed by the service connection
+	live := handler.conn.Tunnels()
+	if len(live) != 2 {
+		t.Fatalf("live tunnel count mismatch: have %d, want %d.", len(live), 2)
+	}
+	if live[0].ID != tunnel.Stats().ID || live[0].Inbound || !live[1].Inbound {
+		t.Errorf("live tunnel listing mismatch: have %+v and %+v.", live[0], live[1])
+	}
+}
+
+// Deterministic byte source for the stream tests.
+type tunnelTestSource struct {
+	next byte
+}
+
+func newTunnelTestSource() *tunnelTestSource {
+	return new(tunnelTestSource)
+}
+
+func (s *tunnelTestSource) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = s.next
+		s.next = s.next*31 + 7
+	}
+	return len(p), nil
+}
+
+// Compares two streams chunk by chunk, without buffering either fully.
+func tunnelTestStreamsEqual(have, want io.Reader) (bool, error) {
+	hbuf, wbuf := make([]byte, 64*1024), make([]byte, 64*1024)
+	for {
+		wn, werr := io.ReadFull(want, wbuf)
+		hn, herr := io.ReadFull(have, hbuf[:wn])
+		if herr != nil && wn > 0 {
+			return false, herr
+		}
+		if !bytes.Equal(hbuf[:hn], wbuf[:wn]) {
+			return false, nil
+		}
+		if werr != nil {
+			// Source exhausted, the received stream must be too
+			if n, err := have.Read(hbuf); n != 0 || err != io.EOF {
+				return false, nil
+			}
+			return true, nil
+		}
+	}
+}
+
 // Benchmarks the latency of a single tunnel send (actually two way, so halves
 // it).
 func BenchmarkTunnelLatency(b *testing.B) {
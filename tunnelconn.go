@@ -0,0 +1,212 @@
+// Copyright (c) 2014 Project Iris. All rights reserved.
+//
+// The current language binding is an official support library of the Iris
+// cloud messaging framework, and as such, the same licensing terms apply.
+// For details please see http://iris.karalabe.com/downloads#License
+
+// Contains the stream adapter exposing a tunnel as a net.Conn.
+
+package iris
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// Address of a tunnel endpoint.
+type TunnelAddr struct {
+	Cluster string // Cluster of the endpoint (empty if a client or unknown)
+	Tunnel  uint64 // Local id of the tunnel
+}
+
+// Implements net.Addr.Network, returning the name of the network.
+func (a *TunnelAddr) Network() string {
+	return "iris"
+}
+
+// Implements net.Addr.String, returning the textual form of the address.
+func (a *TunnelAddr) String() string {
+	return fmt.Sprintf("%s#%d", a.Cluster, a.Tunnel)
+}
+
+// Stream adapter over a message based tunnel, implementing net.Conn.
+type tunnelConn struct {
+	tun *Tunnel // Message tunnel carrying the stream
+
+	readBuf  []byte     // Unread remainder of the last received message
+	readTime *deadline  // Deadline of the read operations
+	readLock sync.Mutex // Mutex to serialize the readers
+
+	writeTime *deadline  // Deadline of the write operations
+	writeLock sync.Mutex // Mutex to serialize the writers
+}
+
+// Returns a stream view of the tunnel implementing net.Conn, allowing its use
+// with io.Copy, bufio, encoding streams or any other stream based API.
+//
+// Writes are split into messages of at most the tunnel's chunk limit, each one
+// subject to the tunnel's flow control. Reads return the received messages as
+// a byte stream, reporting io.EOF after a graceful remote close. Only a single
+// stream view should be used per tunnel, mixing it with Send and Recv calls.
+func (t *Tunnel) Conn() net.Conn {
+	return &tunnelConn{
+		tun:       t,
+		readTime:  newDeadline(),
+		writeTime: newDeadline(),
+	}
+}
+
+// Implements net.Conn.Read, reading data from the tunnel's message stream.
+func (c *tunnelConn) Read(b []byte) (int, error) {
+	c.readLock.Lock()
+	defer c.readLock.Unlock()
+
+	// Wait for a message if nothing is buffered
+	for len(c.readBuf) == 0 {
+		if msg, eof := c.tun.fetchMessage(); msg != nil {
+			c.readBuf = msg
+			break
+		} else if eof {
+			return 0, io.EOF
+		}
+		select {
+		case <-c.tun.term:
+			// Closed, but drain any messages queued before
+			if msg, eof := c.tun.fetchMessage(); msg != nil {
+				c.readBuf = msg
+				continue
+			} else if eof {
+				return 0, io.EOF
+			}
+			if c.tun.stat != nil {
+				return 0, c.tun.stat
+			}
+			return 0, io.EOF
+		case <-c.readTime.wait():
+			return 0, os.ErrDeadlineExceeded
+		case <-c.tun.itoaSign:
+			// Potentially a message arrived, retry
+		}
+	}
+	// Copy as much of the buffer as fits
+	n := copy(b, c.readBuf)
+	c.readBuf = c.readBuf[n:]
+	return n, nil
+}
+
+// Implements net.Conn.Write, sending the data as messages of bounded size.
+func (c *tunnelConn) Write(b []byte) (int, error) {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+
+	sent := 0
+	for sent < len(b) {
+		end := sent + c.tun.chunkLimit
+		if end > len(b) {
+			end = len(b)
+		}
+		if err := c.tun.sendChunk(b[sent:end], end-sent, c.writeTime.wait()); err != nil {
+			if err == ErrTimeout {
+				err = os.ErrDeadlineExceeded
+			}
+			return sent, err
+		}
+		sent = end
+	}
+	return sent, nil
+}
+
+// Implements net.Conn.Close, closing the underlying tunnel.
+func (c *tunnelConn) Close() error {
+	return c.tun.Close()
+}
+
+// Finishes the sending direction of the underlying tunnel, after which the
+// remote side reads io.EOF.
+func (c *tunnelConn) CloseWrite() error {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+
+	return c.tun.CloseWrite()
+}
+
+// Implements net.Conn.LocalAddr, returning the local tunnel endpoint.
+func (c *tunnelConn) LocalAddr() net.Addr {
+	return &TunnelAddr{Cluster: c.tun.conn.cluster, Tunnel: c.tun.id}
+}
+
+// Implements net.Conn.RemoteAddr, returning the remote tunnel endpoint.
+func (c *tunnelConn) RemoteAddr() net.Addr {
+	return &TunnelAddr{Cluster: c.tun.cluster, Tunnel: c.tun.id}
+}
+
+// Implements net.Conn.SetDeadline, setting both read and write deadlines.
+func (c *tunnelConn) SetDeadline(t time.Time) error {
+	c.readTime.set(t)
+	c.writeTime.set(t)
+	return nil
+}
+
+// Implements net.Conn.SetReadDeadline, affecting pending reads too.
+func (c *tunnelConn) SetReadDeadline(t time.Time) error {
+	c.readTime.set(t)
+	return nil
+}
+
+// Implements net.Conn.SetWriteDeadline, affecting pending writes too.
+func (c *tunnelConn) SetWriteDeadline(t time.Time) error {
+	c.writeTime.set(t)
+	return nil
+}
+
+// Resettable deadline signaler, whose expiration channel is closed when the
+// deadline passes. Extending a not yet expired deadline keeps the channel, so
+// pending operations observe the change too.
+type deadline struct {
+	timer   *time.Timer    // Timer closing the expiration channel
+	expired chan time.Time // Channel closed upon expiration
+	lock    sync.Mutex     // Mutex to protect the timer and channel
+}
+
+// Creates a new deadline signaler with no deadline set.
+func newDeadline() *deadline {
+	return &deadline{
+		expired: make(chan time.Time),
+	}
+}
+
+// Sets a new deadline, or disables it if t is zero.
+func (d *deadline) set(t time.Time) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	// Stop any running timer, and renew the channel if already expired
+	if d.timer != nil && !d.timer.Stop() {
+		d.expired = make(chan time.Time)
+	}
+	d.timer = nil
+	if t.IsZero() {
+		return
+	}
+	// Schedule the expiration of the new deadline
+	expired := d.expired
+	if wait := time.Until(t); wait <= 0 {
+		close(expired)
+		d.timer = time.NewTimer(0) // Stopped timer marks the channel closed
+		d.timer.Stop()
+	} else {
+		d.timer = time.AfterFunc(wait, func() { close(expired) })
+	}
+}
+
+// Returns the channel closed upon the deadline's expiration.
+func (d *deadline) wait() <-chan time.Time {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	return d.expired
+}
@@ -0,0 +1,78 @@
+// Copyright (c) 2014 Project Iris. All rights reserved.
+//
+// The current language binding is an official support library of the Iris
+// cloud messaging framework, and as such, the same licensing terms apply.
+// For details please see http://iris.karalabe.com/downloads#License
+
+// Contains the traffic and flow control introspection of the tunnels.
+
+package iris
+
+import (
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// Snapshot of a tunnel's traffic and flow control state.
+type TunnelStats struct {
+	ID      uint64 // Local identifier of the tunnel
+	Cluster string // Remote cluster of the tunnel (empty if inbound)
+	Inbound bool   // Whether the tunnel was initiated remotely
+
+	SentMessages uint64        // Number of messages started sending
+	SentBytes    uint64        // Number of payload bytes sent
+	Allowance    int           // Remaining space allowance for sending
+	Blocked      time.Duration // Total time spent waiting for send allowance
+
+	RecvMessages uint64 // Number of messages started arriving
+	RecvBytes    uint64 // Number of payload bytes arrived
+	QueuedChunks int    // Number of arrived chunks not yet consumed
+	QueuedBytes  int    // Payload bytes arrived but not yet consumed
+	PartialBytes int    // Size of the message being assembled, if any
+}
+
+// Retrieves a snapshot of the tunnel's traffic and flow control state.
+func (t *Tunnel) Stats() *TunnelStats {
+	stats := &TunnelStats{
+		ID:      t.id,
+		Cluster: t.cluster,
+		Inbound: t.inbound,
+
+		SentMessages: atomic.LoadUint64(&t.atoiMsgs),
+		SentBytes:    atomic.LoadUint64(&t.atoiBytes),
+		Blocked:      time.Duration(atomic.LoadInt64(&t.atoiWait)),
+	}
+	t.atoiLock.Lock()
+	stats.Allowance = t.atoiSpace
+	t.atoiLock.Unlock()
+
+	t.itoaLock.Lock()
+	stats.RecvMessages = uint64(t.itoaMsgs)
+	stats.RecvBytes = t.itoaBytes
+	stats.QueuedChunks = t.itoaBuf.Size()
+	stats.QueuedBytes = t.itoaUsed
+	stats.PartialBytes = len(t.itoaPart)
+	t.itoaLock.Unlock()
+
+	return stats
+}
+
+// Retrieves the stats of all the live tunnels of the connection, ordered by
+// their ids. Stuck or slow peers can be spotted through a non-draining queue
+// or a growing blocked time.
+func (c *Connection) Tunnels() []*TunnelStats {
+	c.tunLock.RLock()
+	tunnels := make([]*Tunnel, 0, len(c.tunLive))
+	for _, tun := range c.tunLive {
+		tunnels = append(tunnels, tun)
+	}
+	c.tunLock.RUnlock()
+
+	stats := make([]*TunnelStats, len(tunnels))
+	for i, tun := range tunnels {
+		stats[i] = tun.Stats()
+	}
+	sort.Slice(stats, func(i, j int) bool { return stats[i].ID < stats[j].ID })
+	return stats
+}
@@ -0,0 +1,179 @@
+// Copyright (c) 2014 Project Iris. All rights reserved.
+//
+// The current language binding is an official support library of the Iris
+// cloud messaging framework, and as such, the same licensing terms apply.
+// For details please see http://iris.karalabe.com/downloads#License
+
+// Contains the chunk-by-chunk transfer of large tunnel messages.
+
+package iris
+
+import (
+	"errors"
+	"io"
+)
+
+// Sends a message of exactly size bytes read from r over the tunnel, without
+// buffering it in full. The data is transferred chunk by chunk, each one
+// waiting for the remote side's space allowance.
+//
+// The remote side may receive the message either via Recv or RecvStream. If r
+// ends prematurely or the transfer fails, the remote side discards the partial
+// message once the next one starts.
+func (t *Tunnel) SendStream(r io.Reader, size int64) error {
+	t.Log.Debug("sending message stream", "size", size)
+
+	// Sanity check on the arguments
+	if size <= 0 {
+		return errors.New("non-positive stream size")
+	}
+	// Read and send the chunks one by one, reusing the buffer
+	buffer := make([]byte, t.chunkLimit)
+	for sent := int64(0); sent < size; {
+		chunk := buffer
+		if left := size - sent; left < int64(len(chunk)) {
+			chunk = chunk[:left]
+		}
+		if _, err := io.ReadFull(r, chunk); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return err
+		}
+		sizeOrCont := 0
+		if sent == 0 {
+			sizeOrCont = int(size)
+		}
+		if err := t.sendChunk(chunk, sizeOrCont, nil); err != nil {
+			return err
+		}
+		sent += int64(len(chunk))
+	}
+	return nil
+}
+
+// Retrieves the next message from the tunnel as a stream, blocking until its
+// first chunk arrives. Returned are a reader delivering the message contents
+// chunk by chunk as they arrive, and the total size of the message. Once the
+// remote side finished sending, io.EOF is returned.
+//
+// The message needs to be fully read before the next one can be received. If
+// the sender abandons the message midway, the reader fails with
+// io.ErrUnexpectedEOF.
+func (t *Tunnel) RecvStream() (io.Reader, int64, error) {
+	for closed := false; ; {
+		if chunk, eof := t.fetchStreamStart(); chunk != nil {
+			reader := &tunnelReader{
+				tun:  t,
+				buf:  chunk.data,
+				left: int64(chunk.size - len(chunk.data)),
+			}
+			return reader, int64(chunk.size), nil
+		} else if eof {
+			return nil, 0, io.EOF
+		}
+		if closed {
+			return nil, 0, ErrClosed
+		}
+		select {
+		case <-t.term:
+			// Terminated, but deliver anything that arrived before
+			closed = true
+		case <-t.itoaSign:
+			// Potentially a new message started, retry
+		}
+	}
+}
+
+// Fetches the first chunk of the next buffered message, or nil if none started
+// arriving yet. Any partially received message is discarded. The eof flag
+// reports whether the remote side finished sending.
+func (t *Tunnel) fetchStreamStart() (chunk *tunnelChunk, eof bool) {
+	t.itoaLock.Lock()
+	defer t.itoaLock.Unlock()
+
+	if t.itoaPart != nil {
+		t.Log.Warn("incomplete message discarded", "size", cap(t.itoaPart), "arrived", len(t.itoaPart))
+		t.itoaPart = nil
+	}
+	for !t.itoaEOF && !t.itoaBuf.Empty() {
+		chunk := t.itoaBuf.Pop().(*tunnelChunk)
+		t.releaseAllowance(len(chunk.data))
+
+		switch {
+		case chunk.eof():
+			t.itoaEOF = true
+		case chunk.size != 0:
+			return chunk, false
+		}
+		// Remainder of an already discarded message, skip
+	}
+	// No message start, reset arrival flag
+	select {
+	case <-t.itoaSign:
+	default:
+	}
+	return nil, t.itoaEOF
+}
+
+// Fetches the next continuation chunk of the message being streamed, blocking
+// until one arrives. If a new message starts or the remote side finishes
+// instead, io.ErrUnexpectedEOF is returned, leaving them in the buffer.
+func (t *Tunnel) fetchStreamChunk() ([]byte, error) {
+	for closed := false; ; {
+		t.itoaLock.Lock()
+		if !t.itoaBuf.Empty() {
+			chunk := t.itoaBuf.Front().(*tunnelChunk)
+			if chunk.size != 0 || chunk.eof() {
+				t.itoaLock.Unlock()
+				return nil, io.ErrUnexpectedEOF
+			}
+			t.itoaBuf.Pop()
+			t.releaseAllowance(len(chunk.data))
+			t.itoaLock.Unlock()
+
+			return chunk.data, nil
+		}
+		// No chunk, reset arrival flag and wait
+		select {
+		case <-t.itoaSign:
+		default:
+		}
+		t.itoaLock.Unlock()
+
+		if closed {
+			return nil, ErrClosed
+		}
+		select {
+		case <-t.term:
+			// Terminated, but deliver anything that arrived before
+			closed = true
+		case <-t.itoaSign:
+			// Potentially a chunk arrived, retry
+		}
+	}
+}
+
+// Stream reader over a single tunnel message, consuming it chunk by chunk.
+type tunnelReader struct {
+	tun  *Tunnel // Tunnel delivering the message
+	buf  []byte  // Unread remainder of the current chunk
+	left int64   // Message bytes not yet fetched from the tunnel
+}
+
+// Implements io.Reader, reading the message contents as they arrive.
+func (r *tunnelReader) Read(p []byte) (int, error) {
+	if len(r.buf) == 0 {
+		if r.left == 0 {
+			return 0, io.EOF
+		}
+		chunk, err := r.tun.fetchStreamChunk()
+		if err != nil {
+			return 0, err
+		}
+		r.buf, r.left = chunk, r.left-int64(len(chunk))
+	}
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}